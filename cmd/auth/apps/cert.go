@@ -0,0 +1,232 @@
+package apps
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var CertCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Issue, list and revoke ssh certificates of the daemon CA",
+	Long:  AppDescription,
+}
+
+var signCertCmd = &cobra.Command{
+	Use:   "sign [username] [public key file]",
+	Short: "Issue a short lived certificate for a public key, '-' reads the key from stdin",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
+
+		token, _ := cmd.Flags().GetString("token")
+
+		if err := SignCert(args[0], args[1], token); err != nil {
+			log.Err(err).Send()
+			os.Exit(1)
+		}
+	},
+}
+
+var listCertCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List issued certificates",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
+
+		if err := ListCerts(false); err != nil {
+			log.Err(err).Send()
+			os.Exit(1)
+		}
+	},
+}
+
+var krlCertCmd = &cobra.Command{
+	Use:   "krl",
+	Short: "Print the revoked serials as ssh-keygen -k specification",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
+
+		if err := ListCerts(true); err != nil {
+			log.Err(err).Send()
+			os.Exit(1)
+		}
+	},
+}
+
+var revokeCertCmd = &cobra.Command{
+	Use:   "revoke [serial]",
+	Short: "Revoke an issued certificate",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
+
+		if err := RevokeCert(args[0]); err != nil {
+			log.Err(err).Send()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	signCertCmd.Flags().String("token", "", "identity provider access token, required for keys unknown to sshkeyman")
+
+	CertCmd.AddCommand(signCertCmd, listCertCmd, krlCertCmd, revokeCertCmd)
+}
+
+// SignCert requests a certificate for the public key and prints it.
+func SignCert(username, keyFile, token string) error {
+	var (
+		publicKey []byte
+		err       error
+	)
+
+	if keyFile == "-" {
+		publicKey, err = io.ReadAll(os.Stdin)
+	} else {
+		publicKey, err = os.ReadFile(keyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("read public key: %w", err)
+	}
+
+	cfg := domain.LoadConfig()
+
+	// signing is served to every user, not only on the management socket
+	client, err := protocol.Dial(cfg.SocketPath, 3*time.Second)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	f, err := client.Call("SIGNCERT", username, string(publicKey), token)
+	if err != nil {
+		return fmt.Errorf("sign certificate: %w", err)
+	}
+
+	if len(f.Fields) != 1 {
+		return fmt.Errorf("malformed certificate record with %d fields", len(f.Fields))
+	}
+
+	if _, err := os.Stdout.WriteString(f.Fields[0]); err != nil {
+		return fmt.Errorf("write certificate: %w", err)
+	}
+
+	return nil
+}
+
+// ListCerts prints the issued certificates, or only the revoked serials in
+// key revocation list specification format.
+func ListCerts(krl bool) error {
+	cfg := domain.LoadConfig()
+
+	client, err := protocol.Dial(cfg.ManagementSocketPath, 3*time.Second)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	if err := client.Send("CERTS"); err != nil {
+		return fmt.Errorf("sent command: %w", err)
+	}
+
+	var certs []domain.CertDto
+
+	for {
+		f, err := client.Receive()
+		if err != nil {
+			return fmt.Errorf("read response: %w", err)
+		}
+
+		if err := f.Err(); err != nil {
+			return fmt.Errorf("daemon: %w", err)
+		}
+
+		if f.Status == protocol.StatusEnd {
+			break
+		}
+
+		if len(f.Fields) != 8 {
+			return fmt.Errorf("malformed certificate record with %d fields", len(f.Fields))
+		}
+
+		serial, err := strconv.ParseUint(f.Fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed serial: %w", err)
+		}
+
+		validAfter, err := time.Parse(time.RFC3339, f.Fields[5])
+		if err != nil {
+			return fmt.Errorf("malformed validity: %w", err)
+		}
+
+		validBefore, err := time.Parse(time.RFC3339, f.Fields[6])
+		if err != nil {
+			return fmt.Errorf("malformed validity: %w", err)
+		}
+
+		certs = append(certs, domain.CertDto{
+			Serial:      serial,
+			KeyId:       f.Fields[1],
+			Username:    f.Fields[2],
+			Fingerprint: f.Fields[3],
+			Principals:  strings.Split(f.Fields[4], ","),
+			ValidAfter:  validAfter,
+			ValidBefore: validBefore,
+			Revoked:     f.Fields[7] == "true",
+		})
+	}
+
+	if krl {
+		_, err := os.Stdout.WriteString(domain.KRL(certs))
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(w, "SERIAL\tUSER\tFINGERPRINT\tPRINCIPALS\tVALID AFTER\tVALID BEFORE\tREVOKED")
+
+	for _, cert := range certs {
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%t\n", cert.Serial, cert.Username, cert.Fingerprint,
+			strings.Join(cert.Principals, ","), cert.ValidAfter.Format(time.RFC3339), cert.ValidBefore.Format(time.RFC3339), cert.Revoked)
+	}
+
+	return w.Flush()
+}
+
+// RevokeCert marks the certificate with the given serial as revoked.
+func RevokeCert(serial string) error {
+	cfg := domain.LoadConfig()
+
+	client, err := protocol.Dial(cfg.ManagementSocketPath, 3*time.Second)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	if _, err := client.Call("REVOKECERT", serial); err != nil {
+		return fmt.Errorf("revoke certificate: %w", err)
+	}
+
+	log.Info().Str("serial", serial).Msg("revoked")
+
+	return nil
+}
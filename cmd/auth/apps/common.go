@@ -4,6 +4,9 @@ const (
 	AppDescription = `This is ssh key management tool. Here is the options:
 	- new_user: Create new user with ssh key into internal database
 	- ssh-auth-key: Ssh Auth key for specific user
+	- ssh_auth_principals: Ssh certificate principals for specific user
+	- cert: Issue, list and revoke ssh certificates signed by the daemon CA
+	- keys: Show accepted and rejected keys of a user with the rejection reason
 	- sync-user: Sync local database from centeral authentication system (keycloak etc.)
 	- server: Daemon to manage data etc.`
 )
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -13,9 +14,11 @@ import (
 
 	"github.com/h2hsecure/sshkeyman/internal/adapter"
 	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
 	"github.com/protosam/go-libnss/structs"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -38,9 +41,16 @@ var DaemonCmd = &cobra.Command{
 	},
 }
 
+// enumPageSize is the number of passwd entries sent per GETPWENT request.
+const enumPageSize = 64
+
 func NewDaemon(c chan os.Signal) error {
 	cfg := domain.LoadConfig()
 
+	if err := cfg.Principals.Validate(); err != nil {
+		return fmt.Errorf("principals: %w", err)
+	}
+
 	_ = os.Remove(cfg.SocketPath)
 	_ = os.Remove(cfg.ManagementSocketPath)
 
@@ -77,9 +87,12 @@ func NewDaemon(c chan os.Signal) error {
 		return fmt.Errorf("db open: %w", err)
 	}
 
-	keycloak := adapter.NewKeyCloakAdapter(cfg)
+	backend, err := adapter.NewBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("backend: %w", err)
+	}
 
-	srv := domain.NewService(cfg, db, keycloak)
+	srv := domain.NewService(cfg, db, backend)
 
 	grp, ctx := errgroup.WithContext(context.Background())
 
@@ -106,21 +119,59 @@ func NewDaemon(c chan os.Signal) error {
 	})
 
 	grp.Go(func() error {
-		ticker := time.NewTicker(1 * time.Minute)
+		ticker := time.NewTicker(lo.Ternary(cfg.Sync.Interval > 0, cfg.Sync.Interval, time.Minute))
+		fullInterval := lo.Ternary(cfg.Sync.FullInterval > 0, cfg.Sync.FullInterval, time.Hour)
+
+		// the first sync is a full sync
+		var lastFull time.Time
 
 		for {
 			select {
 			case <-ctx.Done():
 				return fmt.Errorf("closing")
 			case <-ticker.C:
-				err := SyncUser(c)
-				if err != nil {
-					return fmt.Errorf("sync: %w", err)
+				if _, err := srv.PurgeExpiredKeys(ctx); err != nil {
+					log.Err(err).Msg("purging expired keys")
+				}
+
+				full := time.Since(lastFull) >= fullInterval
+
+				// a failed sync is retried with the next tick, the stored
+				// users are served meanwhile
+				if err := syncUsers(!full, c); err != nil {
+					log.Err(err).Bool("full", full).Msg("sync failed")
+					continue
+				}
+
+				if full {
+					lastFull = time.Now()
 				}
 			}
 		}
 	})
 
+	if cfg.Scim.Listen != "" {
+		scim, err := newScimServer(cfg, srv)
+		if err != nil {
+			return fmt.Errorf("scim: %w", err)
+		}
+
+		grp.Go(func() error {
+			log.Info().Str("listen", cfg.Scim.Listen).Msg("scim server listening")
+
+			if cfg.Scim.TLSCert != "" {
+				return fmt.Errorf("scim: %w", scim.ListenAndServeTLS(cfg.Scim.TLSCert, cfg.Scim.TLSKey))
+			}
+
+			return fmt.Errorf("scim: %w", scim.ListenAndServe())
+		})
+
+		grp.Go(func() error {
+			<-ctx.Done()
+			return scim.Close()
+		})
+	}
+
 	grp.Go(func() error {
 		s := <-c
 		return fmt.Errorf("signal recieved: %v", s)
@@ -134,66 +185,210 @@ func NewDaemon(c chan os.Signal) error {
 	return nil
 }
 
+// newScimServer builds the http server of the SCIM endpoint.
+func newScimServer(cfg *domain.Config, srv domain.IService) (*http.Server, error) {
+	if (cfg.Scim.TLSCert == "") != (cfg.Scim.TLSKey == "") {
+		return nil, errors.New("tls_cert and tls_key must be set together")
+	}
+
+	if cfg.Scim.TLSCert == "" {
+		log.Warn().Msg("scim served without tls, terminate tls in a proxy")
+	}
+
+	handler, err := adapter.NewScimHandler(cfg, srv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Server{
+		Addr:              cfg.Scim.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      time.Minute,
+	}, nil
+}
+
+// handleSignCert issues a certificate for the username, public key and
+// optional token arguments.
+func handleSignCert(ctx context.Context, conn net.Conn, args []string, srv domain.IService) {
+	if len(args) != 2 && len(args) != 3 {
+		log.Warn().Interface("params", args).Msg("wrong data provided")
+		reply(conn, protocol.StatusUnavail)
+		return
+	}
+
+	var token string
+	if len(args) == 3 {
+		token = args[2]
+	}
+
+	cert, err := srv.IssueCertificate(ctx, args[0], args[1], token)
+	if err != nil {
+		log.Warn().Err(err).Str("user", args[0]).Msg("issuing certificate")
+		reply(conn, statusOf(err), err.Error())
+		return
+	}
+
+	reply(conn, protocol.StatusOK, cert)
+}
+
 func handleManagementConn(ctx context.Context, conn net.Conn, srv domain.IService) {
 	defer func() {
 		_ = conn.Close()
 	}()
 
-	// Hard timeout: NSS must never block
 	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
 
-	r := bufio.NewReader(conn)
-	line, err := r.ReadString('\n')
+	req, err := protocol.ReadRequest(bufio.NewReader(conn))
 	if err != nil {
 		log.Err(err).Msg("reading socket")
 		return
 	}
 
-	line = strings.TrimSpace(line)
-	fields := strings.Fields(line)
+	log.Info().Str("command", req.Command).Bool("legacy", req.Legacy).Msg("handling")
 
-	log.Info().Str("command", fields[0]).Msg("handling")
+	// a sync is limited by the sync timeout instead
+	if req.Command == "SYNC" {
+		_ = conn.SetDeadline(time.Time{})
+	}
+
+	if req.Legacy {
+		handleLegacyManagementConn(ctx, conn, append([]string{req.Command}, req.Args...), srv)
+		return
+	}
 
-	switch fields[0] {
+	switch req.Command {
 	case "SETUSER":
-		if len(fields) != 5 {
-			log.Warn().Interface("params", fields).Msg("wrong data provided")
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		if len(req.Args) < 4 || len(req.Args) > 7 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data provided")
+			reply(conn, protocol.StatusUnavail)
 			return
 		}
 
-		usernameOrId := fields[1]
-		var keyDto domain.KeyDto
+		keyDto := domain.KeyDto{
+			User: structs.Passwd{
+				Username: req.Args[0],
+			},
+			SshKeys: []domain.SshKey{
+				{
+					Aglo: req.Args[1],
+					Key:  req.Args[2],
+					Name: req.Args[3],
+				},
+			},
+		}
 
-		keyDto.User = structs.Passwd{
-			Username: usernameOrId,
+		if len(req.Args) > 4 {
+			keyDto.SshKeys[0].Options = req.Args[4]
 		}
 
-		keyDto.SshKeys = append(keyDto.SshKeys, domain.SshKey{
-			Aglo: fields[2],
-			Key:  fields[3],
-			Name: fields[4],
-		})
+		if keyDto.SshKeys[0].NotAfter, err = optionalTime(req.Args, 5); err != nil {
+			reply(conn, protocol.StatusUnavail, err.Error())
+			return
+		}
+
+		if keyDto.SshKeys[0].NotBefore, err = optionalTime(req.Args, 6); err != nil {
+			reply(conn, protocol.StatusUnavail, err.Error())
+			return
+		}
 
 		if err := srv.AddUser(ctx, keyDto); err != nil {
 			log.Warn().Err(err).Msg("creating user")
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			reply(conn, statusOf(err), err.Error())
 			return
 		}
 
-		_, _ = fmt.Fprint(conn, "OK\n")
+		reply(conn, protocol.StatusOK)
 	case "SYNC":
-		err := srv.Sync(ctx)
-		if err != nil {
+		syncUsers := srv.Sync
+		if len(req.Args) == 1 && req.Args[0] == "changes" {
+			syncUsers = srv.SyncChanges
+		}
+
+		if err := syncUsers(ctx); err != nil {
 			log.Err(err).Msg("syncing")
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			reply(conn, statusOf(err), err.Error())
+			return
+		}
+
+		reply(conn, protocol.StatusOK)
+	case "GETKEYS":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data provided")
+			reply(conn, protocol.StatusUnavail)
 			return
 		}
 
-		_, _ = fmt.Fprint(conn, "OK\n")
+		keyDto, err := srv.FindUser(ctx, domain.WithUsername(req.Args[0]))
+		if err != nil {
+			reply(conn, statusOf(err))
+			return
+		}
+
+		now := time.Now()
+
+		for _, key := range keyDto.SshKeys {
+			if key.ValidAt(now) {
+				reply(conn, protocol.StatusOK, "accepted", key.Fingerprint, key.AuthorizedKey(), keyWindow(key))
+				continue
+			}
+
+			reply(conn, protocol.StatusOK, "inactive", key.Fingerprint, key.AuthorizedKey(), keyWindow(key))
+		}
+
+		for _, key := range keyDto.RejectedKeys {
+			reply(conn, protocol.StatusOK, "rejected", key.Fingerprint, key.Key, key.Reason)
+		}
+
+		reply(conn, protocol.StatusEnd)
+	case "SIGNCERT":
+		handleSignCert(ctx, conn, req.Args, srv)
+	case "CERTS":
+		certs, err := srv.ListCertificates(ctx)
+		if err != nil {
+			reply(conn, statusOf(err), err.Error())
+			return
+		}
+
+		for _, cert := range certs {
+			reply(
+				conn,
+				protocol.StatusOK,
+				strconv.FormatUint(cert.Serial, 10),
+				cert.KeyId,
+				cert.Username,
+				cert.Fingerprint,
+				strings.Join(cert.Principals, ","),
+				cert.ValidAfter.Format(time.RFC3339),
+				cert.ValidBefore.Format(time.RFC3339),
+				strconv.FormatBool(cert.Revoked),
+			)
+		}
+
+		reply(conn, protocol.StatusEnd)
+	case "REVOKECERT":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data provided")
+			reply(conn, protocol.StatusUnavail)
+			return
+		}
+
+		serial, err := strconv.ParseUint(req.Args[0], 10, 64)
+		if err != nil {
+			reply(conn, protocol.StatusNotFound)
+			return
+		}
+
+		if err := srv.RevokeCertificate(ctx, serial); err != nil {
+			reply(conn, statusOf(err), err.Error())
+			return
+		}
+
+		reply(conn, protocol.StatusOK)
 	default:
-		log.Warn().Interface("command", fields[0]).Msg("wrong request")
-		_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		log.Warn().Str("command", req.Command).Msg("wrong request")
+		reply(conn, protocol.StatusUnavail)
 	}
 }
 
@@ -205,96 +400,268 @@ func handleConn(ctx context.Context, conn net.Conn, srv domain.IService) {
 	// Hard timeout: NSS must never block
 	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
 
-	r := bufio.NewReader(conn)
-	line, err := r.ReadString('\n')
+	req, err := protocol.ReadRequest(bufio.NewReader(conn))
 	if err != nil {
 		log.Err(err).Msg("reading socket")
 		return
 	}
 
-	line = strings.TrimSpace(line)
-	fields := strings.Fields(line)
+	log.Info().Str("command", req.Command).Bool("legacy", req.Legacy).Msg("handling")
 
-	log.Info().Str("command", fields[0]).Msg("handling")
+	if req.Legacy {
+		handleLegacyConn(ctx, conn, append([]string{req.Command}, req.Args...), srv)
+		return
+	}
 
-	switch fields[0] {
+	switch req.Command {
 	case "GETPWNAM":
-		if len(fields) != 2 {
-			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
 			return
 		}
 
-		usernameOrId := fields[1]
-		user, err := srv.FindUser(ctx, domain.WithUsername(usernameOrId))
-		if err != nil && !errors.Is(err, domain.ErrNotFound) {
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		user, err := srv.FindUser(ctx, domain.WithUsername(req.Args[0]))
+		if err != nil {
+			reply(conn, statusOf(err))
 			return
 		}
 
-		if errors.Is(err, domain.ErrNotFound) {
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		replyPasswd(conn, user)
+	case "GETPWUID":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
 			return
 		}
 
-		_, _ = fmt.Fprintf(
-			conn,
-			"OK %s %d %d %s %s\n",
-			user.User.Username,
-			user.User.UID,
-			user.User.GID,
-			user.User.Dir,
-			user.User.Shell,
-		)
-	case "GETPWUID":
-		if len(fields) != 2 {
-			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+		uid, err := strconv.ParseUint(req.Args[0], 10, 32)
+		if err != nil {
+			reply(conn, protocol.StatusNotFound)
 			return
 		}
 
-		usernameOrId := fields[1]
-		uid, _ := strconv.ParseUint(usernameOrId, 10, 32)
 		user, err := srv.FindUser(ctx, domain.WithUserId(uint(uid)))
-		if err != nil && !errors.Is(err, domain.ErrNotFound) {
-			log.Err(err).Msg("fetch user has problem")
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		if err != nil {
+			reply(conn, statusOf(err))
 			return
 		}
 
-		if errors.Is(err, domain.ErrNotFound) {
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		replyPasswd(conn, user)
+	case "GETPWENT":
+		if len(req.Args) > 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
+			return
+		}
+
+		var cursor string
+		if len(req.Args) == 1 {
+			cursor = req.Args[0]
+		}
+
+		users, next, err := srv.ListUsers(ctx, cursor, enumPageSize)
+		if err != nil {
+			reply(conn, statusOf(err))
+			return
+		}
+
+		for _, user := range users {
+			replyPasswd(conn, user)
+		}
+
+		if next == "" {
+			reply(conn, protocol.StatusEnd)
 			return
 		}
 
-		_, _ = fmt.Fprintf(
+		reply(conn, protocol.StatusEnd, next)
+	case "GETSSHKEY":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
+			return
+		}
+
+		keyDto, err := srv.FindUser(ctx, domain.WithUsername(req.Args[0]))
+		if err != nil {
+			reply(conn, statusOf(err))
+			return
+		}
+
+		for _, key := range keyDto.ValidKeys(time.Now()) {
+			reply(conn, protocol.StatusOK, key.Aglo, key.Key, key.Name, key.Options)
+		}
+
+		reply(conn, protocol.StatusEnd)
+	case "GETPRINCIPALS":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
+			return
+		}
+
+		principals, err := srv.AuthorizedPrincipals(ctx, req.Args[0])
+		if err != nil {
+			reply(conn, statusOf(err))
+			return
+		}
+
+		reply(conn, protocol.StatusOK, principals...)
+	case "SIGNCERT":
+		// users request their own certificates, IssueCertificate checks
+		// the key or the token
+		handleSignCert(ctx, conn, req.Args, srv)
+	case "GETSPNAM":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
+			return
+		}
+
+		shadow, err := srv.FindShadow(ctx, req.Args[0])
+		if err != nil {
+			reply(conn, statusOf(err))
+			return
+		}
+
+		reply(
 			conn,
-			"OK %s %d %d %s %s\n",
-			user.User.Username,
-			user.User.UID,
-			user.User.GID,
-			user.User.Dir,
-			user.User.Shell,
+			protocol.StatusOK,
+			shadow.Username,
+			shadow.Password,
+			strconv.Itoa(shadow.LastChange),
+			strconv.Itoa(shadow.MinChange),
+			strconv.Itoa(shadow.MaxChange),
+			strconv.Itoa(shadow.PasswordWarn),
+			strconv.Itoa(shadow.InactiveLockout),
+			strconv.Itoa(shadow.ExpirationDate),
 		)
-	case "GETSSHKEY":
-		if len(fields) != 2 {
-			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+	case "GETGRNAM":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
 			return
 		}
 
-		usernameOrId := fields[1]
-		keyDto, err := srv.FindUser(ctx, domain.WithUsername(usernameOrId))
-		if err != nil && !errors.Is(err, domain.ErrNotFound) {
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		group, err := srv.FindGroup(ctx, domain.WithGroupname(req.Args[0]))
+		if err != nil {
+			reply(conn, statusOf(err))
 			return
 		}
 
-		if errors.Is(err, domain.ErrNotFound) {
-			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+		replyGroup(conn, group)
+	case "GETGRGID":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
 			return
 		}
 
-		for _, key := range keyDto.SshKeys {
-			_, _ = fmt.Fprintf(conn, "OK %s %s %s\n", key.Aglo, key.Key, key.Name)
+		gid, err := strconv.ParseUint(req.Args[0], 10, 32)
+		if err != nil {
+			reply(conn, protocol.StatusNotFound)
+			return
 		}
 
+		group, err := srv.FindGroup(ctx, domain.WithGroupId(uint(gid)))
+		if err != nil {
+			reply(conn, statusOf(err))
+			return
+		}
+
+		replyGroup(conn, group)
+	case "INITGROUPS":
+		if len(req.Args) != 1 {
+			log.Warn().Interface("params", req.Args).Msg("wrong data recieved")
+			reply(conn, protocol.StatusUnavail)
+			return
+		}
+
+		groups, err := srv.UserGroups(ctx, req.Args[0])
+		if err != nil {
+			reply(conn, statusOf(err))
+			return
+		}
+
+		reply(conn, protocol.StatusOK, lo.Map(groups, func(item domain.GroupDto, _ int) string {
+			return strconv.FormatUint(uint64(item.Group.GID), 10)
+		})...)
+	default:
+		log.Warn().Str("command", req.Command).Msg("wrong request")
+		reply(conn, protocol.StatusUnavail)
+	}
+}
+
+// statusOf maps a service error to the protocol status sent to clients.
+func statusOf(err error) protocol.Status {
+	switch {
+	case errors.Is(err, domain.ErrNotFound), errors.Is(err, domain.ErrEnumerationDisabled):
+		return protocol.StatusNotFound
+	case errors.Is(err, domain.ErrInvalidKey), errors.Is(err, domain.ErrKeyPolicy),
+		errors.Is(err, domain.ErrUnauthorized), errors.Is(err, domain.ErrCADisabled):
+		return protocol.StatusUnavail
+	case errors.Is(err, context.DeadlineExceeded):
+		return protocol.StatusTryAgain
+	default:
+		log.Err(err).Msg("request failed")
+		return protocol.StatusUnavail
+	}
+}
+
+// optionalTime parses the optional RFC 3339 argument at index i, a missing
+// or empty argument yields the zero time.
+func optionalTime(args []string, i int) (time.Time, error) {
+	if len(args) <= i || args[i] == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, args[i])
+}
+
+// keyWindow describes the validity window of a key, empty when the key is
+// not restricted.
+func keyWindow(key domain.SshKey) string {
+	var window []string
+
+	if !key.NotBefore.IsZero() {
+		window = append(window, "valid from "+key.NotBefore.Format(time.RFC3339))
 	}
+
+	if !key.NotAfter.IsZero() {
+		window = append(window, "expires "+key.NotAfter.Format(time.RFC3339))
+	}
+
+	return strings.Join(window, ", ")
+}
+
+func reply(conn net.Conn, status protocol.Status, fields ...string) {
+	if err := protocol.WriteFrame(conn, protocol.Frame{Status: status, Fields: fields}); err != nil {
+		log.Warn().Err(err).Msg("writing socket")
+	}
+}
+
+func replyPasswd(conn net.Conn, user domain.KeyDto) {
+	reply(
+		conn,
+		protocol.StatusOK,
+		user.User.Username,
+		"x",
+		strconv.FormatUint(uint64(user.User.UID), 10),
+		strconv.FormatUint(uint64(user.User.GID), 10),
+		user.User.Gecos,
+		user.User.Dir,
+		user.User.Shell,
+	)
+}
+
+func replyGroup(conn net.Conn, group domain.GroupDto) {
+	reply(
+		conn,
+		protocol.StatusOK,
+		group.Group.Groupname,
+		"x",
+		strconv.FormatUint(uint64(group.Group.GID), 10),
+		strings.Join(group.Group.Members, ","),
+	)
 }
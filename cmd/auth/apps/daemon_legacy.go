@@ -0,0 +1,261 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/protosam/go-libnss/structs"
+	"github.com/rs/zerolog/log"
+)
+
+// handleLegacyManagementConn serves a management request received in the
+// legacy text format. fields holds the command followed by its arguments.
+func handleLegacyManagementConn(ctx context.Context, conn net.Conn, fields []string, srv domain.IService) {
+	switch fields[0] {
+	case "SETUSER":
+		if len(fields) != 5 {
+			log.Warn().Interface("params", fields).Msg("wrong data provided")
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		usernameOrId := fields[1]
+		var keyDto domain.KeyDto
+
+		keyDto.User = structs.Passwd{
+			Username: usernameOrId,
+		}
+
+		keyDto.SshKeys = append(keyDto.SshKeys, domain.SshKey{
+			Aglo: fields[2],
+			Key:  fields[3],
+			Name: fields[4],
+		})
+
+		if err := srv.AddUser(ctx, keyDto); err != nil {
+			log.Warn().Err(err).Msg("creating user")
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		_, _ = fmt.Fprint(conn, "OK\n")
+	case "SYNC":
+		err := srv.Sync(ctx)
+		if err != nil {
+			log.Err(err).Msg("syncing")
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		_, _ = fmt.Fprint(conn, "OK\n")
+	default:
+		log.Warn().Interface("command", fields[0]).Msg("wrong request")
+		_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+	}
+}
+
+// handleLegacyConn serves an NSS request received in the legacy text
+// format. fields holds the command followed by its arguments.
+func handleLegacyConn(ctx context.Context, conn net.Conn, fields []string, srv domain.IService) {
+	switch fields[0] {
+	case "GETPWNAM":
+		if len(fields) != 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		usernameOrId := fields[1]
+		user, err := srv.FindUser(ctx, domain.WithUsername(usernameOrId))
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		if errors.Is(err, domain.ErrNotFound) {
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		writeLegacyPasswd(conn, user)
+	case "GETPWUID":
+		if len(fields) != 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		usernameOrId := fields[1]
+		uid, _ := strconv.ParseUint(usernameOrId, 10, 32)
+		user, err := srv.FindUser(ctx, domain.WithUserId(uint(uid)))
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			log.Err(err).Msg("fetch user has problem")
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		if errors.Is(err, domain.ErrNotFound) {
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		writeLegacyPasswd(conn, user)
+	case "GETSSHKEY":
+		if len(fields) != 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		usernameOrId := fields[1]
+		keyDto, err := srv.FindUser(ctx, domain.WithUsername(usernameOrId))
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		if errors.Is(err, domain.ErrNotFound) {
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		for _, key := range keyDto.ValidKeys(time.Now()) {
+			// the legacy reply has no field for options, serving the key
+			// without its restrictions would widen the access
+			if key.Options != "" {
+				log.Warn().Str("user", usernameOrId).Str("fingerprint", key.Fingerprint).Msg("key with options not served over the legacy protocol")
+				continue
+			}
+
+			_, _ = fmt.Fprintf(conn, "OK %s %s %s\n", key.Aglo, key.Key, key.Name)
+		}
+	case "GETPWENT":
+		if len(fields) > 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		var cursor string
+		if len(fields) == 2 {
+			cursor = fields[1]
+		}
+
+		users, next, err := srv.ListUsers(ctx, cursor, enumPageSize)
+		if err != nil {
+			if !errors.Is(err, domain.ErrEnumerationDisabled) {
+				log.Err(err).Msg("list users has problem")
+			}
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		for _, user := range users {
+			writeLegacyPasswd(conn, user)
+		}
+
+		_, _ = fmt.Fprintf(conn, "END %s\n", next)
+	case "GETSPNAM":
+		if len(fields) != 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		shadow, err := srv.FindShadow(ctx, fields[1])
+		if err != nil {
+			if !errors.Is(err, domain.ErrNotFound) {
+				log.Err(err).Msg("fetch shadow has problem")
+			}
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		_, _ = fmt.Fprintf(
+			conn,
+			"OK %s %s %d %d %d %d %d %d\n",
+			shadow.Username,
+			shadow.Password,
+			shadow.LastChange,
+			shadow.MinChange,
+			shadow.MaxChange,
+			shadow.PasswordWarn,
+			shadow.InactiveLockout,
+			shadow.ExpirationDate,
+		)
+	case "GETGRNAM":
+		if len(fields) != 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		group, err := srv.FindGroup(ctx, domain.WithGroupname(fields[1]))
+		if err != nil {
+			if !errors.Is(err, domain.ErrNotFound) {
+				log.Err(err).Msg("fetch group has problem")
+			}
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		writeLegacyGroup(conn, group)
+	case "GETGRGID":
+		if len(fields) != 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		gid, _ := strconv.ParseUint(fields[1], 10, 32)
+		group, err := srv.FindGroup(ctx, domain.WithGroupId(uint(gid)))
+		if err != nil {
+			if !errors.Is(err, domain.ErrNotFound) {
+				log.Err(err).Msg("fetch group has problem")
+			}
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		writeLegacyGroup(conn, group)
+	case "INITGROUPS":
+		if len(fields) != 2 {
+			log.Warn().Interface("params", fields).Msg("wrong data recieved")
+			return
+		}
+
+		groups, err := srv.UserGroups(ctx, fields[1])
+		if err != nil {
+			log.Err(err).Msg("fetch user groups has problem")
+			_, _ = fmt.Fprint(conn, "NOTFOUND\n")
+			return
+		}
+
+		_, _ = fmt.Fprint(conn, "OK")
+		for _, group := range groups {
+			_, _ = fmt.Fprintf(conn, " %d", group.Group.GID)
+		}
+		_, _ = fmt.Fprint(conn, "\n")
+	}
+}
+
+func writeLegacyGroup(conn net.Conn, group domain.GroupDto) {
+	_, _ = fmt.Fprintf(
+		conn,
+		"OK %s %d %s\n",
+		group.Group.Groupname,
+		group.Group.GID,
+		strings.Join(group.Group.Members, ","),
+	)
+}
+
+func writeLegacyPasswd(conn net.Conn, user domain.KeyDto) {
+	_, _ = fmt.Fprintf(
+		conn,
+		"OK %s %d %d %s %s\n",
+		user.User.Username,
+		user.User.UID,
+		user.User.GID,
+		user.User.Dir,
+		user.User.Shell,
+	)
+}
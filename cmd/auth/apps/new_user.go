@@ -1,19 +1,21 @@
 package apps
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
 var NewUserCmd = &cobra.Command{
-	Use:   "new [user] [key]",
+	Use:   "new [user] [algo] [key] [comment]",
 	Short: "Create new user record for ssh keys database",
 	Long:  AppDescription,
 	Args:  cobra.MinimumNArgs(4),
@@ -22,43 +24,56 @@ var NewUserCmd = &cobra.Command{
 		c := make(chan os.Signal, 1)
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
 
+		options, _ := cmd.Flags().GetString("options")
+		expires, _ := cmd.Flags().GetString("expires")
+		notBefore, _ := cmd.Flags().GetString("not-before")
+
 		// Launch the application
-		if err := NewUser(args, c); err != nil {
+		if err := NewUser(args, options, expires, notBefore, c); err != nil {
 			log.Err(err).Interface("args", args).Send()
 			os.Exit(1)
 		}
 	},
 }
 
-func NewUser(args []string, c chan os.Signal) error {
+func init() {
+	NewUserCmd.Flags().String("options", "", "authorized_keys options of the key, e.g. 'from=\"10.0.0.0/8\",no-pty'")
+	NewUserCmd.Flags().String("expires", "", "date the key stops being served (RFC 3339 or YYYY-MM-DD)")
+	NewUserCmd.Flags().String("not-before", "", "date the key starts being served (RFC 3339 or YYYY-MM-DD)")
+}
+
+func NewUser(args []string, options, expires, notBefore string, c chan os.Signal) error {
 	cfg := domain.LoadConfig()
 
-	conn, err := net.Dial("unix", cfg.ManagementSocketPath)
+	window := make([]string, 2)
+
+	for i, value := range []string{expires, notBefore} {
+		if value == "" {
+			continue
+		}
+
+		t, err := domain.ParseDate(value)
+		if err != nil {
+			return err
+		}
+
+		window[i] = t.Format(time.RFC3339)
+	}
+
+	client, err := protocol.Dial(cfg.ManagementSocketPath, 3*time.Second)
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
 	defer func() {
-		_ = conn.Close()
+		_ = client.Close()
 	}()
 
-	// r := bufio.NewWriter(conn)
-	//fmt.Fprintf(os.Stderr, "SETUSER %s %s %s %s\n", args[0], args[1], args[2], args[3])
-	//_, err = fmt.Fprintf(r, "SETUSER %s\n", os.Args[2])
-	count, err := fmt.Fprintf(conn, "SETUSER %s %s %s %s \n", args[0], args[1], args[2], args[3])
-	if err != nil {
-		return fmt.Errorf("sent command")
+	_, err = client.Call("SETUSER", args[0], args[1], args[2], strings.Join(args[3:], " "), options, window[0], window[1])
+	if errors.Is(err, protocol.ErrNotFound) {
+		return fmt.Errorf("user not found")
 	}
-
-	buf := make([]byte, 1024)
-	readCount, err := conn.Read(buf[:])
 	if err != nil {
-		return fmt.Errorf("read buf count: %d path: %s : %w", count, cfg.SocketPath, err)
-	}
-
-	readStr := string(buf[0:readCount])
-
-	if strings.Contains(readStr, "NOTFOUND") {
-		return fmt.Errorf("user not found")
+		return fmt.Errorf("create user: %w", err)
 	}
 
 	log.Info().Str("username", args[0]).Msg("created")
@@ -1,12 +1,14 @@
 package apps
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -23,52 +25,78 @@ var KeyCmd = &cobra.Command{
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
 
 		// Launch the application
-		if err := AuthKey(c); err != nil {
+		if err := AuthKey(args, c); err != nil {
 			log.Err(err).Send()
 			os.Exit(1)
 		}
 	},
 }
 
-func AuthKey(c chan os.Signal) error {
-	if len(os.Args) == 0 {
+// AuthKey prints every key of the user in authorized_keys format. Nothing is
+// printed unless the daemon response was read completely up to its end
+// marker, so a broken connection never yields a partial key list.
+func AuthKey(args []string, c chan os.Signal) error {
+	if len(args) == 0 {
 		return fmt.Errorf("you should give username as a parameter")
 	}
 
-	username := os.Args[2]
+	username := args[0]
 	cfg := domain.LoadConfig()
 
-	conn, err := net.Dial("unix", cfg.SocketPath)
+	client, err := protocol.Dial(cfg.SocketPath, 3*time.Second)
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
 	defer func() {
-		_ = conn.Close()
+		_ = client.Close()
 	}()
 
-	_, err = fmt.Fprintf(conn, "GETSSHKEY %s\n", username)
-	if err != nil {
-		return fmt.Errorf("sent command")
+	if err := client.Send("GETSSHKEY", username); err != nil {
+		return fmt.Errorf("sent command: %w", err)
 	}
 
-	buf := make([]byte, 1024)
-	readCount, err := conn.Read(buf)
-	if err != nil {
-		return fmt.Errorf("read buf: %w", err)
-	}
+	var keys strings.Builder
 
-	readStr := string(buf[:readCount])
+	for {
+		f, err := client.Receive()
+		if err != nil {
+			return fmt.Errorf("read response: %w", err)
+		}
 
-	if strings.Contains(readStr, "NOTFOUND") {
-		return fmt.Errorf("user not found")
-	}
+		if errors.Is(f.Err(), protocol.ErrNotFound) {
+			return fmt.Errorf("user not found")
+		}
+
+		if err := f.Err(); err != nil {
+			return fmt.Errorf("daemon: %w", err)
+		}
 
-	var algo, key, name string
+		if f.Status == protocol.StatusEnd {
+			break
+		}
+
+		if len(f.Fields) != 4 {
+			return fmt.Errorf("malformed key record with %d fields", len(f.Fields))
+		}
+
+		key := domain.SshKey{
+			Aglo:    f.Fields[0],
+			Key:     f.Fields[1],
+			Name:    f.Fields[2],
+			Options: f.Fields[3],
+		}
+
+		if key.Aglo == "" || key.Key == "" || strings.ContainsAny(key.AuthorizedKey(), "\r\n") {
+			return fmt.Errorf("malformed key record")
+		}
+
+		keys.WriteString(key.AuthorizedKey())
+		keys.WriteString("\n")
+	}
 
-	if count, err := fmt.Sscanf(readStr, "OK %s %s %s", &algo, &key, &name); err != nil || count != 3 {
-		return fmt.Errorf("internal")
+	if _, err := os.Stdout.WriteString(keys.String()); err != nil {
+		return fmt.Errorf("write keys: %w", err)
 	}
 
-	fmt.Printf("%s %s %s\n", algo, key, name)
 	return nil
 }
@@ -0,0 +1,74 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var PrincipalsCmd = &cobra.Command{
+	Use:   "ssh_auth_principals [username]",
+	Short: "ssh auth principals application to return related user's certificate principals",
+	Long:  AppDescription,
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Listen for termination signal for gracefully shutdown
+		c := make(chan os.Signal, 1)
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
+
+		// Launch the application
+		if err := AuthPrincipals(args, c); err != nil {
+			log.Err(err).Send()
+			os.Exit(1)
+		}
+	},
+}
+
+// AuthPrincipals prints the certificate principals of the user one per
+// line, as expected from an AuthorizedPrincipalsCommand. Nothing is printed
+// if any principal is malformed.
+func AuthPrincipals(args []string, c chan os.Signal) error {
+	username := args[0]
+	cfg := domain.LoadConfig()
+
+	client, err := protocol.Dial(cfg.SocketPath, 3*time.Second)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	f, err := client.Call("GETPRINCIPALS", username)
+	if errors.Is(err, protocol.ErrNotFound) {
+		return fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+
+	var principals strings.Builder
+
+	for _, principal := range f.Fields {
+		if principal == "" || strings.ContainsAny(principal, "\r\n") {
+			return fmt.Errorf("malformed principal record")
+		}
+
+		principals.WriteString(principal)
+		principals.WriteString("\n")
+	}
+
+	if _, err := os.Stdout.WriteString(principals.String()); err != nil {
+		return fmt.Errorf("write principals: %w", err)
+	}
+
+	return nil
+}
@@ -2,11 +2,11 @@ package apps
 
 import (
 	"fmt"
-	"net"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
@@ -22,41 +22,46 @@ var SyncUserCmd = &cobra.Command{
 		// Listen for termination signal for gracefully shutdown
 		c := make(chan os.Signal, 1)
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
+		changes, _ := cmd.Flags().GetBool("changes")
 
 		// Launch the application
-		if err := SyncUser(c); err != nil {
+		if err := syncUsers(changes, c); err != nil {
 			log.Err(err).Send()
 			os.Exit(1)
 		}
 	},
 }
 
+func init() {
+	SyncUserCmd.Flags().Bool("changes", false, "only apply the changes since the last sync")
+}
+
 func SyncUser(c chan os.Signal) error {
+	return syncUsers(false, c)
+}
+
+// syncUsers asks the daemon for a full sync or to apply the backend changes
+// since the last sync.
+func syncUsers(changes bool, c chan os.Signal) error {
 	cfg := domain.LoadConfig()
 
-	conn, err := net.Dial("unix", cfg.ManagementSocketPath)
+	// a sync of the changes may fall back to a full sync, each is limited
+	// by the sync timeout of the daemon
+	client, err := protocol.Dial(cfg.ManagementSocketPath, 2*cfg.Sync.EffectiveTimeout()+10*time.Second)
 	if err != nil {
 		return fmt.Errorf("dial: %w", err)
 	}
 	defer func() {
-		_ = conn.Close()
+		_ = client.Close()
 	}()
 
-	_, err = fmt.Fprintf(conn, "SYNC\n")
-	if err != nil {
-		return fmt.Errorf("sent command")
+	var args []string
+	if changes {
+		args = append(args, "changes")
 	}
 
-	buf := make([]byte, 1024)
-	readCount, err := conn.Read(buf)
-	if err != nil {
-		return fmt.Errorf("read buf: %w", err)
-	}
-
-	readStr := string(buf[:readCount])
-
-	if strings.Contains(readStr, "NOTFOUND") {
-		return fmt.Errorf("snyc failed. take a look systemd daemon logs")
+	if _, err := client.Call("SYNC", args...); err != nil {
+		return fmt.Errorf("snyc failed. take a look systemd daemon logs: %w", err)
 	}
 
 	log.Info().Msg("sync completed")
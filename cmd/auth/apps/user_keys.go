@@ -0,0 +1,82 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var UserKeysCmd = &cobra.Command{
+	Use:   "keys [username]",
+	Short: "Show the accepted and rejected ssh keys of a user",
+	Long:  AppDescription,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Listen for termination signal for gracefully shutdown
+		c := make(chan os.Signal, 1)
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: false})
+
+		// Launch the application
+		if err := UserKeys(args, c); err != nil {
+			log.Err(err).Send()
+			os.Exit(1)
+		}
+	},
+}
+
+// UserKeys prints every key known for the user, rejected keys are printed
+// with the reason they were dropped.
+func UserKeys(args []string, c chan os.Signal) error {
+	cfg := domain.LoadConfig()
+
+	client, err := protocol.Dial(cfg.ManagementSocketPath, 3*time.Second)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	if err := client.Send("GETKEYS", args[0]); err != nil {
+		return fmt.Errorf("sent command: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(w, "STATE\tFINGERPRINT\tKEY\tDETAIL")
+
+	for {
+		f, err := client.Receive()
+		if err != nil {
+			return fmt.Errorf("read response: %w", err)
+		}
+
+		if errors.Is(f.Err(), protocol.ErrNotFound) {
+			return fmt.Errorf("user not found")
+		}
+
+		if err := f.Err(); err != nil {
+			return fmt.Errorf("daemon: %w", err)
+		}
+
+		if f.Status == protocol.StatusEnd {
+			break
+		}
+
+		if len(f.Fields) != 4 {
+			return fmt.Errorf("malformed key record with %d fields", len(f.Fields))
+		}
+
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Fields[0], f.Fields[1], f.Fields[2], f.Fields[3])
+	}
+
+	return w.Flush()
+}
@@ -23,8 +23,11 @@ func main() {
 	rootCmd.PersistentFlags().StringP("author", "a", "Auth Keycloak", "author name for copyright attribution")
 
 	rootCmd.AddCommand(apps.KeyCmd)
+	rootCmd.AddCommand(apps.PrincipalsCmd)
 	rootCmd.AddCommand(apps.SyncUserCmd)
 	rootCmd.AddCommand(apps.NewUserCmd)
+	rootCmd.AddCommand(apps.UserKeysCmd)
+	rootCmd.AddCommand(apps.CertCmd)
 	rootCmd.AddCommand(apps.DaemonCmd)
 
 	if err := rootCmd.Execute(); err != nil {
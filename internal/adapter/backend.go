@@ -0,0 +1,151 @@
+package adapter
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+const (
+	BackendKeycloak = "keycloak"
+	BackendLdap     = "ldap"
+	BackendRest     = "rest"
+	BackendExec     = "exec"
+	BackendFile     = "file"
+)
+
+// BackendFactory builds a backend from the configuration, the settings of
+// the backend are in the section of its type.
+type BackendFactory func(config *domain.Config) (domain.Backend, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]BackendFactory{
+		BackendKeycloak: func(config *domain.Config) (domain.Backend, error) {
+			return NewKeyCloakAdapter(config), nil
+		},
+		BackendLdap: NewLdapAdapter,
+		BackendRest: NewRestAdapter,
+		BackendExec: NewExecAdapter,
+		BackendFile: NewFileAdapter,
+	}
+)
+
+// RegisterBackend makes a backend type available to the configuration. It
+// panics if the type is registered twice.
+func RegisterBackend(name string, factory BackendFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, has := registry[name]; has {
+		panic(fmt.Sprintf("backend %s registered twice", name))
+	}
+
+	registry[name] = factory
+}
+
+func backendFactory(name string) (BackendFactory, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	factory, has := registry[name]
+	if !has {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+
+	return factory, nil
+}
+
+// NewBackend returns the backends declared in the configuration, combined
+// by a CompositeBackend if there are several. Without a backends list the
+// backend key selects a single backend, Keycloak when it is empty.
+func NewBackend(config *domain.Config) (domain.Backend, error) {
+	if len(config.Backends) == 0 {
+		factory, err := backendFactory(lo.CoalesceOrEmpty(config.Backend, BackendKeycloak))
+		if err != nil {
+			return nil, err
+		}
+
+		return factory(config)
+	}
+
+	declared := slices.Clone(config.Backends)
+	slices.SortStableFunc(declared, func(a, b domain.BackendConfig) int {
+		return a.Priority - b.Priority
+	})
+
+	var backends []NamedBackend
+
+	for _, declaration := range declared {
+		name := lo.CoalesceOrEmpty(declaration.Name, declaration.Type)
+
+		factory, err := backendFactory(declaration.Type)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+
+		cfg := *config
+		cfg.Keycloak = declaration.Keycloak
+		cfg.Ldap = declaration.Ldap
+		cfg.Rest = declaration.Rest
+		cfg.Exec = declaration.Exec
+		cfg.File = declaration.File
+
+		backend, err := factory(&cfg)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+
+		backends = append(backends, NamedBackend{Name: name, Backend: backend})
+	}
+
+	if len(backends) == 1 {
+		return backends[0].Backend, nil
+	}
+
+	return NewCompositeBackend(backends, config.BackendConflict)
+}
+
+// validateUsers rejects the users of a backend without a schema of its
+// own if any user is malformed, rather than applying part of them.
+func validateUsers(users []domain.UserDetail) error {
+	seen := map[string]bool{}
+
+	for i, user := range users {
+		if !validName(user.Username) {
+			return fmt.Errorf("user %d: invalid username %q", i, user.Username)
+		}
+
+		if seen[user.Username] {
+			return fmt.Errorf("user %s: returned twice", user.Username)
+		}
+
+		seen[user.Username] = true
+
+		for _, key := range user.SshPublicKeys {
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+				return fmt.Errorf("user %s: malformed ssh key: %w", user.Username, err)
+			}
+		}
+
+		for _, group := range user.Groups {
+			if !validName(group) {
+				return fmt.Errorf("user %s: invalid group %q", user.Username, group)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validName reports whether a user or group name can be served through
+// NSS, passwd and group entries are separated by ':' and newlines.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ":/,\n\r\t ")
+}
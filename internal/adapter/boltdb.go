@@ -2,6 +2,7 @@ package adapter
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 
@@ -10,7 +11,10 @@ import (
 )
 
 const (
-	bucketSSH = "ssh_keys"
+	bucketSSH   = "ssh_keys"
+	bucketGroup = "ssh_groups"
+	bucketCert  = "ssh_certs"
+	bucketState = "ssh_state"
 )
 
 func NewBoldDB(path string, readOnly bool) (domain.BoltDB, error) {
@@ -24,10 +28,12 @@ func NewBoldDB(path string, readOnly bool) (domain.BoltDB, error) {
 		return nil, fmt.Errorf("db view: %w", err)
 	}
 
-	_, err = tx.CreateBucketIfNotExists([]byte(bucketSSH))
-	if err != nil {
-		_ = tx.Rollback()
-		return nil, fmt.Errorf("create bucket: %w", err)
+	for _, name := range []string{bucketSSH, bucketGroup, bucketCert, bucketState} {
+		_, err = tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, fmt.Errorf("create bucket: %w", err)
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -145,3 +151,422 @@ func (b *boltAdapter) ReadUserById(ctx context.Context, uid uint) (domain.KeyDto
 
 	return retKeyDto, err
 }
+
+// ListUsers implements BoltDB. Users are returned in key order starting after
+// cursor; the returned cursor is empty when there are no more users.
+func (b *boltAdapter) ListUsers(ctx context.Context, cursor string, limit int) ([]domain.KeyDto, string, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, "", fmt.Errorf("db begin: %w", err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	bucket := tx.Bucket([]byte(bucketSSH))
+
+	if bucket == nil {
+		return nil, "", fmt.Errorf("db bucket not found: %s", bucketSSH)
+	}
+
+	c := bucket.Cursor()
+
+	var k, v []byte
+
+	if cursor == "" {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek([]byte(cursor))
+		if k != nil && string(k) == cursor {
+			k, v = c.Next()
+		}
+	}
+
+	var (
+		ret  []domain.KeyDto
+		last string
+	)
+
+	for ; k != nil; k, v = c.Next() {
+		if len(ret) == limit {
+			return ret, last, nil
+		}
+
+		var keyDto domain.KeyDto
+
+		if err := json.Unmarshal(v, &keyDto); err != nil {
+			return nil, "", fmt.Errorf("db value unmarshal: %w", err)
+		}
+
+		ret = append(ret, keyDto)
+		last = string(k)
+	}
+
+	return ret, "", nil
+}
+
+// DeleteUser implements BoltDB.
+func (b *boltAdapter) DeleteUser(ctx context.Context, username string) error {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	bucket := tx.Bucket([]byte(bucketSSH))
+
+	if err := bucket.Delete([]byte(username)); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db delete: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateUsers implements BoltDB. It passes every user to update within a
+// single write transaction and stores the users update reports as changed.
+func (b *boltAdapter) UpdateUsers(ctx context.Context, update func(domain.KeyDto) (domain.KeyDto, bool)) error {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	bucket := tx.Bucket([]byte(bucketSSH))
+
+	changed := map[string][]byte{}
+
+	err = bucket.ForEach(func(k, v []byte) error {
+		var keyDto domain.KeyDto
+
+		if err := json.Unmarshal(v, &keyDto); err != nil {
+			return fmt.Errorf("db value unmarshal: %w", err)
+		}
+
+		keyDto, ok := update(keyDto)
+		if !ok {
+			return nil
+		}
+
+		m, err := json.Marshal(keyDto)
+		if err != nil {
+			return fmt.Errorf("db value marshal: %w", err)
+		}
+
+		changed[string(k)] = m
+
+		return nil
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db foreach: %w", err)
+	}
+
+	// the bucket must not be modified while iterating it
+	for k, v := range changed {
+		if err := bucket.Put([]byte(k), v); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("db put: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	return nil
+}
+
+// CreateGroup implements BoltDB.
+func (b *boltAdapter) CreateGroup(ctx context.Context, groupname string, groupDto domain.GroupDto) error {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("db view: %w", err)
+	}
+	m, err := json.Marshal(groupDto)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db value marshal: %w", err)
+	}
+
+	bucket := tx.Bucket([]byte(bucketGroup))
+
+	err = bucket.Put([]byte(groupname), m)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db put: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	return nil
+}
+
+// ReadGroup implements BoltDB.
+func (b *boltAdapter) ReadGroup(ctx context.Context, groupname string) (domain.GroupDto, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return domain.GroupDto{}, fmt.Errorf("db begin: %w", err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	bucket := tx.Bucket([]byte(bucketGroup))
+
+	if bucket == nil {
+		return domain.GroupDto{}, fmt.Errorf("db bucket not found: %s", bucketGroup)
+	}
+
+	value := bucket.Get([]byte(groupname))
+
+	if value == nil {
+		return domain.GroupDto{}, fmt.Errorf("group not found: %s: %w", groupname, domain.ErrNotFound)
+	}
+
+	var groupDto domain.GroupDto
+
+	err = json.Unmarshal(value, &groupDto)
+	if err != nil {
+		return domain.GroupDto{}, fmt.Errorf("db value unmarshal: %w", err)
+	}
+
+	return groupDto, nil
+}
+
+// ReadGroupById implements BoltDB.
+func (b *boltAdapter) ReadGroupById(ctx context.Context, gid uint) (domain.GroupDto, error) {
+	groups, err := b.ListGroups(ctx)
+	if err != nil {
+		return domain.GroupDto{}, err
+	}
+
+	for _, groupDto := range groups {
+		if groupDto.Group.GID == gid {
+			return groupDto, nil
+		}
+	}
+
+	return domain.GroupDto{}, fmt.Errorf("group not found: %d: %w", gid, domain.ErrNotFound)
+}
+
+// ListGroups implements BoltDB.
+func (b *boltAdapter) ListGroups(ctx context.Context) ([]domain.GroupDto, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, fmt.Errorf("db begin: %w", err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	bucket := tx.Bucket([]byte(bucketGroup))
+
+	if bucket == nil {
+		return nil, fmt.Errorf("db bucket not found: %s", bucketGroup)
+	}
+
+	var ret []domain.GroupDto
+
+	err = bucket.ForEach(func(k, v []byte) error {
+		var groupDto domain.GroupDto
+
+		if err := json.Unmarshal(v, &groupDto); err != nil {
+			return fmt.Errorf("db value unmarshal: %w", err)
+		}
+
+		ret = append(ret, groupDto)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("db foreach: %w", err)
+	}
+
+	return ret, nil
+}
+
+// DeleteGroup implements BoltDB.
+func (b *boltAdapter) DeleteGroup(ctx context.Context, groupname string) error {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	bucket := tx.Bucket([]byte(bucketGroup))
+
+	if err := bucket.Delete([]byte(groupname)); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db delete: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	return nil
+}
+
+// certKey encodes the serial big endian so that certificates are listed in
+// serial order.
+func certKey(serial uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, serial)
+}
+
+// CreateCert implements BoltDB.
+func (b *boltAdapter) CreateCert(ctx context.Context, certDto domain.CertDto) error {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("db view: %w", err)
+	}
+	m, err := json.Marshal(certDto)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db value marshal: %w", err)
+	}
+
+	bucket := tx.Bucket([]byte(bucketCert))
+
+	err = bucket.Put(certKey(certDto.Serial), m)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db put: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	return nil
+}
+
+// ReadCert implements BoltDB.
+func (b *boltAdapter) ReadCert(ctx context.Context, serial uint64) (domain.CertDto, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return domain.CertDto{}, fmt.Errorf("db begin: %w", err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	bucket := tx.Bucket([]byte(bucketCert))
+
+	if bucket == nil {
+		return domain.CertDto{}, fmt.Errorf("db bucket not found: %s", bucketCert)
+	}
+
+	value := bucket.Get(certKey(serial))
+
+	if value == nil {
+		return domain.CertDto{}, fmt.Errorf("certificate not found: %d: %w", serial, domain.ErrNotFound)
+	}
+
+	var certDto domain.CertDto
+
+	err = json.Unmarshal(value, &certDto)
+	if err != nil {
+		return domain.CertDto{}, fmt.Errorf("db value unmarshal: %w", err)
+	}
+
+	return certDto, nil
+}
+
+// ListCerts implements BoltDB.
+func (b *boltAdapter) ListCerts(ctx context.Context) ([]domain.CertDto, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, fmt.Errorf("db begin: %w", err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	bucket := tx.Bucket([]byte(bucketCert))
+
+	if bucket == nil {
+		return nil, fmt.Errorf("db bucket not found: %s", bucketCert)
+	}
+
+	var ret []domain.CertDto
+
+	err = bucket.ForEach(func(k, v []byte) error {
+		var certDto domain.CertDto
+
+		if err := json.Unmarshal(v, &certDto); err != nil {
+			return fmt.Errorf("db value unmarshal: %w", err)
+		}
+
+		ret = append(ret, certDto)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("db foreach: %w", err)
+	}
+
+	return ret, nil
+}
+
+// ReadState implements BoltDB.
+func (b *boltAdapter) ReadState(ctx context.Context, key string) (string, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return "", fmt.Errorf("db begin: %w", err)
+	}
+
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	bucket := tx.Bucket([]byte(bucketState))
+
+	if bucket == nil {
+		return "", fmt.Errorf("db bucket not found: %s", bucketState)
+	}
+
+	value := bucket.Get([]byte(key))
+
+	if value == nil {
+		return "", fmt.Errorf("state not found: %s: %w", key, domain.ErrNotFound)
+	}
+
+	return string(value), nil
+}
+
+// WriteState implements BoltDB.
+func (b *boltAdapter) WriteState(ctx context.Context, key, value string) error {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	bucket := tx.Bucket([]byte(bucketState))
+
+	err = bucket.Put([]byte(key), []byte(value))
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db put: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("db view: %w", err)
+	}
+
+	return nil
+}
@@ -2,15 +2,20 @@ package adapter_test
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/h2hsecure/sshkeyman/internal/adapter"
 	"github.com/h2hsecure/sshkeyman/internal/domain"
 	. "github.com/onsi/gomega"
 	"github.com/protosam/go-libnss/structs"
+	"github.com/samber/lo"
 )
 
-const TMP_DB = "/tmp/user.db"
+const (
+	TMP_DB      = "/tmp/user.db"
+	TMP_LIST_DB = "/tmp/user_list.db"
+)
 
 func TestCreateUser(t *testing.T) {
 	RegisterTestingT(t)
@@ -40,3 +45,127 @@ func TestReadUser(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(user.User.Username).To(Equal("test"))
 }
+
+func TestDeleteUser(t *testing.T) {
+	RegisterTestingT(t)
+	db, err := adapter.NewBoldDB(TMP_LIST_DB, false)
+	Expect(err).To(BeNil())
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	err = db.CreateUser(ctx, "delete-me", domain.KeyDto{
+		User: structs.Passwd{Username: "delete-me"},
+	})
+	Expect(err).To(BeNil())
+
+	Expect(db.DeleteUser(ctx, "delete-me")).To(Succeed())
+
+	_, err = db.ReadUser(ctx, "delete-me")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+}
+
+func TestState(t *testing.T) {
+	RegisterTestingT(t)
+	db, err := adapter.NewBoldDB(TMP_LIST_DB, false)
+	Expect(err).To(BeNil())
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+
+	_, err = db.ReadState(ctx, "missing")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	Expect(db.WriteState(ctx, "cursor", "1")).To(Succeed())
+	Expect(db.WriteState(ctx, "cursor", "2")).To(Succeed())
+
+	value, err := db.ReadState(ctx, "cursor")
+	Expect(err).To(BeNil())
+	Expect(value).To(Equal("2"))
+}
+
+func TestListUsers(t *testing.T) {
+	RegisterTestingT(t)
+	db, err := adapter.NewBoldDB(TMP_LIST_DB, false)
+	Expect(err).To(BeNil())
+	defer func() { _ = db.Close() }()
+
+	for _, username := range []string{"list-a", "list-b", "list-c"} {
+		err = db.CreateUser(context.Background(), username, domain.KeyDto{
+			User: structs.Passwd{
+				Username: username,
+			},
+		})
+		Expect(err).To(BeNil())
+	}
+
+	var (
+		cursor string
+		seen   []string
+	)
+
+	for {
+		users, next, err := db.ListUsers(context.Background(), cursor, 1)
+		Expect(err).To(BeNil())
+
+		for _, user := range users {
+			seen = append(seen, user.User.Username)
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	Expect(seen).To(ContainElements("list-a", "list-b", "list-c"))
+	Expect(seen).To(HaveLen(len(lo.Uniq(seen))))
+}
+
+func TestGroups(t *testing.T) {
+	RegisterTestingT(t)
+	db, err := adapter.NewBoldDB(TMP_LIST_DB, false)
+	Expect(err).To(BeNil())
+	defer func() { _ = db.Close() }()
+
+	err = db.CreateGroup(context.Background(), "ops", domain.GroupDto{
+		Group: structs.Group{
+			Groupname: "ops",
+			GID:       20001,
+			Members:   []string{"list-a"},
+		},
+	})
+	Expect(err).To(BeNil())
+
+	group, err := db.ReadGroupById(context.Background(), 20001)
+	Expect(err).To(BeNil())
+	Expect(group.Group.Members).To(ConsistOf("list-a"))
+
+	Expect(db.DeleteGroup(context.Background(), "ops")).To(Succeed())
+
+	_, err = db.ReadGroup(context.Background(), "ops")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+}
+
+func TestCerts(t *testing.T) {
+	RegisterTestingT(t)
+	db, err := adapter.NewBoldDB(TMP_LIST_DB, false)
+	Expect(err).To(BeNil())
+	defer func() { _ = db.Close() }()
+
+	for _, serial := range []uint64{300, 2, 1 << 40} {
+		Expect(db.CreateCert(context.Background(), domain.CertDto{Serial: serial, Username: "list-a"})).To(Succeed())
+	}
+
+	cert, err := db.ReadCert(context.Background(), 300)
+	Expect(err).To(BeNil())
+	Expect(cert.Username).To(Equal("list-a"))
+
+	certs, err := db.ListCerts(context.Background())
+	Expect(err).To(BeNil())
+	Expect(lo.Map(certs, func(item domain.CertDto, _ int) uint64 {
+		return item.Serial
+	})).To(ContainElements(uint64(2), uint64(300), uint64(1<<40)))
+
+	_, err = db.ReadCert(context.Background(), 4)
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+}
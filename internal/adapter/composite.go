@@ -0,0 +1,272 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+const (
+	// ConflictFirst keeps the user of the backend asked first.
+	ConflictFirst = "first"
+	// ConflictMerge keeps the account of the backend asked first and adds
+	// the keys, groups and roles of the others. The user is disabled if any
+	// backend disabled it.
+	ConflictMerge = "merge"
+	// ConflictError fails when a username is found in several backends.
+	ConflictError = "error"
+)
+
+// NamedBackend is a backend of a CompositeBackend.
+type NamedBackend struct {
+	Name    string
+	Backend domain.Backend
+}
+
+// CompositeBackend serves the users of several backends, asked in order.
+// Users are matched by username, Conflict decides about users found in
+// more than one backend. The returned users name the backend they are
+// served from.
+type CompositeBackend struct {
+	Backends []NamedBackend
+	Conflict string
+
+	mu sync.Mutex
+	// owners holds the backend each username was served from, tokens are
+	// only accepted from that backend
+	owners map[string]string
+}
+
+func NewCompositeBackend(backends []NamedBackend, conflict string) (*CompositeBackend, error) {
+	conflict = lo.CoalesceOrEmpty(conflict, ConflictFirst)
+
+	if !lo.Contains([]string{ConflictFirst, ConflictMerge, ConflictError}, conflict) {
+		return nil, fmt.Errorf("unknown backend conflict rule %q", conflict)
+	}
+
+	return &CompositeBackend{Backends: backends, Conflict: conflict}, nil
+}
+
+func (c *CompositeBackend) FetchUser(ctx context.Context, username string) (domain.UserDetail, error) {
+	var (
+		ret   domain.UserDetail
+		found string
+	)
+
+	for _, backend := range c.Backends {
+		user, err := backend.Backend.FetchUser(ctx, username)
+		if errors.Is(err, domain.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return domain.UserDetail{}, fmt.Errorf("backend %s: %w", backend.Name, err)
+		}
+
+		user.Backend = backend.Name
+
+		if found == "" {
+			ret, found = user, backend.Name
+
+			if c.Conflict == ConflictFirst {
+				break
+			}
+
+			continue
+		}
+
+		ret, err = c.resolve(ret, found, user, backend.Name)
+		if err != nil {
+			return domain.UserDetail{}, err
+		}
+	}
+
+	if found == "" {
+		return domain.UserDetail{}, fmt.Errorf("user %s: %w", username, domain.ErrNotFound)
+	}
+
+	c.setOwner(username, found)
+
+	return ret, nil
+}
+
+// FetchUsers returns a domain.PartialError naming the failed backends with
+// the users of the other backends if some backends fail. The listing fails
+// if every backend fails.
+func (c *CompositeBackend) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
+	var (
+		ret    []domain.UserDetail
+		failed []string
+		errs   []error
+	)
+
+	// origin holds the index in ret and the backend of every username
+	origin := map[string]lo.Tuple2[int, string]{}
+
+	for _, backend := range c.Backends {
+		users, err := backend.Backend.FetchUsers(ctx)
+		if err != nil {
+			failed = append(failed, backend.Name)
+			errs = append(errs, fmt.Errorf("backend %s: %w", backend.Name, err))
+
+			continue
+		}
+
+		for _, user := range users {
+			user.Backend = backend.Name
+
+			existing, has := origin[user.Username]
+			if !has {
+				origin[user.Username] = lo.T2(len(ret), backend.Name)
+				ret = append(ret, user)
+
+				continue
+			}
+
+			merged, err := c.resolve(ret[existing.A], existing.B, user, backend.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			ret[existing.A] = merged
+		}
+	}
+
+	if len(failed) == len(c.Backends) {
+		return nil, errors.Join(errs...)
+	}
+
+	if len(failed) > 0 {
+		// the owners are left as known, a user of a failed backend may
+		// shadow a listed user of the same name
+		return ret, &domain.PartialError{Failed: failed, Err: errors.Join(errs...)}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.owners = lo.MapValues(origin, func(item lo.Tuple2[int, string], _ string) string {
+		return item.B
+	})
+
+	return ret, nil
+}
+
+// VerifyToken implements domain.TokenVerifier. A token is only accepted
+// from the backend the user is served from, another backend can not vouch
+// for a user of the same name.
+func (c *CompositeBackend) VerifyToken(ctx context.Context, token string) (string, error) {
+	var errs []error
+
+	for _, backend := range c.Backends {
+		verifier, ok := backend.Backend.(domain.TokenVerifier)
+		if !ok {
+			continue
+		}
+
+		username, err := verifier.VerifyToken(ctx, token)
+		if err == nil {
+			var owner string
+
+			if owner, err = c.owner(ctx, username); err == nil && owner == backend.Name {
+				return username, nil
+			}
+
+			if err == nil {
+				err = fmt.Errorf("user %s is served by backend %s", username, owner)
+			}
+		}
+
+		errs = append(errs, fmt.Errorf("backend %s: %w", backend.Name, err))
+	}
+
+	if len(errs) == 0 {
+		return "", errors.New("no backend supports tokens")
+	}
+
+	return "", errors.Join(errs...)
+}
+
+// owner returns the backend the user is served from, users not seen yet are
+// looked up.
+func (c *CompositeBackend) owner(ctx context.Context, username string) (string, error) {
+	c.mu.Lock()
+	owner, has := c.owners[username]
+	c.mu.Unlock()
+
+	if has {
+		return owner, nil
+	}
+
+	if _, err := c.FetchUser(ctx, username); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.owners[username], nil
+}
+
+func (c *CompositeBackend) setOwner(username, backend string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.owners == nil {
+		c.owners = map[string]string{}
+	}
+
+	c.owners[username] = backend
+}
+
+// resolve applies the conflict rule to a user found in two backends, first
+// is the user of the backend asked first.
+func (c *CompositeBackend) resolve(first domain.UserDetail, firstBackend string, other domain.UserDetail, otherBackend string) (domain.UserDetail, error) {
+	switch c.Conflict {
+	case ConflictError:
+		return domain.UserDetail{}, fmt.Errorf("user %s found in backends %s and %s", first.Username, firstBackend, otherBackend)
+	case ConflictMerge:
+		return mergeUser(first, other), nil
+	default:
+		log.Debug().Str("user", first.Username).Str("backend", otherBackend).Str("shadowed_by", firstBackend).Msg("user ignored")
+		return first, nil
+	}
+}
+
+// mergeUser adds the keys, groups and roles of other to user, the validity
+// windows stay aligned with the keys.
+func mergeUser(user, other domain.UserDetail) domain.UserDetail {
+	ret := user
+	ret.SshPublicKeys = nil
+	ret.SshKeyNotBefore = nil
+	ret.SshKeyNotAfter = nil
+
+	for _, u := range []domain.UserDetail{user, other} {
+		for i, key := range u.SshPublicKeys {
+			if lo.Contains(ret.SshPublicKeys, key) {
+				continue
+			}
+
+			notBefore, notAfter := u.KeyWindow(i)
+
+			ret.SshPublicKeys = append(ret.SshPublicKeys, key)
+			ret.SshKeyNotBefore = append(ret.SshKeyNotBefore, notBefore)
+			ret.SshKeyNotAfter = append(ret.SshKeyNotAfter, notAfter)
+		}
+	}
+
+	ret.Groups = lo.Union(user.Groups, other.Groups)
+	ret.Roles = lo.Union(user.Roles, other.Roles)
+	ret.Disabled = user.Disabled || other.Disabled
+
+	if other.RevokedBefore.After(ret.RevokedBefore) {
+		ret.RevokedBefore = other.RevokedBefore
+	}
+
+	return ret
+}
@@ -0,0 +1,308 @@
+package adapter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+
+	. "github.com/onsi/gomega"
+)
+
+// staticBackend serves a fixed list of users.
+type staticBackend struct {
+	users []domain.UserDetail
+	err   error
+	// tokens maps accepted tokens to usernames
+	tokens map[string]string
+}
+
+func (b *staticBackend) FetchUser(_ context.Context, username string) (domain.UserDetail, error) {
+	if b.err != nil {
+		return domain.UserDetail{}, b.err
+	}
+
+	user, found := lo.Find(b.users, func(item domain.UserDetail) bool { return item.Username == username })
+	if !found {
+		return domain.UserDetail{}, fmt.Errorf("user %s: %w", username, domain.ErrNotFound)
+	}
+
+	return user, nil
+}
+
+func (b *staticBackend) FetchUsers(_ context.Context) ([]domain.UserDetail, error) {
+	return b.users, b.err
+}
+
+func (b *staticBackend) VerifyToken(_ context.Context, token string) (string, error) {
+	username, has := b.tokens[token]
+	if !has {
+		return "", errors.New("invalid token")
+	}
+
+	return username, nil
+}
+
+func TestCompositeBackend(t *testing.T) {
+	RegisterTestingT(t)
+
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	employees := &staticBackend{users: []domain.UserDetail{
+		{Id: "k1", Username: "alice", Fullname: "Alice", SshPublicKeys: []string{"ssh-ed25519 AAAA"}, Groups: []string{"dev"}},
+		{Id: "k2", Username: "bob", SshPublicKeys: []string{"ssh-ed25519 BBBB"}},
+	}}
+	services := &staticBackend{users: []domain.UserDetail{
+		{
+			Id: "l1", Username: "alice", Fullname: "Alice (ldap)",
+			SshPublicKeys:  []string{"ssh-ed25519 AAAA", "ssh-ed25519 CCCC"},
+			SshKeyNotAfter: []time.Time{{}, expiry},
+			Groups:         []string{"dev", "ops"},
+			Disabled:       true,
+		},
+		{Id: "l2", Username: "backup", SshPublicKeys: []string{"ssh-ed25519 DDDD"}},
+	}}
+	backends := []adapter.NamedBackend{{Name: "keycloak", Backend: employees}, {Name: "ldap", Backend: services}}
+
+	// first wins
+	c, err := adapter.NewCompositeBackend(backends, "")
+	Expect(err).To(BeNil())
+
+	users, err := c.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(lo.Map(users, func(item domain.UserDetail, _ int) string { return item.Id })).To(Equal([]string{"k1", "k2", "l2"}))
+
+	alice, err := c.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+	Expect(alice.Id).To(Equal("k1"))
+	Expect(alice.Backend).To(Equal("keycloak"))
+
+	backup, err := c.FetchUser(context.Background(), "backup")
+	Expect(err).To(BeNil())
+	Expect(backup.Id).To(Equal("l2"))
+	Expect(backup.Backend).To(Equal("ldap"))
+
+	_, err = c.FetchUser(context.Background(), "nobody")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	// merge keys
+	c, err = adapter.NewCompositeBackend(backends, adapter.ConflictMerge)
+	Expect(err).To(BeNil())
+
+	users, err = c.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(3))
+
+	merged := users[0]
+	Expect(merged.Id).To(Equal("k1"))
+	Expect(merged.Fullname).To(Equal("Alice"))
+	Expect(merged.SshPublicKeys).To(Equal([]string{"ssh-ed25519 AAAA", "ssh-ed25519 CCCC"}))
+	Expect(merged.SshKeyNotAfter).To(Equal([]time.Time{{}, expiry}))
+	Expect(merged.Groups).To(Equal([]string{"dev", "ops"}))
+	Expect(merged.Disabled).To(BeTrue())
+	Expect(merged.Backend).To(Equal("keycloak"))
+
+	alice, err = c.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+	Expect(alice).To(Equal(merged))
+
+	// error
+	c, err = adapter.NewCompositeBackend(backends, adapter.ConflictError)
+	Expect(err).To(BeNil())
+
+	_, err = c.FetchUsers(context.Background())
+	Expect(err).To(MatchError(ContainSubstring("user alice found in backends keycloak and ldap")))
+
+	_, err = c.FetchUser(context.Background(), "bob")
+	Expect(err).To(BeNil())
+
+	_, err = adapter.NewCompositeBackend(backends, "newest")
+	Expect(err).NotTo(BeNil())
+}
+
+func TestCompositeBackendFailure(t *testing.T) {
+	RegisterTestingT(t)
+
+	ldap := &staticBackend{err: errors.New("connection refused")}
+
+	c, err := adapter.NewCompositeBackend([]adapter.NamedBackend{
+		{Name: "keycloak", Backend: &staticBackend{users: []domain.UserDetail{{Username: "alice"}}}},
+		{Name: "ldap", Backend: ldap},
+	}, adapter.ConflictFirst)
+	Expect(err).To(BeNil())
+
+	// the users of the other backends are returned with the failed backends
+	users, err := c.FetchUsers(context.Background())
+
+	var partial *domain.PartialError
+
+	Expect(errors.As(err, &partial)).To(BeTrue())
+	Expect(partial.Failed).To(Equal([]string{"ldap"}))
+	Expect(partial).To(MatchError(ContainSubstring("backend ldap: connection refused")))
+	Expect(users).To(Equal([]domain.UserDetail{{Username: "alice", Backend: "keycloak"}}))
+
+	// alice is found before the failing backend is asked
+	_, err = c.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+
+	_, err = c.FetchUser(context.Background(), "bob")
+	Expect(err).To(MatchError("backend ldap: connection refused"))
+
+	ldap.users, ldap.err = []domain.UserDetail{{Username: "bob"}, {Username: "carol"}}, nil
+
+	users, err = c.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(3))
+
+	// the listing fails if every backend fails
+	c, err = adapter.NewCompositeBackend([]adapter.NamedBackend{{Name: "ldap", Backend: &staticBackend{err: errors.New("connection refused")}}}, "")
+	Expect(err).To(BeNil())
+
+	_, err = c.FetchUsers(context.Background())
+	Expect(errors.As(err, &partial)).To(BeFalse())
+	Expect(err).To(MatchError("backend ldap: connection refused"))
+}
+
+func TestCompositeBackendRestart(t *testing.T) {
+	RegisterTestingT(t)
+
+	ctx := context.Background()
+
+	db, err := adapter.NewBoldDB(filepath.Join(t.TempDir(), "users.db"), false)
+	Expect(err).To(BeNil())
+
+	t.Cleanup(func() { _ = db.Close() })
+
+	cfg := &domain.Config{
+		Nss:  domain.NSSConfig{MinUID: 10000, MinGID: 10000, GroupID: 1000, Shell: "/bin/bash"},
+		Home: "/home/%s",
+	}
+
+	keycloak := &staticBackend{users: []domain.UserDetail{
+		{Id: "k1", Username: "alice", SshPublicKeys: []string{execKey}, Groups: []string{"ops"}},
+	}}
+	file := &staticBackend{users: []domain.UserDetail{
+		{Id: "f1", Username: "breakglass", SshPublicKeys: []string{execKey}},
+	}}
+
+	// every start of the daemon builds a new composite backend
+	newService := func() domain.IService {
+		c, err := adapter.NewCompositeBackend([]adapter.NamedBackend{
+			{Name: "keycloak", Backend: keycloak},
+			{Name: "file", Backend: file},
+		}, "")
+		Expect(err).To(BeNil())
+
+		return domain.NewService(cfg, db, c)
+	}
+
+	Expect(newService().Sync(ctx)).To(Succeed())
+
+	// keycloak is down after a restart, the file users are applied and
+	// the stored keycloak users are kept
+	keycloak.err = errors.New("connection refused")
+	file.users = append(file.users, domain.UserDetail{Id: "f2", Username: "oncall", SshPublicKeys: []string{execKey}})
+
+	srv := newService()
+
+	var partial *domain.PartialError
+
+	Expect(errors.As(srv.Sync(ctx), &partial)).To(BeTrue())
+
+	user, err := srv.FindUser(ctx, domain.WithUsername("oncall"))
+	Expect(err).To(BeNil())
+	Expect(user.Backend).To(Equal("file"))
+
+	user, err = srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(err).To(BeNil())
+	Expect(user.Backend).To(Equal("keycloak"))
+
+	ops, err := srv.FindGroup(ctx, domain.WithGroupname("ops"))
+	Expect(err).To(BeNil())
+	Expect(ops.Group.Members).To(Equal([]string{"alice"}))
+}
+
+func TestCompositeBackendToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	c, err := adapter.NewCompositeBackend([]adapter.NamedBackend{
+		{Name: "first", Backend: &staticBackend{
+			users:  []domain.UserDetail{{Username: "alice"}},
+			tokens: map[string]string{"t1": "alice"},
+		}},
+		{Name: "second", Backend: &staticBackend{
+			users:  []domain.UserDetail{{Username: "alice"}, {Username: "bob"}},
+			tokens: map[string]string{"t2": "bob", "t4": "alice"},
+		}},
+	}, "")
+	Expect(err).To(BeNil())
+
+	username, err := c.VerifyToken(context.Background(), "t2")
+	Expect(err).To(BeNil())
+	Expect(username).To(Equal("bob"))
+
+	username, err = c.VerifyToken(context.Background(), "t1")
+	Expect(err).To(BeNil())
+	Expect(username).To(Equal("alice"))
+
+	_, err = c.VerifyToken(context.Background(), "t3")
+	Expect(err).NotTo(BeNil())
+
+	// alice is served by the first backend, the second can not vouch for the user
+	_, err = c.VerifyToken(context.Background(), "t4")
+	Expect(err).To(MatchError(ContainSubstring("served by backend first")))
+}
+
+func TestNewBackend(t *testing.T) {
+	RegisterTestingT(t)
+
+	backend, err := adapter.NewBackend(&domain.Config{})
+	Expect(err).To(BeNil())
+	Expect(backend).To(BeAssignableToTypeOf(&adapter.KeyCloakAdapter{}))
+
+	backend, err = adapter.NewBackend(&domain.Config{
+		Backend: "ldap",
+		Ldap:    domain.LdapConfig{URL: "ldap://localhost"},
+	})
+	Expect(err).To(BeNil())
+	Expect(backend).To(BeAssignableToTypeOf(&adapter.LdapAdapter{}))
+
+	backend, err = adapter.NewBackend(&domain.Config{
+		Backends: []domain.BackendConfig{
+			{Name: "service-accounts", Type: "ldap", Priority: 20, Ldap: domain.LdapConfig{URL: "ldap://localhost"}},
+			{Type: "keycloak", Priority: 10, Keycloak: domain.KeycloakConfig{Server: "https://sso.example.com"}},
+		},
+		BackendConflict: adapter.ConflictMerge,
+	})
+	Expect(err).To(BeNil())
+
+	composite, ok := backend.(*adapter.CompositeBackend)
+	Expect(ok).To(BeTrue())
+	Expect(composite.Conflict).To(Equal(adapter.ConflictMerge))
+	Expect(lo.Map(composite.Backends, func(item adapter.NamedBackend, _ int) string { return item.Name })).
+		To(Equal([]string{"keycloak", "service-accounts"}))
+	Expect(composite.Backends[0].Backend.(*adapter.KeyCloakAdapter).Server).To(Equal("https://sso.example.com"))
+	Expect(composite.Backends[1].Backend.(*adapter.LdapAdapter).URL).To(Equal("ldap://localhost"))
+
+	// a single declared backend is used directly
+	backend, err = adapter.NewBackend(&domain.Config{
+		Backends: []domain.BackendConfig{{Type: "ldap", Ldap: domain.LdapConfig{URL: "ldap://localhost"}}},
+	})
+	Expect(err).To(BeNil())
+	Expect(backend).To(BeAssignableToTypeOf(&adapter.LdapAdapter{}))
+
+	_, err = adapter.NewBackend(&domain.Config{Backend: "nis"})
+	Expect(err).To(MatchError(`unknown backend "nis"`))
+
+	_, err = adapter.NewBackend(&domain.Config{
+		Backends: []domain.BackendConfig{{Type: "keycloak"}, {Name: "legacy", Type: "nis"}},
+	})
+	Expect(err).To(MatchError(`backend legacy: unknown backend "nis"`))
+}
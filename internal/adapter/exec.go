@@ -0,0 +1,262 @@
+package adapter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+const (
+	// ExecProtocolVersion is the version of ExecRequest and ExecResponse.
+	ExecProtocolVersion = 1
+
+	ExecFetchUsers = "fetch_users"
+	ExecFetchUser  = "fetch_user"
+
+	DefaultExecTimeout = 30 * time.Second
+
+	// maxExecOutput limits the plugin output kept in memory.
+	maxExecOutput = 64 << 20
+)
+
+// ExecRequest is written to the standard input of the plugin, e.g.
+//
+//	{"version":1,"operation":"fetch_user","username":"alice"}
+type ExecRequest struct {
+	Version   int    `json:"version"`
+	Operation string `json:"operation"`
+	// Username is set for fetch_user
+	Username string `json:"username,omitempty"`
+}
+
+// ExecResponse is read from the standard output of the plugin. fetch_users
+// returns every user, fetch_user the requested user or no user if it does
+// not exist. Unknown fields, malformed users and keys or a non-zero exit
+// status reject the whole response.
+type ExecResponse struct {
+	Version int        `json:"version"`
+	Users   []ExecUser `json:"users"`
+	// Error reports a failure of the source, the response is rejected
+	Error string `json:"error,omitempty"`
+}
+
+// ExecUser is a user of ExecResponse, only username is required.
+type ExecUser struct {
+	// Id defaults to the username
+	Id       string   `json:"id"`
+	Username string   `json:"username"`
+	Fullname string   `json:"fullname"`
+	SshKeys  []string `json:"ssh_keys"`
+	Groups   []string `json:"groups"`
+	Roles    []string `json:"roles"`
+	Disabled bool     `json:"disabled"`
+	// ExpiresAt is an RFC 3339 timestamp, the account never expires when
+	// it is missing
+	ExpiresAt time.Time `json:"expires_at"`
+	UID       uint      `json:"uid"`
+	GID       uint      `json:"gid"`
+	Shell     string    `json:"shell"`
+	Home      string    `json:"home"`
+}
+
+// ExecAdapter runs an executable for every backend request, so any source
+// can be plugged in with a script.
+type ExecAdapter struct {
+	Command string
+	Args    []string
+	Env     []string
+	Timeout time.Duration
+}
+
+func NewExecAdapter(config *domain.Config) (domain.Backend, error) {
+	cfg := config.Exec
+
+	if cfg.Command == "" {
+		return nil, errors.New("exec command is not set")
+	}
+
+	command, err := exec.LookPath(cfg.Command)
+	if err != nil {
+		return nil, fmt.Errorf("exec command: %w", err)
+	}
+
+	env := os.Environ()
+	for name, value := range cfg.Env {
+		env = append(env, name+"="+value)
+	}
+
+	timeout := lo.Ternary(cfg.Timeout > 0, cfg.Timeout, DefaultExecTimeout)
+
+	// runs are canceled with the sync, a longer timeout is never reached
+	if syncTimeout := config.Sync.EffectiveTimeout(); timeout >= syncTimeout {
+		return nil, fmt.Errorf("exec timeout %s must be below the sync timeout %s", timeout, syncTimeout)
+	}
+
+	return &ExecAdapter{
+		Command: command,
+		Args:    cfg.Args,
+		Env:     env,
+		Timeout: timeout,
+	}, nil
+}
+
+func (a *ExecAdapter) FetchUser(ctx context.Context, username string) (domain.UserDetail, error) {
+	users, err := a.run(ctx, ExecRequest{Operation: ExecFetchUser, Username: username})
+	if err != nil {
+		return domain.UserDetail{}, fmt.Errorf("fetch user: %w", err)
+	}
+
+	switch {
+	case len(users) == 0:
+		return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", username, domain.ErrNotFound)
+	case len(users) > 1 || users[0].Username != username:
+		return domain.UserDetail{}, fmt.Errorf("fetch user %s: plugin returned other users", username)
+	}
+
+	return users[0], nil
+}
+
+func (a *ExecAdapter) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
+	users, err := a.run(ctx, ExecRequest{Operation: ExecFetchUsers})
+	if err != nil {
+		return nil, fmt.Errorf("fetch users: %w", err)
+	}
+
+	return users, nil
+}
+
+// run executes the plugin with the request and returns the validated users.
+// The standard error of the plugin is logged.
+func (a *ExecAdapter) run(ctx context.Context, request ExecRequest) ([]domain.UserDetail, error) {
+	request.Version = ExecProtocolVersion
+
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+
+	var stdout, stderr limitedBuffer
+
+	cmd := exec.CommandContext(ctx, a.Command, a.Args...)
+	cmd.Env = a.Env
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// children keeping the pipes open must not block the sync
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+
+	logStderr(a.Command, request.Operation, stderr.Bytes())
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, fmt.Errorf("plugin %s: %w", a.Command, ctxErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", a.Command, err)
+	}
+	if stdout.overflow {
+		return nil, fmt.Errorf("plugin %s: output exceeds %d bytes", a.Command, maxExecOutput)
+	}
+
+	users, err := parseExecResponse(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", a.Command, err)
+	}
+
+	return users, nil
+}
+
+// parseExecResponse decodes and validates the plugin output, any error
+// rejects the whole response.
+func parseExecResponse(output []byte) ([]domain.UserDetail, error) {
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	decoder.DisallowUnknownFields()
+
+	var response ExecResponse
+
+	if err := decoder.Decode(&response); err != nil {
+		return nil, fmt.Errorf("malformed response: %w", err)
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("malformed response: data after the response")
+	}
+
+	if response.Version != ExecProtocolVersion {
+		return nil, fmt.Errorf("unsupported response version %d", response.Version)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("plugin error: %s", response.Error)
+	}
+
+	users := lo.Map(response.Users, func(user ExecUser, _ int) domain.UserDetail {
+		return domain.UserDetail{
+			Id:            lo.CoalesceOrEmpty(user.Id, user.Username),
+			Username:      user.Username,
+			Fullname:      user.Fullname,
+			SshPublicKeys: user.SshKeys,
+			Groups:        user.Groups,
+			Roles:         user.Roles,
+			Disabled:      user.Disabled,
+			ExpiresAt:     user.ExpiresAt,
+			UID:           user.UID,
+			GID:           user.GID,
+			Shell:         user.Shell,
+			Home:          user.Home,
+		}
+	})
+
+	if err := validateUsers(users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func logStderr(command, operation string, stderr []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(stderr))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			log.Warn().Str("plugin", command).Str("operation", operation).Msg(line)
+		}
+	}
+}
+
+// limitedBuffer keeps the first maxExecOutput bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if room := maxExecOutput - b.Len(); n > room {
+		b.overflow = true
+		p = p[:max(room, 0)]
+	}
+
+	_, _ = b.Buffer.Write(p)
+
+	// the plugin is not stopped by a short write, the overflow rejects the
+	// response after it exited
+	return n, nil
+}
@@ -0,0 +1,225 @@
+package adapter_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+
+	. "github.com/onsi/gomega"
+)
+
+const execKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGtQUDZWhs8k/cZcykMkaUX9CQRK5C/UzlhlEVRkAL0B alice@laptop"
+
+// execPlugin writes a shell script plugin and returns its path.
+func execPlugin(t *testing.T, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "plugin")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o700); err != nil {
+		t.Fatalf("write plugin: %v", err)
+	}
+
+	return path
+}
+
+func newExecAdapter(t *testing.T, script string) domain.Backend {
+	t.Helper()
+
+	k, err := adapter.NewExecAdapter(&domain.Config{Exec: domain.ExecConfig{
+		Command: execPlugin(t, script),
+		Args:    []string{"--realm", "corp"},
+		Env:     map[string]string{"CMDB_TOKEN": "secret"},
+		Timeout: 2 * time.Second,
+	}})
+	if err != nil {
+		t.Fatalf("new exec adapter: %v", err)
+	}
+
+	return k
+}
+
+func TestExecUsers(t *testing.T) {
+	RegisterTestingT(t)
+
+	var logs bytes.Buffer
+
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = logger })
+
+	k := newExecAdapter(t, `
+request=$(cat)
+echo "request $request" >&2
+[ "$1 $2" = "--realm corp" ] || exit 3
+[ "$CMDB_TOKEN" = "secret" ] || exit 4
+
+case "$request" in
+*'"operation":"fetch_users"'*)
+	cat <<EOF
+{"version":1,"users":[
+	{"id":"42","username":"alice","fullname":"Alice","ssh_keys":["`+execKey+`"],"groups":["ops"],"roles":["admin"],
+	 "expires_at":"2030-01-01T00:00:00Z","uid":20001,"gid":5000,"shell":"/bin/zsh","home":"/home/alice"},
+	{"username":"svc-backup","disabled":true}
+]}
+EOF
+	;;
+*'"username":"alice"'*)
+	echo '{"version":1,"users":[{"username":"alice"}]}'
+	;;
+*)
+	echo '{"version":1,"users":[]}'
+	;;
+esac
+`)
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(Equal([]domain.UserDetail{
+		{
+			Id:            "42",
+			Username:      "alice",
+			Fullname:      "Alice",
+			SshPublicKeys: []string{execKey},
+			Groups:        []string{"ops"},
+			Roles:         []string{"admin"},
+			ExpiresAt:     time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			UID:           20001,
+			GID:           5000,
+			Shell:         "/bin/zsh",
+			Home:          "/home/alice",
+		},
+		{Id: "svc-backup", Username: "svc-backup", Disabled: true},
+	}))
+
+	Expect(logs.String()).To(ContainSubstring(`request {\"version\":1,\"operation\":\"fetch_users\"}`))
+
+	alice, err := k.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+	Expect(alice.Username).To(Equal("alice"))
+
+	_, err = k.FetchUser(context.Background(), "bob")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+}
+
+func TestExecRejected(t *testing.T) {
+	RegisterTestingT(t)
+
+	for name, tc := range map[string]struct {
+		script string
+		err    string
+	}{
+		"exit status": {
+			`echo '{"version":1,"users":[]}'; exit 1`,
+			"exit status 1",
+		},
+		"malformed json": {
+			`echo '{"version":1,"users":['`,
+			"malformed response",
+		},
+		"unknown field": {
+			`echo '{"version":1,"users":[{"username":"alice","login":"alice"}]}'`,
+			`unknown field "login"`,
+		},
+		"trailing data": {
+			`echo '{"version":1,"users":[]} {"version":1}'`,
+			"data after the response",
+		},
+		"version": {
+			`echo '{"version":2,"users":[]}'`,
+			"unsupported response version 2",
+		},
+		"plugin error": {
+			`echo '{"version":1,"error":"cmdb unavailable"}'`,
+			"plugin error: cmdb unavailable",
+		},
+		"missing username": {
+			`echo '{"version":1,"users":[{"username":"alice"},{"fullname":"Nobody"}]}'`,
+			`user 1: invalid username ""`,
+		},
+		"invalid username": {
+			`echo '{"version":1,"users":[{"username":"root:x:0:0"}]}'`,
+			"invalid username",
+		},
+		"duplicate": {
+			`echo '{"version":1,"users":[{"username":"alice"},{"username":"alice"}]}'`,
+			"user alice: returned twice",
+		},
+		"malformed key": {
+			`echo '{"version":1,"users":[{"username":"alice","ssh_keys":["ssh-ed25519 garbage"]}]}'`,
+			"user alice: malformed ssh key",
+		},
+		"invalid group": {
+			`echo '{"version":1,"users":[{"username":"alice","groups":["ops,wheel"]}]}'`,
+			"invalid group",
+		},
+		"timeout": {
+			`sleep 10`,
+			"context deadline exceeded",
+		},
+	} {
+		k, err := adapter.NewExecAdapter(&domain.Config{Exec: domain.ExecConfig{
+			Command: execPlugin(t, tc.script),
+			Timeout: 500 * time.Millisecond,
+		}})
+		Expect(err).To(BeNil())
+
+		users, err := k.FetchUsers(context.Background())
+		Expect(err).To(MatchError(ContainSubstring(tc.err)), name)
+		Expect(users).To(BeNil(), name)
+	}
+}
+
+func TestExecOtherUser(t *testing.T) {
+	RegisterTestingT(t)
+
+	k := newExecAdapter(t, `echo '{"version":1,"users":[{"username":"mallory"}]}'`)
+
+	_, err := k.FetchUser(context.Background(), "alice")
+	Expect(err).To(MatchError(ContainSubstring("plugin returned other users")))
+}
+
+func TestExecCancel(t *testing.T) {
+	RegisterTestingT(t)
+
+	k := newExecAdapter(t, `sleep 10`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := k.FetchUsers(ctx)
+	Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+}
+
+func TestExecConfig(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := adapter.NewExecAdapter(&domain.Config{})
+	Expect(err).To(MatchError("exec command is not set"))
+
+	_, err = adapter.NewExecAdapter(&domain.Config{Exec: domain.ExecConfig{Command: "/nonexistent/plugin"}})
+	Expect(err).NotTo(BeNil())
+
+	// the sync timeout caps every run
+	cfg := &domain.Config{Exec: domain.ExecConfig{Command: "sh", Timeout: 2 * time.Minute}}
+
+	_, err = adapter.NewExecAdapter(cfg)
+	Expect(err).To(MatchError("exec timeout 2m0s must be below the sync timeout 1m0s"))
+
+	cfg.Sync.Timeout = 5 * time.Minute
+
+	_, err = adapter.NewExecAdapter(cfg)
+	Expect(err).To(BeNil())
+}
@@ -0,0 +1,259 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+// fileReloadDelay collects the events of a write before the reload.
+const fileReloadDelay = 100 * time.Millisecond
+
+// fileExtensions are the extensions of the per-user files, other files of
+// the directory like editor backups are ignored.
+var fileExtensions = []string{".yaml", ".yml", ".json"}
+
+// fileUser is a user of the file backend. JSON files are read as YAML.
+type fileUser struct {
+	// Id defaults to the username
+	Id       string   `yaml:"id"`
+	Username string   `yaml:"username"`
+	Fullname string   `yaml:"fullname"`
+	SshKeys  []string `yaml:"ssh_keys"`
+	Groups   []string `yaml:"groups"`
+	Roles    []string `yaml:"roles"`
+	Disabled bool     `yaml:"disabled"`
+	// ExpiresAt is a timestamp or date, the account never expires when it
+	// is missing
+	ExpiresAt time.Time `yaml:"expires_at"`
+	UID       uint      `yaml:"uid"`
+	GID       uint      `yaml:"gid"`
+	Shell     string    `yaml:"shell"`
+	Home      string    `yaml:"home"`
+}
+
+func (u fileUser) detail() domain.UserDetail {
+	return domain.UserDetail{
+		Id:            lo.CoalesceOrEmpty(u.Id, u.Username),
+		Username:      u.Username,
+		Fullname:      u.Fullname,
+		SshPublicKeys: u.SshKeys,
+		Groups:        u.Groups,
+		Roles:         u.Roles,
+		Disabled:      u.Disabled,
+		ExpiresAt:     u.ExpiresAt,
+		UID:           u.UID,
+		GID:           u.GID,
+		Shell:         u.Shell,
+		Home:          u.Home,
+	}
+}
+
+// FileAdapter serves the users of a local file or directory, for hosts
+// without access to an identity provider or as emergency accounts next to
+// one. Changes are picked up through inotify, a change with a malformed
+// user is rejected as a whole and the previous users are kept.
+type FileAdapter struct {
+	Path string
+
+	dir     bool
+	watcher *fsnotify.Watcher
+
+	mu    sync.RWMutex
+	users []domain.UserDetail
+}
+
+func NewFileAdapter(config *domain.Config) (domain.Backend, error) {
+	if config.File.Path == "" {
+		return nil, errors.New("file path is not set")
+	}
+
+	info, err := os.Stat(config.File.Path)
+	if err != nil {
+		return nil, fmt.Errorf("file backend: %w", err)
+	}
+
+	a := &FileAdapter{Path: filepath.Clean(config.File.Path), dir: info.IsDir()}
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	a.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("file watch: %w", err)
+	}
+
+	// a single file is watched through its directory, editors and
+	// configuration management replace it instead of writing it
+	if err := a.watcher.Add(lo.Ternary(a.dir, a.Path, filepath.Dir(a.Path))); err != nil {
+		_ = a.watcher.Close()
+		return nil, fmt.Errorf("file watch: %w", err)
+	}
+
+	go a.watch()
+
+	return a, nil
+}
+
+func (a *FileAdapter) FetchUser(_ context.Context, username string) (domain.UserDetail, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	user, found := lo.Find(a.users, func(item domain.UserDetail) bool {
+		return item.Username == username
+	})
+	if !found {
+		return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", username, domain.ErrNotFound)
+	}
+
+	return user, nil
+}
+
+func (a *FileAdapter) FetchUsers(_ context.Context) ([]domain.UserDetail, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return slices.Clone(a.users), nil
+}
+
+// Close stops watching the file.
+func (a *FileAdapter) Close() error {
+	return a.watcher.Close()
+}
+
+// watch reloads the users after changes until the watcher is closed.
+func (a *FileAdapter) watch() {
+	var reload <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-a.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			reload = time.After(fileReloadDelay)
+		case err, ok := <-a.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.Warn().Err(err).Str("path", a.Path).Msg("file watch")
+		case <-reload:
+			reload = nil
+
+			if err := a.load(); err != nil {
+				log.Error().Err(err).Str("path", a.Path).Msg("file rejected, keeping the previous users")
+			}
+		}
+	}
+}
+
+// load reads and validates the users, they replace the served users only
+// if every user is valid.
+func (a *FileAdapter) load() error {
+	var users []domain.UserDetail
+
+	if a.dir {
+		entries, err := os.ReadDir(a.Path)
+		if err != nil {
+			return fmt.Errorf("file backend: %w", err)
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			ext := filepath.Ext(name)
+
+			if entry.IsDir() || strings.HasPrefix(name, ".") || !lo.Contains(fileExtensions, ext) {
+				continue
+			}
+
+			var user fileUser
+
+			if err := decodeFile(filepath.Join(a.Path, name), &user); err != nil {
+				return err
+			}
+
+			username := strings.TrimSuffix(name, ext)
+
+			switch user.Username {
+			case "":
+				user.Username = username
+			case username:
+			default:
+				return fmt.Errorf("%s: username %q does not match the file name", filepath.Join(a.Path, name), user.Username)
+			}
+
+			users = append(users, user.detail())
+		}
+	} else {
+		var file struct {
+			Users []fileUser `yaml:"users"`
+		}
+
+		if err := decodeFile(a.Path, &file); err != nil {
+			return err
+		}
+
+		users = lo.Map(file.Users, func(item fileUser, _ int) domain.UserDetail {
+			return item.detail()
+		})
+	}
+
+	if err := validateUsers(users); err != nil {
+		return fmt.Errorf("%s: %w", a.Path, err)
+	}
+
+	a.mu.Lock()
+	changed := !reflect.DeepEqual(a.users, users)
+	a.users = users
+	a.mu.Unlock()
+
+	if changed {
+		log.Info().Str("path", a.Path).Int("users", len(users)).Msg("users loaded")
+	}
+
+	return nil
+}
+
+// decodeFile strictly decodes a YAML or JSON file, unknown fields and empty
+// files are rejected.
+func decodeFile(path string, out any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("file backend: %w", err)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return fmt.Errorf("%s: empty file", path)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(out); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package adapter_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+
+	. "github.com/onsi/gomega"
+)
+
+// writeFile replaces the file like an editor, through a temporary file.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	tmp := filepath.Join(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+}
+
+func newFileAdapter(t *testing.T, path string) domain.Backend {
+	t.Helper()
+
+	k, err := adapter.NewFileAdapter(&domain.Config{File: domain.FileConfig{Path: path}})
+	if err != nil {
+		t.Fatalf("new file adapter: %v", err)
+	}
+
+	t.Cleanup(func() { _ = k.(io.Closer).Close() })
+
+	return k
+}
+
+func usernames(k domain.Backend) func() []string {
+	return func() []string {
+		users, _ := k.FetchUsers(context.Background())
+		return lo.Map(users, func(item domain.UserDetail, _ int) string { return item.Username })
+	}
+}
+
+func TestFileUsers(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeFile(t, path, `
+users:
+  - username: alice
+    fullname: Alice Liddell
+    ssh_keys:
+      - "`+execKey+`"
+    groups: [ops]
+    expires_at: 2030-01-01
+    uid: 20001
+    shell: /bin/zsh
+  - username: breakglass
+    id: bg-1
+`)
+
+	k := newFileAdapter(t, path)
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(Equal([]domain.UserDetail{
+		{
+			Id:            "alice",
+			Username:      "alice",
+			Fullname:      "Alice Liddell",
+			SshPublicKeys: []string{execKey},
+			Groups:        []string{"ops"},
+			ExpiresAt:     time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			UID:           20001,
+			Shell:         "/bin/zsh",
+		},
+		{Id: "bg-1", Username: "breakglass"},
+	}))
+
+	breakglass, err := k.FetchUser(context.Background(), "breakglass")
+	Expect(err).To(BeNil())
+	Expect(breakglass.Id).To(Equal("bg-1"))
+
+	_, err = k.FetchUser(context.Background(), "bob")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	// changes are applied
+	writeFile(t, path, "users:\n  - username: alice\n  - username: bob\n")
+	Eventually(usernames(k)).Should(Equal([]string{"alice", "bob"}))
+
+	// a malformed change is rejected as a whole
+	writeFile(t, path, "users:\n  - username: carol\n  - username: root:x\n")
+	Consistently(usernames(k), 500*time.Millisecond).Should(Equal([]string{"alice", "bob"}))
+
+	writeFile(t, path, "users:\n  - username: carol\n    password: secret\n")
+	Consistently(usernames(k), 500*time.Millisecond).Should(Equal([]string{"alice", "bob"}))
+
+	// written in place
+	Expect(os.WriteFile(path, []byte(`{"users": [{"username": "carol", "expires_at": "2030-01-01T00:00:00Z"}]}`), 0o600)).To(Succeed())
+	Eventually(usernames(k)).Should(Equal([]string{"carol"}))
+}
+
+func TestFileDirectory(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "alice.yaml"), "fullname: Alice\nssh_keys:\n  - \""+execKey+"\"\n")
+	writeFile(t, filepath.Join(dir, "bob.json"), `{"groups": ["ops"], "disabled": true}`)
+	writeFile(t, filepath.Join(dir, "README.md"), "emergency accounts")
+	writeFile(t, filepath.Join(dir, "alice.yaml~"), "backup: true")
+
+	k := newFileAdapter(t, dir)
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(Equal([]domain.UserDetail{
+		{Id: "alice", Username: "alice", Fullname: "Alice", SshPublicKeys: []string{execKey}},
+		{Id: "bob", Username: "bob", Groups: []string{"ops"}, Disabled: true},
+	}))
+
+	writeFile(t, filepath.Join(dir, "carol.yml"), "username: carol\n")
+	Eventually(usernames(k)).Should(Equal([]string{"alice", "bob", "carol"}))
+
+	Expect(os.Remove(filepath.Join(dir, "bob.json"))).To(Succeed())
+	Eventually(usernames(k)).Should(Equal([]string{"alice", "carol"}))
+
+	// the username must match the file name
+	writeFile(t, filepath.Join(dir, "dave.yaml"), "username: root\n")
+	Consistently(usernames(k), 500*time.Millisecond).Should(Equal([]string{"alice", "carol"}))
+}
+
+func TestFileConfig(t *testing.T) {
+	RegisterTestingT(t)
+
+	dir := t.TempDir()
+
+	_, err := adapter.NewFileAdapter(&domain.Config{})
+	Expect(err).To(MatchError("file path is not set"))
+
+	_, err = adapter.NewFileAdapter(&domain.Config{File: domain.FileConfig{Path: filepath.Join(dir, "missing.yaml")}})
+	Expect(err).NotTo(BeNil())
+
+	for name, content := range map[string]string{
+		"empty.yaml":     "\n",
+		"unknown.yaml":   "users:\n  - username: alice\n    password: secret\n",
+		"duplicate.yaml": "users:\n  - username: alice\n  - username: alice\n",
+		"key.yaml":       "users:\n  - username: alice\n    ssh_keys: [\"ssh-rsa garbage\"]\n",
+	} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, content)
+
+		_, err = adapter.NewFileAdapter(&domain.Config{File: domain.FileConfig{Path: path}})
+		Expect(err).NotTo(BeNil(), name)
+	}
+}
+
+func TestFileFallback(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := filepath.Join(t.TempDir(), "breakglass.yaml")
+	writeFile(t, path, "users:\n  - username: breakglass\n    ssh_keys: [\""+execKey+"\"]\n")
+
+	backend, err := adapter.NewBackend(&domain.Config{
+		Backends: []domain.BackendConfig{
+			{Type: "keycloak", Keycloak: domain.KeycloakConfig{Server: "https://sso.example.com"}},
+			{Name: "emergency", Type: "file", Priority: 100, File: domain.FileConfig{Path: path}},
+		},
+	})
+	Expect(err).To(BeNil())
+
+	composite := backend.(*adapter.CompositeBackend)
+	Expect(composite.Backends[1].Name).To(Equal("emergency"))
+
+	users, err := composite.Backends[1].Backend.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(1))
+
+	_ = composite.Backends[1].Backend.(io.Closer).Close()
+}
@@ -0,0 +1,151 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// jsonPath selects values of a decoded JSON document. It supports the
+// JSONPath subset of member names, array indexes and wildcards, e.g.
+// "$.data.users", "emails[0]" or "keys[*].value".
+type jsonPath []jsonStep
+
+type jsonStep struct {
+	name string
+	// index is the array index, -1 selects every element or member
+	index int
+}
+
+func parseJsonPath(path string) (jsonPath, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, nil
+	}
+
+	var ret jsonPath
+
+	for _, segment := range strings.Split(path, ".") {
+		name, rest, _ := strings.Cut(segment, "[")
+
+		switch {
+		case name == "*":
+			ret = append(ret, jsonStep{index: -1})
+		case name != "":
+			ret = append(ret, jsonStep{name: name})
+		case rest == "":
+			return nil, fmt.Errorf("path %s: empty member name", path)
+		}
+
+		for rest != "" {
+			index, tail, found := strings.Cut(rest, "]")
+			if !found {
+				return nil, fmt.Errorf("path %s: unterminated index", path)
+			}
+
+			if index == "*" {
+				ret = append(ret, jsonStep{index: -1})
+			} else {
+				i, err := strconv.Atoi(index)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("path %s: malformed index %q", path, index)
+				}
+
+				ret = append(ret, jsonStep{index: i})
+			}
+
+			if tail != "" && !strings.HasPrefix(tail, "[") {
+				return nil, fmt.Errorf("path %s: unexpected %q", path, tail)
+			}
+
+			rest = strings.TrimPrefix(tail, "[")
+		}
+	}
+
+	return ret, nil
+}
+
+// Select returns the selected values, missing members are skipped. An
+// empty path selects the document.
+func (p jsonPath) Select(doc any) []any {
+	current := []any{doc}
+
+	for _, step := range p {
+		var next []any
+
+		for _, value := range current {
+			switch v := value.(type) {
+			case map[string]any:
+				switch {
+				case step.name != "":
+					if member, has := v[step.name]; has {
+						next = append(next, member)
+					}
+				case step.index < 0:
+					// members in a stable order
+					keys := lo.Keys(v)
+					slices.Sort(keys)
+
+					for _, key := range keys {
+						next = append(next, v[key])
+					}
+				}
+			case []any:
+				switch {
+				case step.name != "":
+				case step.index < 0:
+					next = append(next, v...)
+				case step.index < len(v):
+					next = append(next, v[step.index])
+				}
+			}
+		}
+
+		current = next
+	}
+
+	return current
+}
+
+// Strings returns the selected scalar values as strings, arrays are
+// flattened.
+func (p jsonPath) Strings(doc any) []string {
+	var ret []string
+
+	for _, value := range p.Select(doc) {
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+
+		for _, v := range values {
+			if s, ok := jsonString(v); ok && s != "" {
+				ret = append(ret, s)
+			}
+		}
+	}
+
+	return ret
+}
+
+// String returns the first selected scalar value.
+func (p jsonPath) String(doc any) string {
+	return lo.FirstOrEmpty(p.Strings(doc))
+}
+
+func jsonString(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
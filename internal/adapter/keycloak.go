@@ -3,28 +3,77 @@ package adapter
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
 	"github.com/samber/lo"
 
 	"github.com/h2hsecure/sshkeyman/internal/domain"
 )
 
 const (
-	ServerTokenUrl       = "/auth/realms/%s/protocol/openid-connect/token"
-	ServerUserDetailsUrl = "/auth/admin/realms/%s/users"
-	ServerUserDetailUrl  = "/auth/admin/realms/%s/users/%s"
+	ServerUserDetailsUrl  = "/admin/realms/%s/users"
+	ServerUserCountUrl    = "/admin/realms/%s/users/count"
+	ServerUserDetailUrl   = "/admin/realms/%s/users/%s"
+	ServerUserGroupsUrl   = "/admin/realms/%s/users/%s/groups"
+	ServerGroupsUrl       = "/admin/realms/%s/groups"
+	ServerGroupMembersUrl = "/admin/realms/%s/groups/%s/members"
+	ServerUserRolesUrl    = "/admin/realms/%s/users/%s/role-mappings/realm/composite"
+
+	ServerClientsUrl         = "/admin/realms/%s/clients"
+	ServerUserClientRolesUrl = "/admin/realms/%s/users/%s/role-mappings/clients/%s/composite"
+
+	DefaultPageSize = 100
+
+	DefaultSshKeyAttribute = "ssh-key"
 )
 
 type KeyCloakAdapter struct {
-	ClientId       string
-	Server         string
+	ClientId string
+	Server   string
+	// ContextPath is the path Keycloak is served below, e.g. "/auth" for
+	// versions before 17. It is detected when empty, "/" is the root
+	ContextPath    string
 	Realm          string
 	AccessUser     string
 	AccessPassword string
+	// GrantType is GrantPassword or GrantClientCredentials
+	GrantType string
+	// ClientSecret and ClientAssertionKey authenticate confidential clients,
+	// the latter is the path of the private key signing JWT assertions
+	ClientSecret       string
+	ClientAssertionKey string
+	ExpiryAttribute    string
+	KeyAttributes      []string
+
+	KeyExpiryAttribute    string
+	KeyNotBeforeAttribute string
+
+	// Attributes maps user attributes to the account properties
+	Attributes domain.AttributeMapping
+
+	// LockRequiredActions lists the required actions disabling the user
+	LockRequiredActions []string
+
+	// Roles lists the realm roles fetched for principals, "*" fetches all
+	// of them and none are fetched when empty
+	Roles []string
+	// PageSize is the number of users requested per admin API call
+	PageSize int
 
-	resty *resty.Client
+	// RequiredGroups, RequiredRealmRoles and RequiredClientRoles restrict
+	// the returned users, see domain.KeycloakConfig
+	RequiredGroups      []string
+	RequiredRealmRoles  []string
+	RequiredClientRoles map[string][]string
+
+	resty     *resty.Client
+	tokens    tokenCache
+	endpoints endpoints
 }
 
 type keycloakUser struct {
@@ -33,57 +82,229 @@ type keycloakUser struct {
 	Attributes map[string][]string `json:"attributes"`
 	FirstName  string              `json:"firstName"`
 	LastName   string              `json:"lastName"`
+	Enabled    bool                `json:"enabled"`
+	// NotBefore revokes the sessions issued before it, in epoch seconds
+	NotBefore       int64    `json:"notBefore"`
+	RequiredActions []string `json:"requiredActions"`
 }
 
-func (k keycloakUser) sshKey() string {
-	key, has := k.Attributes["ssh-key"]
-	if !has {
-		return ""
+type keycloakRole struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type keycloakGroup struct {
+	Id        string          `json:"id"`
+	Name      string          `json:"name"`
+	Path      string          `json:"path"`
+	SubGroups []keycloakGroup `json:"subGroups"`
+}
+
+// posixName returns the local name of the group, derived from its path so
+// that subgroups of the same name stay apart, e.g. /ops/linux is ops-linux.
+func (g keycloakGroup) posixName() string {
+	if g.Path == "" {
+		return g.Name
 	}
 
-	if len(key) != 1 {
-		return ""
+	return strings.ReplaceAll(strings.Trim(g.Path, "/"), "/", "-")
+}
+
+// groupNames returns the local names of the groups of the user. Names which
+// can not be served through NSS, e.g. holding spaces, are skipped.
+func groupNames(username string, groups []keycloakGroup) []string {
+	return lo.FilterMap(groups, func(item keycloakGroup, _ int) (string, bool) {
+		name := item.posixName()
+		if !validName(name) {
+			log.Warn().Str("user", username).Str("group", item.Path).Msg("skipping group with invalid name")
+			return "", false
+		}
+
+		return name, true
+	})
+}
+
+// flatten returns the group itself followed by all of its subgroups.
+func (g keycloakGroup) flatten() []keycloakGroup {
+	ret := []keycloakGroup{g}
+
+	for _, sub := range g.SubGroups {
+		ret = append(ret, sub.flatten()...)
 	}
-	return key[0]
+
+	return ret
 }
 
-func NewKeyCloakAdapter(config *domain.Config) domain.Backend {
-	return &KeyCloakAdapter{
-		ClientId:       config.Keycloak.ClientId,
-		Realm:          config.Keycloak.Realm,
-		AccessUser:     config.Keycloak.Username,
-		AccessPassword: config.Keycloak.Password,
-		resty:          resty.New().SetTimeout(3 * time.Second).SetBaseURL(config.Keycloak.Server),
+// sshKeys returns every non empty value of the given key attributes.
+func (k keycloakUser) sshKeys(attributes []string) []string {
+	var ret []string
+
+	for _, attribute := range attributes {
+		for _, value := range k.Attributes[attribute] {
+			if value = strings.TrimSpace(value); value != "" {
+				ret = append(ret, value)
+			}
+		}
 	}
+
+	return ret
 }
 
-func (a *KeyCloakAdapter) auth(ctx context.Context) (string, error) {
-	var ret domain.TokenDetail
+// expiresAt parses the account expiry attribute, a zero time is returned
+// when the attribute is not configured, missing or malformed.
+func (k keycloakUser) expiresAt(attribute string) time.Time {
+	if attribute == "" {
+		return time.Time{}
+	}
 
-	formData := map[string]string{
-		"client_id":  a.ClientId,
-		"username":   a.AccessUser,
-		"password":   a.AccessPassword,
-		"grant_type": "password",
+	value, has := k.Attributes[attribute]
+	if !has || len(value) != 1 {
+		return time.Time{}
 	}
 
-	postUrl := fmt.Sprintf(ServerTokenUrl, a.Realm)
+	t, err := domain.ParseDate(value[0])
+	if err != nil {
+		log.Warn().Err(err).Str("user", k.Username).Msg("malformed account expiry")
+	}
 
-	res, err := a.resty.R().
-		EnableTrace().
-		SetContext(ctx).
-		SetFormData(formData).
-		SetResult(&ret).
-		Post(postUrl)
+	return t
+}
 
-	if res.IsError() {
-		return "", fmt.Errorf("auth request (%s): %v code: %d", postUrl, res.Error(), res.StatusCode())
+// keyDates parses a per key date attribute. The values apply to the keys
+// in the order returned by sshKeys, a single value applies to every key.
+// Empty and malformed values leave the related key unrestricted.
+func (k keycloakUser) keyDates(attribute string, keys int) []time.Time {
+	if attribute == "" || len(k.Attributes[attribute]) == 0 {
+		return nil
 	}
+
+	values := k.Attributes[attribute]
+	ret := make([]time.Time, keys)
+
+	for i := range ret {
+		value := values[0]
+		if len(values) > 1 {
+			if i >= len(values) {
+				break
+			}
+
+			value = values[i]
+		}
+
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+
+		t, err := domain.ParseDate(value)
+		if err != nil {
+			log.Warn().Err(err).Str("user", k.Username).Str("attribute", attribute).Msg("malformed key date")
+			continue
+		}
+
+		ret[i] = t
+	}
+
+	return ret
+}
+
+// toUserDetail maps the keycloak representation to the backend user.
+func (k keycloakUser) toUserDetail(a *KeyCloakAdapter) domain.UserDetail {
+	keys := k.sshKeys(a.KeyAttributes)
+
+	return domain.UserDetail{
+		Id:              k.Id,
+		Username:        k.Username,
+		Fullname:        k.FirstName + " " + k.LastName,
+		SshPublicKeys:   keys,
+		SshKeyNotBefore: k.keyDates(a.KeyNotBeforeAttribute, len(keys)),
+		SshKeyNotAfter:  k.keyDates(a.KeyExpiryAttribute, len(keys)),
+		Disabled:        !k.Enabled || k.pendingAction(a.LockRequiredActions),
+		RevokedBefore:   lo.Ternary(k.NotBefore > 0, time.Unix(k.NotBefore, 0), time.Time{}),
+		ExpiresAt:       k.expiresAt(a.ExpiryAttribute),
+		UID:             k.id(a.Attributes.Uid),
+		GID:             k.id(a.Attributes.Gid),
+		Shell:           k.attribute(a.Attributes.Shell),
+		Home:            k.attribute(a.Attributes.Home),
+	}
+}
+
+// attribute returns the first value of a single valued attribute, empty
+// when the attribute is not configured or missing.
+func (k keycloakUser) attribute(attribute string) string {
+	if attribute == "" || len(k.Attributes[attribute]) == 0 {
+		return ""
+	}
+
+	return strings.TrimSpace(k.Attributes[attribute][0])
+}
+
+// id parses a numeric id attribute, zero is returned when the attribute is
+// not configured, missing or malformed.
+func (k keycloakUser) id(attribute string) uint {
+	value := k.attribute(attribute)
+	if value == "" {
+		return 0
+	}
+
+	id, err := strconv.ParseUint(value, 10, 32)
 	if err != nil {
-		return "", fmt.Errorf("auth request: %w", err)
+		log.Warn().Err(err).Str("user", k.Username).Str("attribute", attribute).Msg("malformed id")
+		return 0
 	}
 
-	return ret.AuthToken, nil
+	return uint(id)
+}
+
+// pendingAction reports whether the user still has to complete any of the
+// given required actions.
+func (k keycloakUser) pendingAction(actions []string) bool {
+	for _, action := range k.RequiredActions {
+		if lo.Contains(actions, action) {
+			log.Info().Str("user", k.Username).Str("action", action).Msg("required action pending")
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewKeyCloakAdapter(config *domain.Config) domain.Backend {
+	keyAttributes := config.Keycloak.SshKeyAttributes
+	if len(keyAttributes) == 0 {
+		keyAttributes = []string{DefaultSshKeyAttribute}
+	}
+
+	grantType := config.Keycloak.GrantType
+	if grantType == "" {
+		grantType = lo.Ternary(config.Keycloak.Username != "", GrantPassword, GrantClientCredentials)
+	}
+
+	return &KeyCloakAdapter{
+		ClientId:           config.Keycloak.ClientId,
+		Server:             config.Keycloak.Server,
+		ContextPath:        config.Keycloak.ContextPath,
+		GrantType:          grantType,
+		ClientSecret:       config.Keycloak.ClientSecret,
+		ClientAssertionKey: config.Keycloak.ClientAssertionKey,
+
+		Realm:           config.Keycloak.Realm,
+		AccessUser:      config.Keycloak.Username,
+		AccessPassword:  config.Keycloak.Password,
+		ExpiryAttribute: config.Keycloak.ExpiryAttribute,
+		KeyAttributes:   keyAttributes,
+
+		KeyExpiryAttribute:    config.Keycloak.KeyExpiryAttribute,
+		KeyNotBeforeAttribute: config.Keycloak.KeyNotBeforeAttribute,
+		LockRequiredActions:   config.Keycloak.LockRequiredActions,
+		Attributes:            config.Keycloak.Attributes,
+		Roles:                 config.Principals.Roles,
+		PageSize:              lo.Ternary(config.Keycloak.PageSize > 0, config.Keycloak.PageSize, DefaultPageSize),
+		RequiredGroups:        config.Keycloak.RequiredGroups,
+		RequiredRealmRoles:    config.Keycloak.RequiredRealmRoles,
+		RequiredClientRoles:   config.Keycloak.RequiredClientRoles,
+
+		resty: resty.New().SetTimeout(3 * time.Second).SetBaseURL(config.Keycloak.Server),
+	}
 }
 
 func (a *KeyCloakAdapter) FetchUser(ctx context.Context, username string) (domain.UserDetail, error) {
@@ -102,43 +323,82 @@ func (a *KeyCloakAdapter) FetchUser(ctx context.Context, username string) (domai
 		SetQueryParam("username", username).
 		SetQueryParam("exact", "true").
 		SetResult(&ret).
-		Get(fmt.Sprintf(ServerUserDetailsUrl, a.Realm))
+		Get(a.adminUrl(ServerUserDetailsUrl, a.Realm))
 
 	if res.IsError() {
-		return domain.UserDetail{}, fmt.Errorf("fetch user: %v code: %d", res.Error(), res.StatusCode())
+		return domain.UserDetail{}, a.statusError("fetch user", res)
 	}
 	if err != nil {
 		return domain.UserDetail{}, fmt.Errorf("fetch user: %w", err)
 	}
 
-	detail, _ := lo.Find(ret, func(item keycloakUser) bool {
+	detail, found := lo.Find(ret, func(item keycloakUser) bool {
 		return item.Username == username
 	})
+	if !found {
+		return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", username, domain.ErrNotFound)
+	}
 
+	return a.fetchUserById(ctx, token, detail.Id)
+}
+
+// fetchUserById returns the user with its groups and, if needed, its roles.
+// Missing users and users lacking the required groups and roles are not
+// found.
+func (a *KeyCloakAdapter) fetchUserById(ctx context.Context, token, id string) (domain.UserDetail, error) {
 	var userRet keycloakUser
 
-	userResp, err := a.resty.R().
-		EnableTrace().
-		SetContext(ctx).
-		SetHeader("Content-Type", "application/json").
-		SetHeader("Authorization", fmt.Sprintf("bearer %s", token)).
-		SetQueryParam("username", username).
-		SetQueryParam("exact", "true").
+	userResp, err := a.request(ctx, token).
 		SetResult(&userRet).
-		Get(fmt.Sprintf(ServerUserDetailUrl, a.Realm, detail.Id))
-
+		Get(a.adminUrl(ServerUserDetailUrl, a.Realm, id))
+	if err != nil {
+		return domain.UserDetail{}, fmt.Errorf("fetch user: %w", err)
+	}
+	if userResp.StatusCode() == http.StatusNotFound {
+		return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", id, domain.ErrNotFound)
+	}
 	if userResp.IsError() {
-		return domain.UserDetail{}, fmt.Errorf("fetch user: %v code: %d", res.Error(), userResp.StatusCode())
+		return domain.UserDetail{}, a.statusError("fetch user", userResp)
 	}
+
+	var groups []keycloakGroup
+
+	groupsResp, err := a.request(ctx, token).
+		SetResult(&groups).
+		Get(a.adminUrl(ServerUserGroupsUrl, a.Realm, id))
 	if err != nil {
-		return domain.UserDetail{}, fmt.Errorf("fetch user: %w", err)
+		return domain.UserDetail{}, fmt.Errorf("fetch user groups: %w", err)
+	}
+	if groupsResp.IsError() {
+		return domain.UserDetail{}, a.statusError("fetch user groups", groupsResp)
 	}
 
-	return domain.UserDetail{
-		Id:           detail.Id,
-		Username:     detail.Username,
-		SshPublicKey: detail.sshKey(),
-	}, nil
+	if a.restricted() {
+		clients, err := a.requiredClients(ctx, token)
+		if err != nil {
+			return domain.UserDetail{}, fmt.Errorf("fetch user access: %w", err)
+		}
+
+		authorized, err := a.userAuthorized(ctx, token, id, groups, clients)
+		if err != nil {
+			return domain.UserDetail{}, fmt.Errorf("fetch user access: %w", err)
+		}
+
+		if !authorized {
+			return domain.UserDetail{}, fmt.Errorf("user %s lacks the required groups and roles: %w", userRet.Username, domain.ErrNotFound)
+		}
+	}
+
+	user := userRet.toUserDetail(a)
+	user.Groups = groupNames(userRet.Username, groups)
+
+	if len(a.Roles) > 0 {
+		if user.Roles, err = a.userRoles(ctx, token, id); err != nil {
+			return domain.UserDetail{}, err
+		}
+	}
+
+	return user, nil
 }
 
 func (a *KeyCloakAdapter) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
@@ -147,26 +407,215 @@ func (a *KeyCloakAdapter) FetchUsers(ctx context.Context) ([]domain.UserDetail,
 		return nil, fmt.Errorf("authentication: %w", err)
 	}
 
-	var ret []keycloakUser
+	var count int
 
-	res, err := a.resty.R().
-		EnableTrace().
-		SetContext(ctx).
-		SetHeader("Content-Type", "application/json").
-		SetHeader("Authorization", fmt.Sprintf("bearer %s", token)).
-		SetQueryParam("exact", "true").
-		SetResult(&ret).
-		Get(fmt.Sprintf(ServerUserDetailsUrl, a.Realm))
+	res, err := a.request(ctx, token).
+		SetResult(&count).
+		Get(a.adminUrl(ServerUserCountUrl, a.Realm))
+	if err != nil {
+		return nil, fmt.Errorf("count users: %w", err)
+	}
+	if res.IsError() {
+		return nil, a.statusError("count users", res)
+	}
 
-	if res.IsError() || err != nil {
-		return []domain.UserDetail{}, fmt.Errorf("auth request: %w", err)
+	// attributes are only returned with the full representation
+	ret, err := fetchPages[keycloakUser](ctx, a, token, "list users", a.adminUrl(ServerUserDetailsUrl, a.Realm), "false")
+	if err != nil {
+		return nil, err
+	}
+
+	// users deleted while paging also shrink the listing, a later sync
+	// picks up the complete realm again
+	if len(ret) < count {
+		return nil, fmt.Errorf("%w: listed %d of %d users", domain.ErrTruncated, len(ret), count)
+	}
+
+	memberships, err := a.fetchMemberships(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("fetch groups: %w", err)
+	}
+
+	if a.restricted() {
+		authorized, err := a.fetchAuthorized(ctx, token, ret, memberships)
+		if err != nil {
+			return nil, fmt.Errorf("fetch authorized users: %w", err)
+		}
+
+		ret = lo.Filter(ret, func(item keycloakUser, _ int) bool {
+			return authorized[item.Username]
+		})
+	}
+
+	roles := map[string][]string{}
+
+	if len(a.Roles) > 0 {
+		if roles, err = a.fetchRoles(ctx, token, ret); err != nil {
+			return nil, fmt.Errorf("fetch roles: %w", err)
+		}
 	}
 
 	return lo.Map(ret, func(item keycloakUser, _ int) domain.UserDetail {
-		return domain.UserDetail{
-			Username:     item.Username,
-			SshPublicKey: item.sshKey(),
-			Fullname:     item.FirstName + " " + item.LastName,
+		detail := item.toUserDetail(a)
+		detail.Groups = groupNames(item.Username, memberships[item.Username])
+		detail.Roles = roles[item.Username]
+
+		return detail
+	}), nil
+}
+
+// fetchMemberships returns the groups of every group member in the realm,
+// keyed by username. Subgroups are resolved as separate groups, groups
+// whose paths map to the same local name are rejected.
+func (a *KeyCloakAdapter) fetchMemberships(ctx context.Context, token string) (map[string][]keycloakGroup, error) {
+	var groups []keycloakGroup
+
+	res, err := a.request(ctx, token).
+		SetResult(&groups).
+		Get(a.adminUrl(ServerGroupsUrl, a.Realm))
+	if err != nil {
+		return nil, fmt.Errorf("list groups: %w", err)
+	}
+	if res.IsError() {
+		return nil, a.statusError("list groups", res)
+	}
+
+	ret := map[string][]keycloakGroup{}
+	// paths holds the path of every local group name
+	paths := map[string]string{}
+
+	for _, group := range lo.FlatMap(groups, func(item keycloakGroup, _ int) []keycloakGroup {
+		return item.flatten()
+	}) {
+		if path, has := paths[group.posixName()]; has {
+			return nil, fmt.Errorf("groups %s and %s are both named %s", path, group.Path, group.posixName())
 		}
+
+		paths[group.posixName()] = group.Path
+
+		members, err := fetchPages[keycloakUser](ctx, a, token, fmt.Sprintf("group members (%s)", group.Path),
+			a.adminUrl(ServerGroupMembersUrl, a.Realm, group.Id), "true")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range members {
+			ret[member.Username] = append(ret[member.Username], group)
+		}
+	}
+
+	return ret, nil
+}
+
+// fetchRoles returns the realm roles of every user with keys, keyed by
+// username. They are resolved by userRoles like FetchUser does, users
+// without keys are never synced.
+func (a *KeyCloakAdapter) fetchRoles(ctx context.Context, token string, users []keycloakUser) (map[string][]string, error) {
+	ret := map[string][]string{}
+
+	for _, user := range users {
+		if len(user.sshKeys(a.KeyAttributes)) == 0 {
+			continue
+		}
+
+		roles, err := a.userRoles(ctx, token, user.Id)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+
+		ret[user.Username] = roles
+	}
+
+	return ret, nil
+}
+
+// userRoles returns the effective realm roles of the user listed in Roles,
+// including roles granted to groups and through composite roles.
+func (a *KeyCloakAdapter) userRoles(ctx context.Context, token, id string) ([]string, error) {
+	var roles []keycloakRole
+
+	res, err := a.request(ctx, token).
+		SetResult(&roles).
+		Get(a.adminUrl(ServerUserRolesUrl, a.Realm, id))
+	if err != nil {
+		return nil, fmt.Errorf("fetch user roles: %w", err)
+	}
+	if res.IsError() {
+		return nil, a.statusError("fetch user roles", res)
+	}
+
+	return lo.FilterMap(roles, func(item keycloakRole, _ int) (string, bool) {
+		return item.Name, lo.Contains(a.Roles, "*") || lo.Contains(a.Roles, item.Name)
 	}), nil
 }
+
+// VerifyToken implements domain.TokenVerifier by asking the userinfo
+// endpoint of the realm, which rejects expired and foreign tokens.
+func (a *KeyCloakAdapter) VerifyToken(ctx context.Context, token string) (string, error) {
+	var userInfo struct {
+		PreferredUsername string `json:"preferred_username"`
+	}
+
+	oidc, err := a.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := a.request(ctx, token).
+		SetResult(&userInfo).
+		Get(oidc.UserinfoEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("userinfo: %w", err)
+	}
+	if res.IsError() {
+		return "", fmt.Errorf("userinfo: code: %d", res.StatusCode())
+	}
+
+	if userInfo.PreferredUsername == "" {
+		return "", fmt.Errorf("userinfo: token without username")
+	}
+
+	return userInfo.PreferredUsername, nil
+}
+
+// fetchPages requests every page of an admin API listing. The brief
+// representation is requested when brief is not empty.
+func fetchPages[T any](ctx context.Context, a *KeyCloakAdapter, token, op, path, brief string) ([]T, error) {
+	var ret []T
+
+	for first := 0; ; first += a.PageSize {
+		var page []T
+
+		req := a.request(ctx, token).
+			SetQueryParam("first", strconv.Itoa(first)).
+			SetQueryParam("max", strconv.Itoa(a.PageSize)).
+			SetResult(&page)
+
+		if brief != "" {
+			req.SetQueryParam("briefRepresentation", brief)
+		}
+
+		res, err := req.Get(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if res.IsError() {
+			return nil, a.statusError(op, res)
+		}
+
+		ret = append(ret, page...)
+
+		if len(page) < a.PageSize {
+			return ret, nil
+		}
+	}
+}
+
+// request prepares an authorized admin API request.
+func (a *KeyCloakAdapter) request(ctx context.Context, token string) *resty.Request {
+	return a.resty.R().
+		EnableTrace().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", fmt.Sprintf("bearer %s", token))
+}
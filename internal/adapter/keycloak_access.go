@@ -0,0 +1,144 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+type keycloakClient struct {
+	Id       string `json:"id"`
+	ClientId string `json:"clientId"`
+}
+
+// restricted reports whether only members of required groups or holders of
+// required roles are returned.
+func (a *KeyCloakAdapter) restricted() bool {
+	return len(a.RequiredGroups) > 0 || len(a.RequiredRealmRoles) > 0 || len(a.RequiredClientRoles) > 0
+}
+
+// inGroups reports whether any of the groups is one of the paths or one of
+// their subgroups.
+func inGroups(groups []keycloakGroup, paths []string) bool {
+	return lo.SomeBy(groups, func(group keycloakGroup) bool {
+		return lo.SomeBy(paths, func(path string) bool {
+			path = strings.TrimSuffix(path, "/")
+			return group.Path == path || strings.HasPrefix(group.Path, path+"/")
+		})
+	})
+}
+
+// fetchAuthorized returns the users holding a required group or role. Each
+// user is checked by userAuthorized, so that a full sync resolves roles as
+// FetchUser does, including roles granted through groups and composite
+// roles. Users without keys are never synced and not checked.
+func (a *KeyCloakAdapter) fetchAuthorized(ctx context.Context, token string, users []keycloakUser, memberships map[string][]keycloakGroup) (map[string]bool, error) {
+	clients, err := a.requiredClients(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]bool{}
+
+	for _, user := range users {
+		if len(user.sshKeys(a.KeyAttributes)) == 0 {
+			continue
+		}
+
+		authorized, err := a.userAuthorized(ctx, token, user.Id, memberships[user.Username], clients)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+
+		ret[user.Username] = authorized
+	}
+
+	return ret, nil
+}
+
+// userAuthorized checks a single user against the required groups and the
+// effective realm and client roles of the user. clients holds the required
+// clients resolved by requiredClients.
+func (a *KeyCloakAdapter) userAuthorized(ctx context.Context, token, userId string, groups []keycloakGroup, clients map[string]keycloakClient) (bool, error) {
+	if inGroups(groups, a.RequiredGroups) {
+		return true, nil
+	}
+
+	hasRole := func(op, rolesUrl string, required []string) (bool, error) {
+		var roles []keycloakRole
+
+		res, err := a.request(ctx, token).
+			SetResult(&roles).
+			Get(rolesUrl)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+		if res.IsError() {
+			return false, a.statusError(op, res)
+		}
+
+		return lo.SomeBy(roles, func(role keycloakRole) bool {
+			return lo.Contains(required, role.Name)
+		}), nil
+	}
+
+	if len(a.RequiredRealmRoles) > 0 {
+		has, err := hasRole("user realm roles", a.adminUrl(ServerUserRolesUrl, a.Realm, userId), a.RequiredRealmRoles)
+		if err != nil || has {
+			return has, err
+		}
+	}
+
+	for clientId, roles := range a.RequiredClientRoles {
+		has, err := hasRole("user client roles", a.adminUrl(ServerUserClientRolesUrl, a.Realm, userId, clients[clientId].Id), roles)
+		if err != nil || has {
+			return has, err
+		}
+	}
+
+	return false, nil
+}
+
+// requiredClients resolves the clients of the required client roles, keyed
+// by client id.
+func (a *KeyCloakAdapter) requiredClients(ctx context.Context, token string) (map[string]keycloakClient, error) {
+	ret := map[string]keycloakClient{}
+
+	for clientId := range a.RequiredClientRoles {
+		client, err := a.fetchClient(ctx, token, clientId)
+		if err != nil {
+			return nil, err
+		}
+
+		ret[clientId] = client
+	}
+
+	return ret, nil
+}
+
+// fetchClient resolves a client id to the client representation.
+func (a *KeyCloakAdapter) fetchClient(ctx context.Context, token, clientId string) (keycloakClient, error) {
+	var clients []keycloakClient
+
+	res, err := a.request(ctx, token).
+		SetQueryParam("clientId", clientId).
+		SetResult(&clients).
+		Get(a.adminUrl(ServerClientsUrl, a.Realm))
+	if err != nil {
+		return keycloakClient{}, fmt.Errorf("client %s: %w", clientId, err)
+	}
+	if res.IsError() {
+		return keycloakClient{}, a.statusError(fmt.Sprintf("client %s", clientId), res)
+	}
+
+	client, found := lo.Find(clients, func(item keycloakClient) bool {
+		return item.ClientId == clientId
+	})
+	if !found {
+		return keycloakClient{}, fmt.Errorf("client %s not found", clientId)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,100 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const ServerDiscoveryUrl = "/realms/%s/.well-known/openid-configuration"
+
+// LegacyContextPath is the context path of Keycloak before version 17.
+const LegacyContextPath = "/auth"
+
+// oidcConfiguration holds the used part of the OpenID provider metadata.
+type oidcConfiguration struct {
+	Issuer           string `json:"issuer"`
+	TokenEndpoint    string `json:"token_endpoint"`
+	UserinfoEndpoint string `json:"userinfo_endpoint"`
+}
+
+// endpoints keeps the discovered context path and OIDC endpoints.
+type endpoints struct {
+	mu          sync.Mutex
+	discovered  bool
+	contextPath string
+	oidc        oidcConfiguration
+}
+
+// NormalizeContextPath returns the context path with a leading and without
+// a trailing slash, "/" stands for the root context and becomes empty.
+func NormalizeContextPath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+
+	return "/" + path
+}
+
+// discover fetches the OIDC metadata of the realm once. Without a
+// configured context path the root and the legacy /auth context are tried.
+func (a *KeyCloakAdapter) discover(ctx context.Context) (oidcConfiguration, error) {
+	a.endpoints.mu.Lock()
+	defer a.endpoints.mu.Unlock()
+
+	if a.endpoints.discovered {
+		return a.endpoints.oidc, nil
+	}
+
+	candidates := []string{"", LegacyContextPath}
+	if a.ContextPath != "" {
+		candidates = []string{NormalizeContextPath(a.ContextPath)}
+	}
+
+	for _, contextPath := range candidates {
+		var ret oidcConfiguration
+
+		res, err := a.resty.R().
+			SetContext(ctx).
+			SetResult(&ret).
+			Get(contextPath + fmt.Sprintf(ServerDiscoveryUrl, a.Realm))
+		if err != nil {
+			return ret, fmt.Errorf("oidc discovery: %w", err)
+		}
+
+		if res.StatusCode() == http.StatusNotFound {
+			continue
+		}
+
+		if res.IsError() {
+			return ret, fmt.Errorf("oidc discovery (%s): code: %d", res.Request.URL, res.StatusCode())
+		}
+
+		if ret.TokenEndpoint == "" {
+			return ret, fmt.Errorf("oidc discovery (%s): no token endpoint", res.Request.URL)
+		}
+
+		log.Debug().Str("context_path", contextPath).Str("issuer", ret.Issuer).Msg("keycloak discovered")
+
+		a.endpoints.discovered = true
+		a.endpoints.contextPath = contextPath
+		a.endpoints.oidc = ret
+
+		return ret, nil
+	}
+
+	return oidcConfiguration{}, fmt.Errorf("oidc discovery: realm %s not found below %v", a.Realm, candidates)
+}
+
+// adminUrl formats an admin API path below the discovered context path.
+func (a *KeyCloakAdapter) adminUrl(format string, args ...any) string {
+	a.endpoints.mu.Lock()
+	defer a.endpoints.mu.Unlock()
+
+	return a.endpoints.contextPath + fmt.Sprintf(format, args...)
+}
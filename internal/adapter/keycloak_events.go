@@ -0,0 +1,174 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+const ServerAdminEventsUrl = "/admin/realms/%s/admin-events"
+
+// trackedResources are the admin event resource types changing the synced
+// state of a user. Changes to groups and roles themselves, e.g. renaming a
+// group, are picked up by the next full sync.
+var trackedResources = []string{"USER", "GROUP_MEMBERSHIP", "REALM_ROLE_MAPPING", "CLIENT_ROLE_MAPPING"}
+
+type keycloakAdminEvent struct {
+	// Time is the event time in epoch milliseconds
+	Time          int64  `json:"time"`
+	OperationType string `json:"operationType"`
+	ResourceType  string `json:"resourceType"`
+	ResourcePath  string `json:"resourcePath"`
+}
+
+// userId returns the id of the user the event belongs to, resource paths
+// look like "users/<id>" or "users/<id>/groups/<group id>".
+func (e keycloakAdminEvent) userId() (string, bool) {
+	parts := strings.Split(e.ResourcePath, "/")
+	if len(parts) < 2 || parts[0] != "users" || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// ChangeCursor implements domain.ChangeTracker. The cursor is the time of
+// the latest admin event in epoch milliseconds as seen by Keycloak, so the
+// clocks of the daemon and Keycloak need not agree.
+func (a *KeyCloakAdapter) ChangeCursor(ctx context.Context) (string, error) {
+	token, err := a.auth(ctx)
+	if err != nil {
+		return "", fmt.Errorf("authentication: %w", err)
+	}
+
+	var events []keycloakAdminEvent
+
+	res, err := a.request(ctx, token).
+		SetQueryParam("max", "1").
+		SetResult(&events).
+		Get(a.adminUrl(ServerAdminEventsUrl, a.Realm))
+	if err != nil {
+		return "", fmt.Errorf("admin events: %w", err)
+	}
+	if res.IsError() {
+		return "", a.statusError("admin events", res)
+	}
+
+	if len(events) == 0 {
+		return "0", nil
+	}
+
+	return strconv.FormatInt(events[0].Time, 10), nil
+}
+
+// FetchChanges implements domain.ChangeTracker. Admin events must be
+// enabled in the realm, the user needs the view-events role.
+func (a *KeyCloakAdapter) FetchChanges(ctx context.Context, cursor string) (domain.Changes, error) {
+	since, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return domain.Changes{}, fmt.Errorf("malformed change cursor %q: %w", cursor, err)
+	}
+
+	token, err := a.auth(ctx)
+	if err != nil {
+		return domain.Changes{}, fmt.Errorf("authentication: %w", err)
+	}
+
+	events, err := a.fetchEvents(ctx, token, since)
+	if err != nil {
+		return domain.Changes{}, err
+	}
+
+	ret := domain.Changes{Cursor: cursor}
+
+	if len(events) > 0 {
+		ret.Cursor = strconv.FormatInt(events[0].Time, 10)
+	}
+
+	var (
+		changed []string
+		removed []string
+	)
+
+	// events are returned newest first
+	for _, event := range events {
+		id, ok := event.userId()
+		if !ok {
+			continue
+		}
+
+		if lo.Contains(changed, id) || lo.Contains(removed, id) {
+			continue
+		}
+
+		if event.ResourceType == "USER" && event.OperationType == "DELETE" {
+			removed = append(removed, id)
+		} else {
+			changed = append(changed, id)
+		}
+	}
+
+	for _, id := range changed {
+		user, err := a.fetchUserById(ctx, token, id)
+		if errors.Is(err, domain.ErrNotFound) {
+			removed = append(removed, id)
+			continue
+		}
+		if err != nil {
+			return domain.Changes{}, err
+		}
+
+		ret.Users = append(ret.Users, user)
+	}
+
+	ret.Removed = removed
+
+	return ret, nil
+}
+
+// fetchEvents returns the tracked admin events since the given time, newest
+// first. Events of the cursor millisecond are returned again as further
+// events may have been stored in the same millisecond.
+func (a *KeyCloakAdapter) fetchEvents(ctx context.Context, token string, since int64) ([]keycloakAdminEvent, error) {
+	// dateFrom only takes a day, in the time zone of the server
+	dateFrom := time.UnixMilli(since).Add(-24 * time.Hour).Format(time.DateOnly)
+
+	var ret []keycloakAdminEvent
+
+	for first := 0; ; first += a.PageSize {
+		var page []keycloakAdminEvent
+
+		res, err := a.request(ctx, token).
+			SetQueryParam("dateFrom", dateFrom).
+			SetQueryParamsFromValues(map[string][]string{"resourceTypes": trackedResources}).
+			SetQueryParam("first", strconv.Itoa(first)).
+			SetQueryParam("max", strconv.Itoa(a.PageSize)).
+			SetResult(&page).
+			Get(a.adminUrl(ServerAdminEventsUrl, a.Realm))
+		if err != nil {
+			return nil, fmt.Errorf("admin events: %w", err)
+		}
+		if res.IsError() {
+			return nil, a.statusError("admin events", res)
+		}
+
+		for _, event := range page {
+			if event.Time < since {
+				return ret, nil
+			}
+
+			ret = append(ret, event)
+		}
+
+		if len(page) < a.PageSize {
+			return ret, nil
+		}
+	}
+}
@@ -2,6 +2,7 @@ package adapter_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
@@ -10,6 +11,7 @@ import (
 	"github.com/docker/go-connections/nat"
 	"github.com/h2hsecure/sshkeyman/internal/adapter"
 	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/samber/lo"
 	keycloak "github.com/stillya/testcontainers-keycloak"
 	"github.com/testcontainers/testcontainers-go"
 
@@ -94,3 +96,133 @@ func Test_keycloak_users(t *testing.T) {
 	Expect(err).To(BeNil())
 	Expect(user).NotTo(Equal(0))
 }
+
+func Test_keycloak_users_paging(t *testing.T) {
+	RegisterTestingT(t)
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:   fmt.Sprintf("http://localhost:%d", keycloakPort),
+			ClientId: "admin-cli",
+			Realm:    "test-realm",
+			Username: "test-api-user",
+			Password: "password",
+			PageSize: 1,
+		},
+	})
+	ctx := context.Background()
+	users, err := k.FetchUsers(ctx)
+	Expect(err).To(BeNil())
+	Expect(lo.Map(users, func(item domain.UserDetail, _ int) string {
+		return item.Username
+	})).To(ContainElements("test-api-user", "test-ssh-user", "test-multi-key-user"))
+
+	multiKeyUser, _ := lo.Find(users, func(item domain.UserDetail) bool {
+		return item.Username == "test-multi-key-user"
+	})
+	Expect(multiKeyUser.SshPublicKeys).To(HaveLen(2))
+}
+
+func Test_keycloak_user_multiple_keys(t *testing.T) {
+	RegisterTestingT(t)
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:   fmt.Sprintf("http://localhost:%d", keycloakPort),
+			ClientId: "admin-cli",
+			Realm:    "test-realm",
+			Username: "test-api-user",
+			Password: "password",
+		},
+	})
+	ctx := context.Background()
+	user, err := k.FetchUser(ctx, "test-multi-key-user")
+	Expect(err).To(BeNil())
+	Expect(user.SshPublicKeys).To(HaveLen(2))
+}
+
+func Test_keycloak_user_roles(t *testing.T) {
+	RegisterTestingT(t)
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:   fmt.Sprintf("http://localhost:%d", keycloakPort),
+			ClientId: "admin-cli",
+			Realm:    "test-realm",
+			Username: "test-api-user",
+			Password: "password",
+		},
+		Principals: domain.PrincipalsConfig{Roles: []string{"*"}},
+	})
+	ctx := context.Background()
+	user, err := k.FetchUser(ctx, "test-multi-key-user")
+	Expect(err).To(BeNil())
+	Expect(user.Roles).To(ContainElement("ops"))
+}
+
+func Test_keycloak_required_groups(t *testing.T) {
+	RegisterTestingT(t)
+	for _, cfg := range []domain.KeycloakConfig{
+		{RequiredGroups: []string{"/ops"}},
+		{RequiredRealmRoles: []string{"ops"}},
+	} {
+		cfg.Server = fmt.Sprintf("http://localhost:%d", keycloakPort)
+		cfg.ClientId = "admin-cli"
+		cfg.Realm = "test-realm"
+		cfg.Username = "test-api-user"
+		cfg.Password = "password"
+
+		k := adapter.NewKeyCloakAdapter(&domain.Config{Keycloak: cfg})
+		ctx := context.Background()
+
+		users, err := k.FetchUsers(ctx)
+		Expect(err).To(BeNil())
+		Expect(lo.Map(users, func(item domain.UserDetail, _ int) string {
+			return item.Username
+		})).To(ConsistOf("test-multi-key-user"))
+		// subgroups are named after their path
+		Expect(users[0].Groups).To(Equal([]string{"ops-linux"}))
+
+		user, err := k.FetchUser(ctx, "test-multi-key-user")
+		Expect(err).To(BeNil())
+		Expect(user.Groups).To(Equal([]string{"ops-linux"}))
+
+		_, err = k.FetchUser(ctx, "test-ssh-user")
+		Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+	}
+}
+
+func Test_keycloak_user_key_expiry(t *testing.T) {
+	RegisterTestingT(t)
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:             fmt.Sprintf("http://localhost:%d", keycloakPort),
+			ClientId:           "admin-cli",
+			Realm:              "test-realm",
+			Username:           "test-api-user",
+			Password:           "password",
+			KeyExpiryAttribute: "ssh-key-expires",
+		},
+	})
+	ctx := context.Background()
+	user, err := k.FetchUser(ctx, "test-multi-key-user")
+	Expect(err).To(BeNil())
+	Expect(user.SshKeyNotAfter).To(HaveLen(2))
+	// a single value applies to every key
+	Expect(user.SshKeyNotAfter).To(HaveEach(time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)))
+}
+
+func Test_keycloak_disabled_user(t *testing.T) {
+	RegisterTestingT(t)
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:   fmt.Sprintf("http://localhost:%d", keycloakPort),
+			ClientId: "admin-cli",
+			Realm:    "test-realm",
+			Username: "test-api-user",
+			Password: "password",
+		},
+	})
+	ctx := context.Background()
+	user, err := k.FetchUser(ctx, "test-disabled-user")
+	Expect(err).To(BeNil())
+	Expect(user.Disabled).To(BeTrue())
+	Expect(user.SshPublicKeys).To(HaveLen(1))
+}
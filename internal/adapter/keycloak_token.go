@@ -0,0 +1,278 @@
+package adapter
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+const (
+	GrantPassword          = "password"
+	GrantClientCredentials = "client_credentials"
+
+	// tokenRefreshMargin renews cached tokens shortly before they expire.
+	tokenRefreshMargin = 30 * time.Second
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// tokenCache keeps the admin API token between requests.
+type tokenCache struct {
+	mu               sync.Mutex
+	accessToken      string
+	expiresAt        time.Time
+	refreshToken     string
+	refreshExpiresAt time.Time
+}
+
+func (c *tokenCache) store(token domain.TokenDetail, now time.Time) {
+	c.accessToken = token.AuthToken
+	c.expiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	c.refreshToken = token.RefreshToken
+	c.refreshExpiresAt = now.Add(time.Duration(token.RefreshExpiresIn) * time.Second)
+}
+
+func (c *tokenCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	*c = tokenCache{}
+}
+
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// auth returns an admin API access token. Tokens are reused until shortly
+// before they expire and renewed with the refresh token when possible.
+func (a *KeyCloakAdapter) auth(ctx context.Context) (string, error) {
+	a.tokens.mu.Lock()
+	defer a.tokens.mu.Unlock()
+
+	now := time.Now()
+
+	if a.tokens.accessToken != "" && now.Add(tokenRefreshMargin).Before(a.tokens.expiresAt) {
+		return a.tokens.accessToken, nil
+	}
+
+	if a.tokens.refreshToken != "" && now.Add(tokenRefreshMargin).Before(a.tokens.refreshExpiresAt) {
+		token, err := a.token(ctx, map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": a.tokens.refreshToken,
+		})
+		if err == nil {
+			a.tokens.store(token, now)
+			return token.AuthToken, nil
+		}
+
+		log.Warn().Err(err).Msg("refreshing token, authenticating again")
+	}
+
+	formData := map[string]string{
+		"grant_type": a.GrantType,
+	}
+
+	if a.GrantType == GrantPassword {
+		formData["username"] = a.AccessUser
+		formData["password"] = a.AccessPassword
+	}
+
+	token, err := a.token(ctx, formData)
+	if err != nil {
+		return "", err
+	}
+
+	a.tokens.store(token, now)
+
+	return token.AuthToken, nil
+}
+
+// token calls the token endpoint with the given grant and the configured
+// client authentication.
+func (a *KeyCloakAdapter) token(ctx context.Context, formData map[string]string) (domain.TokenDetail, error) {
+	var (
+		ret    domain.TokenDetail
+		errRet tokenError
+	)
+
+	oidc, err := a.discover(ctx)
+	if err != nil {
+		return ret, err
+	}
+
+	formData["client_id"] = a.ClientId
+
+	if a.ClientSecret != "" {
+		formData["client_secret"] = a.ClientSecret
+	}
+
+	if a.ClientAssertionKey != "" {
+		assertion, err := a.clientAssertion(oidc.Issuer)
+		if err != nil {
+			return ret, fmt.Errorf("client assertion: %w", err)
+		}
+
+		formData["client_assertion_type"] = clientAssertionType
+		formData["client_assertion"] = assertion
+	}
+
+	postUrl := oidc.TokenEndpoint
+
+	res, err := a.resty.R().
+		EnableTrace().
+		SetContext(ctx).
+		SetFormData(formData).
+		SetResult(&ret).
+		SetError(&errRet).
+		Post(postUrl)
+	if err != nil {
+		return ret, fmt.Errorf("auth request: %w", err)
+	}
+	if res.IsError() {
+		return ret, fmt.Errorf("auth request (%s, %s grant): %s %s code: %d",
+			postUrl, formData["grant_type"], errRet.Error, errRet.Description, res.StatusCode())
+	}
+
+	return ret, nil
+}
+
+// clientAssertion builds the signed JWT used for the private_key_jwt client
+// authentication, RS256 for RSA keys and ES256 for P-256 keys. The realm
+// issuer is the audience.
+func (a *KeyCloakAdapter) clientAssertion(audience string) (string, error) {
+	signer, err := readPrivateKey(a.ClientAssertionKey)
+	if err != nil {
+		return "", err
+	}
+
+	var alg string
+
+	switch key := signer.Public().(type) {
+	case *rsa.PublicKey:
+		alg = "RS256"
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", fmt.Errorf("only P-256 ecdsa keys are supported")
+		}
+
+		alg = "ES256"
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("jti: %w", err)
+	}
+
+	now := time.Now()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss": a.ClientId,
+		"sub": a.ClientId,
+		"aud": audience,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(),
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+
+	if alg == "ES256" {
+		// JWS uses the fixed size r || s encoding instead of ASN.1
+		if signature, err = ecdsaRawSignature(signature); err != nil {
+			return "", err
+		}
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// readPrivateKey reads a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key.
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("read key: no PEM data in %s", path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("read key: unsupported private key in %s", path)
+}
+
+// ecdsaRawSignature converts an ASN.1 P-256 signature to r || s.
+func ecdsaRawSignature(der []byte) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	ret := make([]byte, 64)
+	sig.R.FillBytes(ret[:32])
+	sig.S.FillBytes(ret[32:])
+
+	return ret, nil
+}
+
+// statusError describes a failed admin API response. Rejected tokens are
+// dropped from the cache and missing permissions are reported explicitly.
+func (a *KeyCloakAdapter) statusError(op string, res *resty.Response) error {
+	switch res.StatusCode() {
+	case http.StatusUnauthorized:
+		a.tokens.reset()
+	case http.StatusForbidden:
+		return fmt.Errorf("%s: %w: the account of client %s needs the view-users role of the realm-management client",
+			op, domain.ErrForbidden, a.ClientId)
+	}
+
+	return fmt.Errorf("%s: %v code: %d", op, res.Error(), res.StatusCode())
+}
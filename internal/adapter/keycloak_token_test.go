@@ -0,0 +1,490 @@
+package adapter_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/samber/lo"
+
+	. "github.com/onsi/gomega"
+)
+
+// fakeGroup is a top level group of the fake realm with the usernames of
+// its members.
+type fakeGroup struct {
+	id, path string
+	members  []string
+}
+
+// fakeKeycloak serves the discovery document, the token endpoint and a
+// realm holding users, groups and admin events, newest first, below
+// contextPath. Every issued token is valid for expiresIn seconds.
+type fakeKeycloak struct {
+	contextPath string
+	users       []map[string]any
+	groups      []fakeGroup
+	events      []map[string]any
+	expiresIn   int
+	forbidden   bool
+	grants      []string
+	tokens      atomic.Int32
+	verify      func(r *http.Request)
+}
+
+func (f *fakeKeycloak) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !strings.HasPrefix(r.URL.Path, f.contextPath+"/realms/") && !strings.HasPrefix(r.URL.Path, f.contextPath+"/admin/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration") {
+		issuer := "http://" + r.Host + strings.TrimSuffix(r.URL.Path, "/.well-known/openid-configuration")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":            issuer,
+			"token_endpoint":    issuer + "/protocol/openid-connect/token",
+			"userinfo_endpoint": issuer + "/protocol/openid-connect/userinfo",
+		})
+
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/token") {
+		_ = r.ParseForm()
+		f.grants = append(f.grants, r.PostForm.Get("grant_type"))
+
+		if f.verify != nil {
+			f.verify(r)
+		}
+
+		n := f.tokens.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":       fmt.Sprintf("token-%d", n),
+			"expires_in":         f.expiresIn,
+			"refresh_token":      fmt.Sprintf("refresh-%d", n),
+			"refresh_expires_in": 1800,
+		})
+
+		return
+	}
+
+	if f.forbidden {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":"HTTP 403 Forbidden"}`))
+
+		return
+	}
+
+	_, userPath, _ := strings.Cut(r.URL.Path, "/users/")
+	_, groupPath, _ := strings.Cut(r.URL.Path, "/groups/")
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/groups") && userPath != "":
+		user, _ := lo.Find(f.users, func(item map[string]any) bool {
+			return item["id"] == strings.TrimSuffix(userPath, "/groups")
+		})
+
+		_ = json.NewEncoder(w).Encode(lo.FilterMap(f.groups, func(item fakeGroup, _ int) (map[string]any, bool) {
+			return item.representation(), lo.Contains(item.members, user["username"].(string))
+		}))
+	case strings.HasSuffix(r.URL.Path, "/groups"):
+		_ = json.NewEncoder(w).Encode(lo.Map(f.groups, func(item fakeGroup, _ int) map[string]any {
+			return item.representation()
+		}))
+	case strings.HasSuffix(r.URL.Path, "/members") && r.URL.Query().Get("first") == "0":
+		group, _ := lo.Find(f.groups, func(item fakeGroup) bool {
+			return item.id == strings.TrimSuffix(groupPath, "/members")
+		})
+
+		_ = json.NewEncoder(w).Encode(lo.Filter(f.users, func(item map[string]any, _ int) bool {
+			return lo.Contains(group.members, item["username"].(string))
+		}))
+	case strings.HasSuffix(r.URL.Path, "/users") && r.URL.Query().Has("username"):
+		_ = json.NewEncoder(w).Encode(lo.Filter(f.users, func(item map[string]any, _ int) bool {
+			return item["username"] == r.URL.Query().Get("username")
+		}))
+	case strings.HasSuffix(r.URL.Path, "/admin-events"):
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		last, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		last = min(first+last, len(f.events))
+		_ = json.NewEncoder(w).Encode(f.events[min(first, last):last])
+	case userPath != "" && !strings.Contains(userPath, "/") && userPath != "count":
+		user, found := lo.Find(f.users, func(item map[string]any) bool {
+			return item["id"] == userPath
+		})
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(user)
+	case strings.HasSuffix(r.URL.Path, "/users/count"):
+		_, _ = fmt.Fprint(w, len(f.users))
+	case strings.HasSuffix(r.URL.Path, "/users") && r.URL.Query().Get("first") == "0":
+		_ = json.NewEncoder(w).Encode(f.users)
+	default:
+		_, _ = w.Write([]byte("[]"))
+	}
+}
+
+func TestKeycloakTokenCache(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := &fakeKeycloak{expiresIn: 300}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := &domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:       server.URL,
+			ClientId:     "sshkeyman",
+			ClientSecret: "secret",
+			Realm:        "test-realm",
+		},
+	}
+
+	k := adapter.NewKeyCloakAdapter(cfg)
+
+	for range 3 {
+		_, err := k.FetchUsers(context.Background())
+		Expect(err).To(BeNil())
+	}
+
+	Expect(fake.grants).To(Equal([]string{"client_credentials"}))
+
+	// tokens expiring within the refresh margin are renewed
+	fake.expiresIn = 10
+	fake.grants = nil
+	k = adapter.NewKeyCloakAdapter(cfg)
+
+	for range 3 {
+		_, err := k.FetchUsers(context.Background())
+		Expect(err).To(BeNil())
+	}
+
+	Expect(fake.grants).To(Equal([]string{"client_credentials", "refresh_token", "refresh_token"}))
+}
+
+func TestKeycloakForbidden(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := httptest.NewServer(&fakeKeycloak{expiresIn: 300, forbidden: true})
+	defer server.Close()
+
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:       server.URL,
+			ClientId:     "sshkeyman",
+			ClientSecret: "secret",
+			Realm:        "test-realm",
+		},
+	})
+
+	_, err := k.FetchUsers(context.Background())
+	Expect(errors.Is(err, domain.ErrForbidden)).To(BeTrue())
+	Expect(err.Error()).To(ContainSubstring("view-users"))
+}
+
+func TestKeycloakClientAssertion(t *testing.T) {
+	RegisterTestingT(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).To(BeNil())
+
+	keyPath := filepath.Join(t.TempDir(), "client.pem")
+	Expect(os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)).To(Succeed())
+
+	var claims map[string]any
+
+	fake := &fakeKeycloak{expiresIn: 300}
+	fake.verify = func(r *http.Request) {
+		Expect(r.PostForm.Get("client_assertion_type")).To(Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer"))
+
+		parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+		Expect(parts).To(HaveLen(3))
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		Expect(err).To(BeNil())
+		Expect(signature).To(HaveLen(64))
+
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		Expect(ecdsa.Verify(&key.PublicKey, digest[:],
+			new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))).To(BeTrue())
+
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		Expect(err).To(BeNil())
+		Expect(json.Unmarshal(payload, &claims)).To(Succeed())
+	}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:             server.URL,
+			ClientId:           "sshkeyman",
+			ClientAssertionKey: keyPath,
+			Realm:              "test-realm",
+		},
+	})
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(claims).To(HaveKeyWithValue("sub", "sshkeyman"))
+	Expect(claims).To(HaveKeyWithValue("aud", server.URL+"/realms/test-realm"))
+}
+
+func TestKeycloakUserState(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := &fakeKeycloak{
+		expiresIn: 300,
+		users: []map[string]any{
+			{"id": "1", "username": "enabled", "enabled": true},
+			{"id": "2", "username": "disabled", "enabled": false},
+			{"id": "3", "username": "pending", "enabled": true, "requiredActions": []string{"TERMS_AND_CONDITIONS"}},
+			{"id": "4", "username": "password", "enabled": true, "requiredActions": []string{"UPDATE_PASSWORD"}},
+			{"id": "5", "username": "signed-out", "enabled": true, "notBefore": 1700000000},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:              server.URL,
+			ClientId:            "sshkeyman",
+			ClientSecret:        "secret",
+			Realm:               "test-realm",
+			LockRequiredActions: []string{"TERMS_AND_CONDITIONS"},
+		},
+	})
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+
+	state := map[string]domain.UserDetail{}
+	for _, user := range users {
+		state[user.Username] = user
+	}
+
+	Expect(state).To(HaveLen(5))
+	Expect(state["enabled"].Disabled).To(BeFalse())
+	Expect(state["disabled"].Disabled).To(BeTrue())
+	Expect(state["pending"].Disabled).To(BeTrue())
+	Expect(state["password"].Disabled).To(BeFalse())
+	Expect(state["enabled"].RevokedBefore.IsZero()).To(BeTrue())
+	Expect(state["signed-out"].RevokedBefore.Unix()).To(Equal(int64(1700000000)))
+}
+
+func (g fakeGroup) representation() map[string]any {
+	return map[string]any{"id": g.id, "name": strings.TrimPrefix(g.path, "/"), "path": g.path}
+}
+
+func TestKeycloakGroupNames(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := &fakeKeycloak{
+		expiresIn: 300,
+		users: []map[string]any{
+			{"id": "1", "username": "alice", "enabled": true, "attributes": map[string][]string{"ssh-key": {execKey}}},
+		},
+		groups: []fakeGroup{
+			{id: "g1", path: "/ops", members: []string{"alice"}},
+			{id: "g2", path: "/Linux Admins", members: []string{"alice"}},
+			{id: "g3", path: "/dev:all", members: []string{"alice"}},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:       server.URL,
+			ClientId:     "sshkeyman",
+			ClientSecret: "secret",
+			Realm:        "test-realm",
+		},
+	})
+
+	// groups which can not be served through NSS are skipped
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(1))
+	Expect(users[0].Groups).To(Equal([]string{"ops"}))
+
+	user, err := k.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+	Expect(user.Groups).To(Equal([]string{"ops"}))
+}
+
+func TestKeycloakAttributeMapping(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := &fakeKeycloak{
+		expiresIn: 300,
+		users: []map[string]any{
+			{
+				"id": "1", "username": "alice", "enabled": true,
+				"attributes": map[string][]string{
+					"sshPublicKey":  {"ssh-ed25519 AAAA alice"},
+					"ssh-key":       {"ssh-ed25519 BBBB ignored"},
+					"uidNumber":     {"20001"},
+					"gidNumber":     {"not a number"},
+					"loginShell":    {"/bin/zsh"},
+					"homeDirectory": {"/srv/home/alice"},
+				},
+			},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:           server.URL,
+			ClientId:         "sshkeyman",
+			ClientSecret:     "secret",
+			Realm:            "test-realm",
+			SshKeyAttributes: []string{"sshPublicKey"},
+			Attributes: domain.AttributeMapping{
+				Uid:   "uidNumber",
+				Gid:   "gidNumber",
+				Shell: "loginShell",
+				Home:  "homeDirectory",
+			},
+		},
+	})
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(1))
+
+	Expect(users[0].SshPublicKeys).To(Equal([]string{"ssh-ed25519 AAAA alice"}))
+	Expect(users[0].UID).To(Equal(uint(20001)))
+	Expect(users[0].GID).To(BeZero())
+	Expect(users[0].Shell).To(Equal("/bin/zsh"))
+	Expect(users[0].Home).To(Equal("/srv/home/alice"))
+}
+
+func TestKeycloakContextPath(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, tc := range []struct {
+		served     string
+		configured string
+		discovered bool
+	}{
+		{served: "", configured: "", discovered: true},
+		{served: "/auth", configured: "", discovered: true},
+		{served: "/auth", configured: "auth/", discovered: true},
+		{served: "/keycloak", configured: "/keycloak", discovered: true},
+		{served: "/keycloak", configured: "", discovered: false},
+		{served: "/auth", configured: "/", discovered: false},
+	} {
+		fake := &fakeKeycloak{
+			contextPath: tc.served,
+			expiresIn:   300,
+			users:       []map[string]any{{"id": "1", "username": "alice", "enabled": true}},
+		}
+		server := httptest.NewServer(fake)
+
+		k := adapter.NewKeyCloakAdapter(&domain.Config{
+			Keycloak: domain.KeycloakConfig{
+				Server:       server.URL,
+				ContextPath:  tc.configured,
+				ClientId:     "sshkeyman",
+				ClientSecret: "secret",
+				Realm:        "test-realm",
+			},
+		})
+
+		users, err := k.FetchUsers(context.Background())
+		if tc.discovered {
+			Expect(err).To(BeNil(), "served below %q", tc.served)
+			Expect(users).To(HaveLen(1))
+			Expect(fake.grants).To(Equal([]string{"client_credentials"}))
+		} else {
+			Expect(err).To(MatchError(ContainSubstring("oidc discovery")), "served below %q", tc.served)
+		}
+
+		server.Close()
+	}
+}
+
+func TestKeycloakChanges(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := &fakeKeycloak{
+		expiresIn: 300,
+		users: []map[string]any{
+			{"id": "1", "username": "alice", "enabled": true},
+			{"id": "2", "username": "bob", "enabled": true},
+		},
+		events: []map[string]any{
+			{"time": 4000, "operationType": "CREATE", "resourceType": "GROUP_MEMBERSHIP", "resourcePath": "users/2/groups/g1"},
+			{"time": 3000, "operationType": "DELETE", "resourceType": "USER", "resourcePath": "users/3"},
+			{"time": 2500, "operationType": "UPDATE", "resourceType": "USER", "resourcePath": "users/1"},
+			{"time": 2000, "operationType": "UPDATE", "resourceType": "USER", "resourcePath": "users/4"},
+			{"time": 1000, "operationType": "UPDATE", "resourceType": "USER", "resourcePath": "users/5"},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	k := adapter.NewKeyCloakAdapter(&domain.Config{
+		Keycloak: domain.KeycloakConfig{
+			Server:       server.URL,
+			ClientId:     "sshkeyman",
+			ClientSecret: "secret",
+			Realm:        "test-realm",
+			PageSize:     2,
+		},
+	})
+
+	tracker, ok := k.(domain.ChangeTracker)
+	Expect(ok).To(BeTrue())
+
+	cursor, err := tracker.ChangeCursor(context.Background())
+	Expect(err).To(BeNil())
+	Expect(cursor).To(Equal("4000"))
+
+	changes, err := tracker.FetchChanges(context.Background(), "2000")
+	Expect(err).To(BeNil())
+	Expect(changes.Cursor).To(Equal("4000"))
+	Expect(lo.Map(changes.Users, func(item domain.UserDetail, _ int) string {
+		return item.Username
+	})).To(ConsistOf("alice", "bob"))
+	// user 3 was deleted, user 4 no longer exists
+	Expect(changes.Removed).To(ConsistOf("3", "4"))
+
+	changes, err = tracker.FetchChanges(context.Background(), "4000")
+	Expect(err).To(BeNil())
+	Expect(changes.Cursor).To(Equal("4000"))
+	Expect(changes.Users).To(HaveLen(1))
+	Expect(changes.Removed).To(BeEmpty())
+}
@@ -2,101 +2,563 @@ package adapter
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
+	"github.com/samber/lo"
 
 	"github.com/h2hsecure/sshkeyman/internal/domain"
 	"github.com/rs/zerolog/log"
 )
 
-// UserLogin struct represents the user credentials.
-type UserLogin struct {
-	Username string
-	Password string
+const (
+	LdapSchemaOpenLDAP = "openldap"
+	LdapSchemaFreeIPA  = "freeipa"
+	LdapSchemaAD       = "ad"
+
+	// DefaultLdapGroupFilter matches the group classes of all schemas.
+	DefaultLdapGroupFilter = "(|(objectClass=posixGroup)(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)(objectClass=group))"
+
+	DefaultLdapPageSize = 500
+	DefaultLdapTimeout  = 10 * time.Second
+
+	// adAccountDisable is the ACCOUNTDISABLE flag of userAccountControl.
+	adAccountDisable = 0x2
+)
+
+// ldapAttributeName matches attribute descriptions and OIDs (RFC 4512),
+// the username attribute is placed in filters unescaped.
+var ldapAttributeName = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*|[0-9]+(\.[0-9]+)*)(;[A-Za-z0-9-]+)*$`)
+
+// ldapSchema holds the default filter and attributes of a directory.
+type ldapSchema struct {
+	userFilter string
+	username   string
+	fullname   string
+	// id is a stable unique id of the entry, the DN is used when missing
+	id         string
+	attributes domain.AttributeMapping
+	// disabled reports accounts locked in the directory
+	disabled func(entry *ldap.Entry) bool
+	// disabledAttribute is requested for disabled
+	disabledAttribute string
+}
+
+var ldapSchemas = map[string]ldapSchema{
+	LdapSchemaOpenLDAP: {
+		userFilter: "(objectClass=posixAccount)",
+		username:   "uid",
+		fullname:   "gecos",
+		id:         "entryUUID",
+		attributes: domain.AttributeMapping{
+			SshKeys: []string{"sshPublicKey"},
+			Uid:     "uidNumber",
+			Gid:     "gidNumber",
+			Shell:   "loginShell",
+			Home:    "homeDirectory",
+		},
+		// set by the ppolicy overlay
+		disabledAttribute: "pwdAccountLockedTime",
+		disabled: func(entry *ldap.Entry) bool {
+			return entry.GetAttributeValue("pwdAccountLockedTime") != ""
+		},
+	},
+	LdapSchemaFreeIPA: {
+		userFilter: "(objectClass=posixAccount)",
+		username:   "uid",
+		fullname:   "gecos",
+		id:         "ipaUniqueID",
+		attributes: domain.AttributeMapping{
+			SshKeys: []string{"ipaSshPubKey"},
+			Uid:     "uidNumber",
+			Gid:     "gidNumber",
+			Shell:   "loginShell",
+			Home:    "homeDirectory",
+		},
+		disabledAttribute: "nsAccountLock",
+		disabled: func(entry *ldap.Entry) bool {
+			return strings.EqualFold(entry.GetAttributeValue("nsAccountLock"), "true")
+		},
+	},
+	LdapSchemaAD: {
+		userFilter: "(&(objectCategory=person)(objectClass=user))",
+		username:   "sAMAccountName",
+		fullname:   "displayName",
+		id:         "objectGUID",
+		attributes: domain.AttributeMapping{
+			SshKeys: []string{"sshPublicKey"},
+			Uid:     "uidNumber",
+			Gid:     "gidNumber",
+			Shell:   "loginShell",
+			Home:    "unixHomeDirectory",
+		},
+		disabledAttribute: "userAccountControl",
+		disabled: func(entry *ldap.Entry) bool {
+			flags, _ := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64)
+			return flags&adAccountDisable != 0
+		},
+	},
 }
 
-type LdapAdapter struct{}
+type LdapAdapter struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string
+	GroupBaseDN  string
+	GroupFilter  string
+
+	UsernameAttribute string
+	FullnameAttribute string
+	Attributes        domain.AttributeMapping
 
-func NewLdapAdapter(config *domain.Config) domain.Backend {
-	return &LdapAdapter{}
+	StartTLS bool
+	PageSize int
+	Timeout  time.Duration
+
+	schema    ldapSchema
+	tlsConfig *tls.Config
+
+	// mu guards conn, the connection is reused between requests
+	mu   sync.Mutex
+	conn *ldap.Conn
+}
+
+func NewLdapAdapter(config *domain.Config) (domain.Backend, error) {
+	cfg := config.Ldap
+
+	schema, has := ldapSchemas[strings.ToLower(cfg.Schema)]
+	if !has {
+		if cfg.Schema != "" {
+			log.Warn().Str("schema", cfg.Schema).Msg("unknown ldap schema, using openldap")
+		}
+
+		schema = ldapSchemas[LdapSchemaOpenLDAP]
+	}
+
+	attributes := cfg.Attributes
+	attributes.SshKeys = lo.Ternary(len(attributes.SshKeys) > 0, attributes.SshKeys, schema.attributes.SshKeys)
+	attributes.Uid = lo.CoalesceOrEmpty(attributes.Uid, schema.attributes.Uid)
+	attributes.Gid = lo.CoalesceOrEmpty(attributes.Gid, schema.attributes.Gid)
+	attributes.Shell = lo.CoalesceOrEmpty(attributes.Shell, schema.attributes.Shell)
+	attributes.Home = lo.CoalesceOrEmpty(attributes.Home, schema.attributes.Home)
+
+	a := &LdapAdapter{
+		URL:          cfg.URL,
+		BindDN:       cfg.BindDN,
+		BindPassword: cfg.BindPassword,
+		BaseDN:       cfg.BaseDN,
+		UserFilter:   lo.CoalesceOrEmpty(cfg.UserFilter, schema.userFilter),
+		GroupBaseDN:  lo.CoalesceOrEmpty(cfg.GroupBaseDN, cfg.BaseDN),
+		GroupFilter:  lo.CoalesceOrEmpty(cfg.GroupFilter, DefaultLdapGroupFilter),
+
+		UsernameAttribute: lo.CoalesceOrEmpty(cfg.UsernameAttribute, schema.username),
+		FullnameAttribute: lo.CoalesceOrEmpty(cfg.FullnameAttribute, schema.fullname),
+		Attributes:        attributes,
+
+		StartTLS: cfg.StartTLS,
+		PageSize: lo.Ternary(cfg.PageSize > 0, cfg.PageSize, DefaultLdapPageSize),
+		Timeout:  lo.Ternary(cfg.Timeout > 0, cfg.Timeout, DefaultLdapTimeout),
+
+		schema: schema,
+	}
+
+	// the filters are configured, but checking them here reports mistakes
+	// at startup instead of on every sync
+	for _, filter := range []string{a.UserFilter, a.GroupFilter} {
+		if _, err := ldap.CompileFilter(filter); err != nil {
+			return nil, fmt.Errorf("ldap filter %s: %w", filter, err)
+		}
+	}
+
+	if !ldapAttributeName.MatchString(a.UsernameAttribute) {
+		return nil, fmt.Errorf("ldap username attribute %q: invalid name", a.UsernameAttribute)
+	}
+
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap url: %w", err)
+	}
+
+	if a.StartTLS && u.Scheme != "ldap" {
+		return nil, fmt.Errorf("ldap start_tls needs an ldap:// url, got %s", u.Scheme)
+	}
+
+	a.tlsConfig, err = ldapTLSConfig(u.Hostname(), cfg.CACert, cfg.TLSSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
 }
 
 func (a *LdapAdapter) FetchUser(ctx context.Context, username string) (domain.UserDetail, error) {
-	conn, err := a.connect()
+	var user domain.UserDetail
+
+	err := a.withConn(ctx, func(conn *ldap.Conn) error {
+		entries, err := a.search(ctx, conn, a.userSearch(ldapAnd(a.UserFilter, ldapEqual(a.UsernameAttribute, username))))
+		if err != nil {
+			return fmt.Errorf("ldap search user %s: %w", username, err)
+		}
+
+		switch len(entries) {
+		case 0:
+			return fmt.Errorf("ldap user %s: %w", username, domain.ErrNotFound)
+		case 1:
+		default:
+			return fmt.Errorf("ldap user %s: %d entries found", username, len(entries))
+		}
+
+		entry := entries[0]
+		user = a.toUserDetail(entry)
+
+		filter := ldapAnd(a.GroupFilter, ldapOr(
+			ldapEqual("member", entry.DN),
+			ldapEqual("uniqueMember", entry.DN),
+			ldapEqual("memberUid", user.Username),
+		))
+
+		groups, err := a.groups(ctx, conn, filter)
+		if err != nil {
+			return err
+		}
+
+		user.Groups = lo.Map(groups, func(item ldapGroup, _ int) string {
+			return item.name
+		})
+
+		return nil
+	})
 	if err != nil {
-		return domain.UserDetail{}, fmt.Errorf("ldap connect: %w", err)
+		return domain.UserDetail{}, err
 	}
 
-	searchRequest := ldap.NewSearchRequest(
-		os.Getenv("LDAP_BASE_DN"),
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(sAMAccountName=%s)", username),
-		[]string{"dn"},
-		nil,
+	return user, nil
+}
+
+func (a *LdapAdapter) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
+	var (
+		entries []*ldap.Entry
+		groups  []ldapGroup
 	)
 
-	searchResp, err := conn.Search(searchRequest)
+	err := a.withConn(ctx, func(conn *ldap.Conn) error {
+		var err error
+
+		entries, err = a.search(ctx, conn, a.userSearch(a.UserFilter))
+		if err != nil {
+			return fmt.Errorf("ldap search users: %w", err)
+		}
+
+		groups, err = a.groups(ctx, conn, a.GroupFilter)
+
+		return err
+	})
 	if err != nil {
-		log.Printf("LDAP search failed for user %s, error details: %v", username, err)
-		return domain.UserDetail{}, err
+		return nil, err
 	}
 
-	if len(searchResp.Entries) != 1 {
-		log.Printf("User: %s not found or multiple entries found", username)
-		err = fmt.Errorf("user: %s not found or multiple entries found", username)
-		return domain.UserDetail{}, err
+	var ret []domain.UserDetail
+
+	for _, entry := range entries {
+		user := a.toUserDetail(entry)
+		if user.Username == "" {
+			log.Warn().Str("dn", entry.DN).Str("attribute", a.UsernameAttribute).Msg("ldap entry without username")
+			continue
+		}
+
+		for _, group := range groups {
+			if group.hasMember(entry.DN, user.Username) {
+				user.Groups = append(user.Groups, group.name)
+			}
+		}
+
+		ret = append(ret, user)
 	}
 
-	entry := searchResp.Entries[0]
+	return ret, nil
+}
+
+// userSearch builds the search request of user entries.
+func (a *LdapAdapter) userSearch(filter string) *ldap.SearchRequest {
+	attributes := []string{
+		a.UsernameAttribute, a.FullnameAttribute, "cn",
+		a.Attributes.Uid, a.Attributes.Gid, a.Attributes.Shell, a.Attributes.Home,
+		a.schema.id, a.schema.disabledAttribute,
+	}
+	attributes = append(attributes, a.Attributes.SshKeys...)
+
+	return ldap.NewSearchRequest(
+		a.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		lo.Uniq(lo.Compact(attributes)),
+		nil,
+	)
+}
+
+// toUserDetail maps a user entry to the backend user.
+func (a *LdapAdapter) toUserDetail(entry *ldap.Entry) domain.UserDetail {
+	username := entry.GetAttributeValue(a.UsernameAttribute)
+
+	var keys []string
+
+	for _, attribute := range a.Attributes.SshKeys {
+		for _, value := range entry.GetAttributeValues(attribute) {
+			if value = strings.TrimSpace(value); value != "" {
+				keys = append(keys, value)
+			}
+		}
+	}
 
 	return domain.UserDetail{
-		Username: entry.DN,
-	}, nil
+		Id:            a.entryId(entry),
+		Username:      username,
+		Fullname:      lo.CoalesceOrEmpty(entry.GetAttributeValue(a.FullnameAttribute), entry.GetAttributeValue("cn")),
+		SshPublicKeys: keys,
+		Disabled:      a.schema.disabled != nil && a.schema.disabled(entry),
+		UID:           ldapId(entry, username, a.Attributes.Uid),
+		GID:           ldapId(entry, username, a.Attributes.Gid),
+		Shell:         entry.GetAttributeValue(a.Attributes.Shell),
+		Home:          entry.GetAttributeValue(a.Attributes.Home),
+	}
 }
 
-func (a *LdapAdapter) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
-	conn, err := a.connect()
+// entryId returns the stable id of the entry, binary ids like the AD
+// objectGUID are hex encoded.
+func (a *LdapAdapter) entryId(entry *ldap.Entry) string {
+	if a.schema.id == "objectGUID" {
+		if raw := entry.GetRawAttributeValue(a.schema.id); len(raw) > 0 {
+			return hex.EncodeToString(raw)
+		}
+	}
+
+	return lo.CoalesceOrEmpty(entry.GetAttributeValue(a.schema.id), entry.DN)
+}
+
+// ldapId parses a numeric id attribute, zero is returned when the attribute
+// is missing or malformed.
+func ldapId(entry *ldap.Entry, username, attribute string) uint {
+	value := entry.GetAttributeValue(attribute)
+	if value == "" {
+		return 0
+	}
+
+	id, err := strconv.ParseUint(value, 10, 32)
 	if err != nil {
-		return nil, fmt.Errorf("ldap connect: %w", err)
+		log.Warn().Err(err).Str("user", username).Str("attribute", attribute).Msg("malformed id")
+		return 0
 	}
 
+	return uint(id)
+}
+
+type ldapGroup struct {
+	name string
+	// members holds the member DNs and member uids
+	members []string
+}
+
+// hasMember reports whether the user is a member by DN or by uid. DNs are
+// compared case insensitively.
+func (g ldapGroup) hasMember(dn, uid string) bool {
+	return lo.ContainsBy(g.members, func(item string) bool {
+		return strings.EqualFold(item, dn) || item == uid
+	})
+}
+
+// groups returns the groupOfNames, groupOfUniqueNames, posixGroup and AD
+// group entries matching the filter.
+func (a *LdapAdapter) groups(ctx context.Context, conn *ldap.Conn, filter string) ([]ldapGroup, error) {
 	searchRequest := ldap.NewSearchRequest(
-		os.Getenv("LDAP_BASE_DN"),
+		a.GroupBaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		"",
-		[]string{"dn"},
+		filter,
+		[]string{"cn", "member", "uniqueMember", "memberUid"},
 		nil,
 	)
 
-	searchResp, err := conn.Search(searchRequest)
+	entries, err := a.search(ctx, conn, searchRequest)
 	if err != nil {
-		log.Printf("LDAP search failed for users, error details: %v", err)
-		return []domain.UserDetail{}, err
+		return nil, fmt.Errorf("ldap search groups: %w", err)
 	}
 
-	var ret []domain.UserDetail
+	var ret []ldapGroup
+
+	for _, entry := range entries {
+		group := ldapGroup{name: entry.GetAttributeValue("cn")}
+		group.members = append(group.members, entry.GetAttributeValues("member")...)
+		group.members = append(group.members, entry.GetAttributeValues("uniqueMember")...)
+		group.members = append(group.members, entry.GetAttributeValues("memberUid")...)
 
-	for _, entry := range searchResp.Entries {
-		ret = append(ret, domain.UserDetail{Username: entry.DN})
+		ret = append(ret, group)
 	}
 
 	return ret, nil
 }
 
-// Connect establishes a connection to the LDAP server.
+// search returns all entries of the search, fetched in pages of PageSize
+// entries so server side size limits, 1000 entries in AD, do not truncate
+// the result. Servers without paging support return all entries at once.
+func (a *LdapAdapter) search(ctx context.Context, conn *ldap.Conn, searchRequest *ldap.SearchRequest) ([]*ldap.Entry, error) {
+	paging := ldap.NewControlPaging(uint32(a.PageSize))
+	searchRequest.Controls = append(searchRequest.Controls, paging)
+
+	var ret []*ldap.Entry
+
+	for {
+		var cookie []byte
+
+		res := conn.SearchAsync(ctx, searchRequest, 0)
+		for res.Next() {
+			if entry := res.Entry(); entry != nil {
+				ret = append(ret, entry)
+				continue
+			}
+
+			if control, ok := ldap.FindControl(res.Controls(), ldap.ControlTypePaging).(*ldap.ControlPaging); ok {
+				cookie = control.Cookie
+			}
+		}
+
+		if err := res.Err(); err != nil {
+			return nil, err
+		}
+
+		// a cancelled search ends without an error
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if len(cookie) == 0 {
+			return ret, nil
+		}
+
+		paging.SetCookie(cookie)
+	}
+}
+
+// withConn runs fn with the shared connection, connecting on first use. A
+// connection lost in between, e.g. closed by an idle timeout of the server,
+// is replaced and fn is retried once.
+func (a *LdapAdapter) withConn(ctx context.Context, fn func(conn *ldap.Conn) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if a.conn == nil || a.conn.IsClosing() {
+			conn, err := a.connect()
+			if err != nil {
+				return fmt.Errorf("ldap connect: %w", err)
+			}
+
+			a.conn = conn
+		}
+
+		err := fn(a.conn)
+		if err == nil || attempt > 0 || ctx.Err() != nil {
+			return err
+		}
+
+		if !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) && !a.conn.IsClosing() {
+			return err
+		}
+
+		log.Warn().Err(err).Str("url", a.URL).Msg("ldap connection lost, reconnecting")
+
+		_ = a.conn.Close()
+		a.conn = nil
+	}
+}
+
+// connect establishes an authenticated connection to the LDAP server.
 func (a *LdapAdapter) connect() (*ldap.Conn, error) {
-	conn, err := ldap.DialURL(os.Getenv("LDAP_ADDRESS"))
+	conn, err := ldap.DialURL(a.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.Timeout}),
+		ldap.DialWithTLSConfig(a.tlsConfig))
 	if err != nil {
-		log.Printf("LDAP connection failed, error details: %v", err)
 		return nil, err
 	}
 
-	if err := conn.Bind(os.Getenv("BIND_USER"), os.Getenv("BIND_PASSWORD")); err != nil {
-		log.Printf("LDAP bind failed while connecting, error details: %v", err)
-		return nil, err
+	conn.SetTimeout(a.Timeout)
+
+	if a.StartTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("start tls: %w", err)
+		}
+	}
+
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("bind: %w", err)
+		}
 	}
 
 	return conn, nil
 }
+
+// ldapTLSConfig returns the TLS configuration of ldaps:// and StartTLS
+// connections.
+func ldapTLSConfig(serverName, caCert string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if caCert == "" {
+		return config, nil
+	}
+
+	pool, err := loadCertPool(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("ldap ca certificate: %w", err)
+	}
+
+	config.RootCAs = pool
+
+	return config, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+
+	return pool, nil
+}
+
+// ldapEqual returns an equality filter, the value is escaped.
+func ldapEqual(attribute, value string) string {
+	return "(" + attribute + "=" + ldap.EscapeFilter(value) + ")"
+}
+
+// ldapAnd and ldapOr combine filters, which must be complete and escaped.
+func ldapAnd(filters ...string) string {
+	return "(&" + strings.Join(filters, "") + ")"
+}
+
+func ldapOr(filters ...string) string {
+	return "(|" + strings.Join(filters, "") + ")"
+}
@@ -0,0 +1,736 @@
+package adapter_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+
+	. "github.com/onsi/gomega"
+)
+
+const (
+	ldapAppBindRequest      = 0
+	ldapAppBindResponse     = 1
+	ldapAppUnbindRequest    = 2
+	ldapAppSearchRequest    = 3
+	ldapAppSearchEntry      = 4
+	ldapAppSearchDone       = 5
+	ldapAppExtendedRequest  = 23
+	ldapAppExtendedResponse = 24
+	ldapSizeLimitExceeded   = 4
+	ldapInvalidCredential   = 49
+)
+
+type fakeLdapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// get returns the values of an attribute, names are case insensitive.
+func (e fakeLdapEntry) get(name string) []string {
+	for attr, values := range e.attrs {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+
+	return nil
+}
+
+// fakeLdap is a minimal LDAP server answering simple binds, StartTLS and
+// searches with and, or, not, equality and presence filters. Searches
+// support the paged results control.
+type fakeLdap struct {
+	bindDN   string
+	password string
+	entries  []fakeLdapEntry
+	// sizeLimit caps the entries returned by a search without paging
+	sizeLimit int
+	// tls enables StartTLS
+	tls *tls.Config
+
+	mu sync.Mutex
+	// filters records the received search filters
+	filters []string
+	// accepted counts the connections
+	accepted int
+	conns    []net.Conn
+}
+
+func newFakeLdap(t *testing.T, f *fakeLdap) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	f.listen(t, l)
+
+	return "ldap://" + l.Addr().String()
+}
+
+// newFakeLdaps serves LDAP over TLS with the certificate.
+func newFakeLdaps(t *testing.T, f *fakeLdap, cert tls.Certificate) string {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	f.listen(t, l)
+
+	return "ldaps://" + l.Addr().String()
+}
+
+func (f *fakeLdap) listen(t *testing.T, l net.Listener) {
+	t.Cleanup(func() {
+		_ = l.Close()
+		f.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			f.mu.Lock()
+			f.accepted++
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+
+			go f.serve(conn)
+		}
+	}()
+}
+
+// drop closes all client connections.
+func (f *fakeLdap) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, conn := range f.conns {
+		_ = conn.Close()
+	}
+
+	f.conns = nil
+}
+
+func (f *fakeLdap) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.accepted
+}
+
+func (f *fakeLdap) searchFilters() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.filters)
+}
+
+func (f *fakeLdap) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldapAppBindRequest:
+			code := int64(0)
+			if op.Children[1].Value.(string) != f.bindDN || op.Children[2].Data.String() != f.password {
+				code = ldapInvalidCredential
+			}
+
+			_, _ = conn.Write(ldapMessage(id, ldapResult(ldapAppBindResponse, code)))
+		case ldapAppUnbindRequest:
+			return
+		case ldapAppExtendedRequest:
+			if f.tls == nil || op.Children[0].Data.String() != "1.3.6.1.4.1.1466.20037" {
+				_, _ = conn.Write(ldapMessage(id, ldapResult(ldapAppExtendedResponse, 2)))
+				continue
+			}
+
+			_, _ = conn.Write(ldapMessage(id, ldapResult(ldapAppExtendedResponse, 0)))
+
+			tlsConn := tls.Server(conn, f.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn = tlsConn
+		case ldapAppSearchRequest:
+			var paging *ldap.ControlPaging
+
+			if len(packet.Children) > 2 {
+				for _, child := range packet.Children[2].Children {
+					if control, err := ldap.DecodeControl(child); err == nil {
+						if c, ok := control.(*ldap.ControlPaging); ok {
+							paging = c
+						}
+					}
+				}
+			}
+
+			f.search(conn, id, op, paging)
+		default:
+			return
+		}
+	}
+}
+
+func (f *fakeLdap) search(conn net.Conn, id int64, op *ber.Packet, paging *ldap.ControlPaging) {
+	base := op.Children[0].Value.(string)
+	filter := op.Children[6]
+	requested := lo.Map(op.Children[7].Children, func(item *ber.Packet, _ int) string {
+		return item.Value.(string)
+	})
+
+	if decompiled, err := decompileFilter(filter); err == nil {
+		f.mu.Lock()
+		f.filters = append(f.filters, decompiled)
+		f.mu.Unlock()
+	}
+
+	matched := lo.Filter(f.entries, func(entry fakeLdapEntry, _ int) bool {
+		return strings.HasSuffix(strings.ToLower(entry.dn), strings.ToLower(base)) && matchFilter(entry, filter)
+	})
+
+	var (
+		code     int64
+		controls []*ber.Packet
+	)
+
+	switch {
+	case paging != nil && paging.PagingSize > 0:
+		// the cookie is the offset of the next page
+		offset, _ := strconv.Atoi(string(paging.Cookie))
+		end := min(offset+int(paging.PagingSize), len(matched))
+		next := lo.Ternary(end < len(matched), strconv.Itoa(end), "")
+		matched = matched[min(offset, end):end]
+
+		controls = append(controls, (&ldap.ControlPaging{Cookie: []byte(next)}).Encode())
+	case f.sizeLimit > 0 && len(matched) > f.sizeLimit:
+		matched = matched[:f.sizeLimit]
+		code = ldapSizeLimitExceeded
+	}
+
+	for _, entry := range matched {
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapAppSearchEntry, nil, "")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+
+		for _, name := range requested {
+			values := entry.get(name)
+			if len(values) == 0 {
+				continue
+			}
+
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+			}
+
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+
+		result.AppendChild(attributes)
+
+		_, _ = conn.Write(ldapMessage(id, result))
+	}
+
+	_, _ = conn.Write(ldapMessage(id, ldapResult(ldapAppSearchDone, code), controls...))
+}
+
+// matchFilter evaluates a BER encoded search filter against the entry.
+func matchFilter(entry fakeLdapEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case 0:
+		return lo.EveryBy(filter.Children, func(item *ber.Packet) bool { return matchFilter(entry, item) })
+	case 1:
+		return lo.SomeBy(filter.Children, func(item *ber.Packet) bool { return matchFilter(entry, item) })
+	case 2:
+		return !matchFilter(entry, filter.Children[0])
+	case 3:
+		value := filter.Children[1].Data.String()
+		return lo.ContainsBy(entry.get(filter.Children[0].Data.String()), func(item string) bool {
+			return strings.EqualFold(item, value)
+		})
+	case 7:
+		return len(entry.get(filter.Data.String())) > 0
+	default:
+		return false
+	}
+}
+
+func decompileFilter(filter *ber.Packet) (string, error) {
+	var b strings.Builder
+
+	switch filter.Tag {
+	case 0, 1:
+		b.WriteString(lo.Ternary(filter.Tag == 0, "(&", "(|"))
+
+		for _, child := range filter.Children {
+			s, err := decompileFilter(child)
+			if err != nil {
+				return "", err
+			}
+
+			b.WriteString(s)
+		}
+
+		b.WriteString(")")
+	case 2:
+		s, err := decompileFilter(filter.Children[0])
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString("(!" + s + ")")
+	case 3:
+		b.WriteString("(" + filter.Children[0].Data.String() + "=" + filter.Children[1].Data.String() + ")")
+	case 7:
+		b.WriteString("(" + filter.Data.String() + "=*)")
+	default:
+		return "", errors.New("unsupported filter")
+	}
+
+	return b.String(), nil
+}
+
+func ldapMessage(id int64, op *ber.Packet, controls ...*ber.Packet) []byte {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+
+	if len(controls) > 0 {
+		packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+		for _, control := range controls {
+			packet.AppendChild(control)
+		}
+
+		message.AppendChild(packet)
+	}
+
+	return message.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+
+	return result
+}
+
+func newOpenLdap() *fakeLdap {
+	return &fakeLdap{
+		bindDN:   "cn=sshkeyman,dc=example,dc=org",
+		password: "secret",
+		entries: []fakeLdapEntry{
+			{
+				dn: "uid=alice,ou=people,dc=example,dc=org",
+				attrs: map[string][]string{
+					"objectClass":   {"inetOrgPerson", "posixAccount", "ldapPublicKey"},
+					"uid":           {"alice"},
+					"cn":            {"Alice"},
+					"gecos":         {"Alice Liddell"},
+					"entryUUID":     {"6b8b4567-1111-2222-3333-444455556666"},
+					"uidNumber":     {"20001"},
+					"gidNumber":     {"5000"},
+					"homeDirectory": {"/home/alice"},
+					"loginShell":    {"/bin/zsh"},
+					"sshPublicKey":  {"ssh-ed25519 AAAA alice@laptop", "ssh-ed25519 BBBB alice@desktop"},
+				},
+			},
+			{
+				dn: "uid=bob,ou=people,dc=example,dc=org",
+				attrs: map[string][]string{
+					"objectClass":          {"posixAccount"},
+					"uid":                  {"bob"},
+					"cn":                   {"Bob"},
+					"uidNumber":            {"20002"},
+					"pwdAccountLockedTime": {"000001010000Z"},
+				},
+			},
+			{
+				dn: "cn=printer,ou=devices,dc=example,dc=org",
+				attrs: map[string][]string{
+					"objectClass": {"device"},
+					"cn":          {"printer"},
+				},
+			},
+			{
+				dn: "cn=ops,ou=groups,dc=example,dc=org",
+				attrs: map[string][]string{
+					"objectClass": {"posixGroup"},
+					"cn":          {"ops"},
+					"memberUid":   {"alice", "bob"},
+				},
+			},
+			{
+				dn: "cn=admins,ou=groups,dc=example,dc=org",
+				attrs: map[string][]string{
+					"objectClass": {"groupOfNames"},
+					"cn":          {"admins"},
+					"member":      {"UID=alice,OU=people,DC=example,DC=org"},
+				},
+			},
+		},
+	}
+}
+
+func TestLdapUsers(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := newOpenLdap()
+	k, err := adapter.NewLdapAdapter(&domain.Config{
+		Ldap: domain.LdapConfig{
+			URL:          newFakeLdap(t, fake),
+			BindDN:       "cn=sshkeyman,dc=example,dc=org",
+			BindPassword: "secret",
+			BaseDN:       "dc=example,dc=org",
+		},
+	})
+
+	Expect(err).To(BeNil())
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(2))
+
+	alice, _ := lo.Find(users, func(item domain.UserDetail) bool { return item.Username == "alice" })
+	Expect(alice).To(Equal(domain.UserDetail{
+		Id:            "6b8b4567-1111-2222-3333-444455556666",
+		Username:      "alice",
+		Fullname:      "Alice Liddell",
+		SshPublicKeys: []string{"ssh-ed25519 AAAA alice@laptop", "ssh-ed25519 BBBB alice@desktop"},
+		Groups:        []string{"ops", "admins"},
+		UID:           20001,
+		GID:           5000,
+		Shell:         "/bin/zsh",
+		Home:          "/home/alice",
+	}))
+
+	bob, _ := lo.Find(users, func(item domain.UserDetail) bool { return item.Username == "bob" })
+	Expect(bob.Disabled).To(BeTrue())
+	// the DN is the id without entryUUID, the cn the name without gecos
+	Expect(bob.Id).To(Equal("uid=bob,ou=people,dc=example,dc=org"))
+	Expect(bob.Fullname).To(Equal("Bob"))
+	Expect(bob.Groups).To(Equal([]string{"ops"}))
+}
+
+func TestLdapUser(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := newOpenLdap()
+	k, err := adapter.NewLdapAdapter(&domain.Config{
+		Ldap: domain.LdapConfig{
+			URL:          newFakeLdap(t, fake),
+			BindDN:       "cn=sshkeyman,dc=example,dc=org",
+			BindPassword: "secret",
+			BaseDN:       "dc=example,dc=org",
+		},
+	})
+
+	Expect(err).To(BeNil())
+
+	alice, err := k.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+	Expect(alice.Username).To(Equal("alice"))
+	Expect(alice.SshPublicKeys).To(HaveLen(2))
+	Expect(alice.Groups).To(ConsistOf("ops", "admins"))
+
+	_, err = k.FetchUser(context.Background(), "nobody")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	// filter meta characters are escaped
+	_, err = k.FetchUser(context.Background(), "*")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+	Expect(fake.searchFilters()).To(ContainElement("(&(objectClass=posixAccount)(uid=*))"))
+}
+
+func TestLdapActiveDirectory(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := &fakeLdap{
+		bindDN:   "cn=sshkeyman,cn=users,dc=example,dc=org",
+		password: "secret",
+		entries: []fakeLdapEntry{
+			{
+				dn: "cn=Carol,cn=users,dc=example,dc=org",
+				attrs: map[string][]string{
+					"objectClass":        {"top", "person", "user"},
+					"objectCategory":     {"person"},
+					"sAMAccountName":     {"carol"},
+					"displayName":        {"Carol Danvers"},
+					"objectGUID":         {"\x01\x02\x03\x04"},
+					"userAccountControl": {"514"},
+					"unixHomeDirectory":  {"/home/carol"},
+					"sshPublicKey":       {"ssh-ed25519 CCCC carol"},
+				},
+			},
+			{
+				dn: "cn=linux,cn=users,dc=example,dc=org",
+				attrs: map[string][]string{
+					"objectClass": {"top", "group"},
+					"cn":          {"linux"},
+					"member":      {"cn=Carol,cn=users,dc=example,dc=org"},
+				},
+			},
+		},
+	}
+
+	k, err := adapter.NewLdapAdapter(&domain.Config{
+		Ldap: domain.LdapConfig{
+			URL:          newFakeLdap(t, fake),
+			BindDN:       "cn=sshkeyman,cn=users,dc=example,dc=org",
+			BindPassword: "secret",
+			BaseDN:       "dc=example,dc=org",
+			Schema:       "ad",
+		},
+	})
+	Expect(err).To(BeNil())
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(Equal([]domain.UserDetail{{
+		Id:            "01020304",
+		Username:      "carol",
+		Fullname:      "Carol Danvers",
+		SshPublicKeys: []string{"ssh-ed25519 CCCC carol"},
+		Groups:        []string{"linux"},
+		Disabled:      true,
+		Home:          "/home/carol",
+	}}))
+}
+
+func TestLdapBindFailure(t *testing.T) {
+	RegisterTestingT(t)
+
+	k, err := adapter.NewLdapAdapter(&domain.Config{
+		Ldap: domain.LdapConfig{
+			URL:          newFakeLdap(t, newOpenLdap()),
+			BindDN:       "cn=sshkeyman,dc=example,dc=org",
+			BindPassword: "wrong",
+			BaseDN:       "dc=example,dc=org",
+		},
+	})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(MatchError(ContainSubstring("bind")))
+}
+
+// testCertificate returns a self-signed server and client certificate of
+// 127.0.0.1 and the paths of its PEM certificate and key.
+func testCertificate(t *testing.T) (tls.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sshkeyman test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPath, keyPath
+}
+
+func TestLdapPaging(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := &fakeLdap{sizeLimit: 3}
+	for i := range 7 {
+		fake.entries = append(fake.entries, fakeLdapEntry{
+			dn: fmt.Sprintf("uid=user%d,ou=people,dc=example,dc=org", i),
+			attrs: map[string][]string{
+				"objectClass": {"posixAccount"},
+				"uid":         {fmt.Sprintf("user%d", i)},
+			},
+		})
+	}
+
+	k, err := adapter.NewLdapAdapter(&domain.Config{
+		Ldap: domain.LdapConfig{
+			URL:      newFakeLdap(t, fake),
+			BaseDN:   "dc=example,dc=org",
+			PageSize: 2,
+		},
+	})
+	Expect(err).To(BeNil())
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(7))
+	// four user pages and one group page
+	Expect(fake.searchFilters()).To(HaveLen(5))
+}
+
+func TestLdapTLS(t *testing.T) {
+	RegisterTestingT(t)
+
+	cert, caPath, _ := testCertificate(t)
+
+	fake := newOpenLdap()
+	fake.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	ldaps := newFakeLdaps(t, fake, cert)
+	plain := newFakeLdap(t, fake)
+
+	cfg := domain.LdapConfig{
+		BindDN:       "cn=sshkeyman,dc=example,dc=org",
+		BindPassword: "secret",
+		BaseDN:       "dc=example,dc=org",
+	}
+
+	fetch := func(cfg domain.LdapConfig) ([]domain.UserDetail, error) {
+		k, err := adapter.NewLdapAdapter(&domain.Config{Ldap: cfg})
+		Expect(err).To(BeNil())
+
+		return k.FetchUsers(context.Background())
+	}
+
+	cfg.URL = ldaps
+	_, err := fetch(cfg)
+	Expect(err).To(MatchError(ContainSubstring("certificate")))
+
+	cfg.CACert = caPath
+	users, err := fetch(cfg)
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(2))
+
+	cfg.URL = plain
+	cfg.StartTLS = true
+	users, err = fetch(cfg)
+	Expect(err).To(BeNil())
+	Expect(users).To(HaveLen(2))
+
+	cfg.CACert = ""
+	_, err = fetch(cfg)
+	Expect(err).To(MatchError(ContainSubstring("start tls")))
+
+	cfg.TLSSkipVerify = true
+	_, err = fetch(cfg)
+	Expect(err).To(BeNil())
+}
+
+func TestLdapReconnect(t *testing.T) {
+	RegisterTestingT(t)
+
+	fake := newOpenLdap()
+	k, err := adapter.NewLdapAdapter(&domain.Config{
+		Ldap: domain.LdapConfig{
+			URL:          newFakeLdap(t, fake),
+			BindDN:       "cn=sshkeyman,dc=example,dc=org",
+			BindPassword: "secret",
+			BaseDN:       "dc=example,dc=org",
+		},
+	})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	_, err = k.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+	Expect(fake.connections()).To(Equal(1))
+
+	fake.drop()
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	Expect(fake.connections()).To(Equal(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = k.FetchUsers(ctx)
+	Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+}
+
+func TestLdapConfig(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, cfg := range []domain.LdapConfig{
+		{URL: "ldap://localhost", UserFilter: "(uid=a"},
+		{URL: "ldap://localhost", GroupFilter: "objectClass=group)"},
+		{URL: "ldap://localhost", UsernameAttribute: "uid=*)(uid"},
+		{URL: "ldaps://localhost", StartTLS: true},
+		{URL: "ldap://localhost", CACert: "/nonexistent/ca.pem"},
+	} {
+		_, err := adapter.NewLdapAdapter(&domain.Config{Ldap: cfg})
+		Expect(err).NotTo(BeNil(), "%+v", cfg)
+	}
+}
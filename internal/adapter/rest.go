@@ -0,0 +1,481 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+const (
+	RestAuthBearer = "bearer"
+	RestAuthBasic  = "basic"
+
+	RestPageOffset = "offset"
+	RestPageCursor = "cursor"
+	RestPageLink   = "link"
+
+	DefaultRestPageSize = 100
+	DefaultRestTimeout  = 10 * time.Second
+)
+
+// restFields holds the parsed paths of domain.RestFieldMapping.
+type restFields struct {
+	id       jsonPath
+	username jsonPath
+	fullname jsonPath
+	sshKeys  jsonPath
+	groups   jsonPath
+	enabled  jsonPath
+}
+
+// RestAdapter reads users from a JSON API, the fields of a user object are
+// mapped by paths.
+type RestAdapter struct {
+	UsersURL   string
+	UserURL    string
+	Pagination domain.RestPaginationConfig
+
+	usersPath  jsonPath
+	userPath   jsonPath
+	cursorPath jsonPath
+	fields     restFields
+	resty      *resty.Client
+}
+
+func NewRestAdapter(config *domain.Config) (domain.Backend, error) {
+	cfg := config.Rest
+
+	if cfg.UsersURL == "" {
+		return nil, errors.New("rest users_url is not set")
+	}
+
+	if cfg.Fields.Username == "" {
+		return nil, errors.New("rest fields.username is not set")
+	}
+
+	a := &RestAdapter{
+		UsersURL:   cfg.UsersURL,
+		UserURL:    cfg.UserURL,
+		Pagination: cfg.Pagination,
+	}
+
+	for _, path := range []struct {
+		path   string
+		target *jsonPath
+	}{
+		{cfg.UsersPath, &a.usersPath},
+		{cfg.UserPath, &a.userPath},
+		{cfg.Pagination.CursorPath, &a.cursorPath},
+		{cfg.Fields.Id, &a.fields.id},
+		{cfg.Fields.Username, &a.fields.username},
+		{cfg.Fields.Fullname, &a.fields.fullname},
+		{cfg.Fields.SshKeys, &a.fields.sshKeys},
+		{cfg.Fields.Groups, &a.fields.groups},
+		{cfg.Fields.Enabled, &a.fields.enabled},
+	} {
+		parsed, err := parseJsonPath(path.path)
+		if err != nil {
+			return nil, fmt.Errorf("rest: %w", err)
+		}
+
+		*path.target = parsed
+	}
+
+	switch a.Pagination.Style {
+	case "", RestPageOffset, RestPageLink:
+	case RestPageCursor:
+		if a.Pagination.CursorPath == "" {
+			return nil, errors.New("rest cursor pagination needs pagination.cursor_path")
+		}
+	default:
+		return nil, fmt.Errorf("unknown rest pagination style %q", a.Pagination.Style)
+	}
+
+	a.Pagination.PageSize = lo.Ternary(a.Pagination.PageSize > 0, a.Pagination.PageSize, DefaultRestPageSize)
+	a.Pagination.LimitParam = lo.CoalesceOrEmpty(a.Pagination.LimitParam, "limit")
+	a.Pagination.OffsetParam = lo.CoalesceOrEmpty(a.Pagination.OffsetParam, "offset")
+	a.Pagination.CursorParam = lo.CoalesceOrEmpty(a.Pagination.CursorParam, "cursor")
+
+	client, err := newRestClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	a.resty = client
+
+	return a, nil
+}
+
+// newRestClient returns a client sending the configured credentials.
+func newRestClient(cfg domain.RestConfig) (*resty.Client, error) {
+	client := resty.New().
+		SetTimeout(lo.Ternary(cfg.Timeout > 0, cfg.Timeout, DefaultRestTimeout)).
+		SetHeader("Accept", "application/json").
+		SetHeaders(cfg.Headers)
+
+	switch cfg.Auth.Type {
+	case "":
+	case RestAuthBearer:
+		client.SetAuthToken(cfg.Auth.Token)
+	case RestAuthBasic:
+		client.SetBasicAuth(cfg.Auth.Username, cfg.Auth.Password)
+	default:
+		return nil, fmt.Errorf("unknown rest auth type %q", cfg.Auth.Type)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.Auth.ClientCert != "" || cfg.Auth.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Auth.ClientCert, cfg.Auth.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("rest client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.Auth.CACert != "" {
+		pool, err := loadCertPool(cfg.Auth.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("rest ca certificate: %w", err)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return client.SetTLSClientConfig(tlsConfig), nil
+}
+
+func (a *RestAdapter) FetchUser(ctx context.Context, username string) (domain.UserDetail, error) {
+	if a.UserURL == "" {
+		users, err := a.FetchUsers(ctx)
+		if err != nil {
+			return domain.UserDetail{}, err
+		}
+
+		user, found := lo.Find(users, func(item domain.UserDetail) bool {
+			return item.Username == username
+		})
+		if !found {
+			return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", username, domain.ErrNotFound)
+		}
+
+		return user, nil
+	}
+
+	res, err := a.resty.R().
+		SetContext(ctx).
+		Get(strings.ReplaceAll(a.UserURL, "{username}", url.PathEscape(username)))
+	if err != nil {
+		return domain.UserDetail{}, fmt.Errorf("fetch user: %w", err)
+	}
+	if res.StatusCode() == http.StatusNotFound {
+		return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", username, domain.ErrNotFound)
+	}
+
+	doc, err := restDocument("fetch user", res)
+	if err != nil {
+		return domain.UserDetail{}, err
+	}
+
+	// the user must match exactly, the API may be case insensitive or
+	// return a similar user
+	for _, item := range a.userPath.Select(doc) {
+		if user, ok := a.toUserDetail(item); ok && user.Username == username {
+			if err := validateUsers([]domain.UserDetail{user}); err != nil {
+				return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", username, err)
+			}
+
+			return user, nil
+		}
+	}
+
+	return domain.UserDetail{}, fmt.Errorf("fetch user %s: %w", username, domain.ErrNotFound)
+}
+
+func (a *RestAdapter) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
+	users, err := a.fetchUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateUsers(users); err != nil {
+		return nil, fmt.Errorf("fetch users: %w", err)
+	}
+
+	return users, nil
+}
+
+// fetchUsers reads every page of the listing.
+func (a *RestAdapter) fetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
+	var (
+		ret    []domain.UserDetail
+		next   = a.UsersURL
+		cursor string
+		// seen detects an API returning the same cursor or link again
+		seen = map[string]bool{}
+		// listed holds the ids of the earlier pages, an API ignoring the
+		// offset returns them again
+		listed = map[string]bool{}
+	)
+
+	for page := 0; ; page++ {
+		req := a.resty.R().SetContext(ctx)
+
+		switch a.Pagination.Style {
+		case RestPageOffset:
+			req.SetQueryParam(a.Pagination.LimitParam, strconv.Itoa(a.Pagination.PageSize)).
+				SetQueryParam(a.Pagination.OffsetParam, strconv.Itoa(page*a.Pagination.PageSize))
+		case RestPageCursor:
+			req.SetQueryParam(a.Pagination.LimitParam, strconv.Itoa(a.Pagination.PageSize))
+			if cursor != "" {
+				req.SetQueryParam(a.Pagination.CursorParam, cursor)
+			}
+		}
+
+		res, err := req.Get(next)
+		if err != nil {
+			return nil, fmt.Errorf("fetch users: %w", err)
+		}
+
+		doc, err := restDocument("fetch users", res)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			items []any
+			found bool
+		)
+
+		for _, value := range a.usersPath.Select(doc) {
+			if values, ok := value.([]any); ok {
+				items = append(items, values...)
+				found = true
+			}
+		}
+
+		// an empty result would remove every user in the sync
+		if !found {
+			return nil, fmt.Errorf("fetch users: no user array found at %q", a.UsersURL)
+		}
+
+		var ids []string
+
+		for _, item := range items {
+			user, ok := a.toUserDetail(item)
+			if !ok {
+				log.Warn().Int("page", page).Msg("rest user without username")
+				continue
+			}
+
+			ret = append(ret, user)
+			ids = append(ids, user.Id)
+		}
+
+		switch a.Pagination.Style {
+		case RestPageOffset:
+			// an API ignoring limit or offset would be paged until the
+			// sync times out
+			if len(items) > a.Pagination.PageSize {
+				return nil, fmt.Errorf("fetch users: page of %d users exceeds the limit %d", len(items), a.Pagination.PageSize)
+			}
+
+			if id, found := lo.Find(ids, func(item string) bool { return listed[item] }); found {
+				return nil, fmt.Errorf("fetch users: user %s returned again at offset %d", id, page*a.Pagination.PageSize)
+			}
+
+			for _, id := range ids {
+				listed[id] = true
+			}
+
+			if len(items) < a.Pagination.PageSize {
+				return ret, nil
+			}
+		case RestPageCursor:
+			cursor = a.cursorPath.String(doc)
+			if cursor == "" {
+				return ret, nil
+			}
+
+			if seen[cursor] {
+				return nil, fmt.Errorf("fetch users: cursor %s returned twice", cursor)
+			}
+
+			seen[cursor] = true
+		case RestPageLink:
+			next = nextLink(res.Header().Get("Link"), res.Request.URL)
+			if next == "" {
+				return ret, nil
+			}
+
+			if seen[next] {
+				return nil, fmt.Errorf("fetch users: link %s returned twice", next)
+			}
+
+			// the credentials are sent with every page, they must not leave
+			// the origin of users_url
+			if !sameOrigin(next, a.UsersURL) {
+				return nil, fmt.Errorf("fetch users: link %s leaves the origin of %s", next, a.UsersURL)
+			}
+
+			seen[next] = true
+		default:
+			return ret, nil
+		}
+	}
+}
+
+// toUserDetail maps a user object, it fails if the username is missing.
+// The id defaults to the username.
+func (a *RestAdapter) toUserDetail(item any) (domain.UserDetail, bool) {
+	// unmapped fields are empty, the empty path would select the object
+	field := func(path jsonPath) []string {
+		if len(path) == 0 {
+			return nil
+		}
+
+		return path.Strings(item)
+	}
+
+	username := lo.FirstOrEmpty(field(a.fields.username))
+	if username == "" {
+		return domain.UserDetail{}, false
+	}
+
+	user := domain.UserDetail{
+		Id:       lo.CoalesceOrEmpty(lo.FirstOrEmpty(field(a.fields.id)), username),
+		Username: username,
+		Fullname: lo.FirstOrEmpty(field(a.fields.fullname)),
+		Groups:   field(a.fields.groups),
+		Disabled: !a.enabled(item),
+	}
+
+	for _, key := range field(a.fields.sshKeys) {
+		if key = strings.TrimSpace(key); key != "" {
+			user.SshPublicKeys = append(user.SshPublicKeys, key)
+		}
+	}
+
+	return user, true
+}
+
+// enabled parses the enabled field, users without one are enabled. Values
+// which are not understood disable the user, e.g. "suspended".
+func (a *RestAdapter) enabled(item any) bool {
+	if len(a.fields.enabled) == 0 {
+		return true
+	}
+
+	values := a.fields.enabled.Select(item)
+	if len(values) == 0 {
+		return true
+	}
+
+	switch v := values[0].(type) {
+	case bool:
+		return v
+	case json.Number:
+		n, err := v.Float64()
+		return err == nil && n != 0
+	case string:
+		if enabled, err := strconv.ParseBool(v); err == nil {
+			return enabled
+		}
+
+		return lo.Contains([]string{"yes", "on", "active", "enabled"}, strings.ToLower(v))
+	default:
+		return false
+	}
+}
+
+// restDocument decodes the JSON response, numbers are kept as json.Number
+// so large ids are not rounded.
+func restDocument(op string, res *resty.Response) (any, error) {
+	switch {
+	case res.StatusCode() == http.StatusUnauthorized, res.StatusCode() == http.StatusForbidden:
+		return nil, fmt.Errorf("%s: %w: code: %d", op, domain.ErrForbidden, res.StatusCode())
+	case res.IsError():
+		return nil, fmt.Errorf("%s: code: %d", op, res.StatusCode())
+	}
+
+	var doc any
+
+	decoder := json.NewDecoder(bytes.NewReader(res.Body()))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: malformed response: %w", op, err)
+	}
+
+	return doc, nil
+}
+
+// nextLink returns the rel="next" target of a Link header (RFC 8288),
+// resolved against the request URL.
+func nextLink(header, requestURL string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, _ := strings.Cut(strings.TrimSpace(link), ";")
+		target = strings.TrimSpace(target)
+
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		next := false
+
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "rel") && lo.Contains(strings.Fields(strings.Trim(value, `"`)), "next") {
+				next = true
+			}
+		}
+
+		if !next {
+			continue
+		}
+
+		base, err := url.Parse(requestURL)
+		if err != nil {
+			return ""
+		}
+
+		ref, err := url.Parse(strings.Trim(target, "<>"))
+		if err != nil {
+			return ""
+		}
+
+		return base.ResolveReference(ref).String()
+	}
+
+	return ""
+}
+
+// sameOrigin reports whether both URLs have the same scheme, host and port.
+func sameOrigin(target, base string) bool {
+	t, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	b, err := url.Parse(base)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(t.Scheme, b.Scheme) && strings.EqualFold(t.Host, b.Host)
+}
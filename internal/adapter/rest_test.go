@@ -0,0 +1,451 @@
+package adapter_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+
+	. "github.com/onsi/gomega"
+)
+
+const (
+	portalDesktopKey = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBBrpEURt84wm0le8rqNQP6h2FXa43hE/CtihCJ8XOb7WlI6oKB0kI7TbtYz9plar1B3kat70Qw7iu4tYkZ+fOPM= alice@desktop"
+	portalBobKey     = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKNlOXIxo+1XKlJUAz4CdTHX6hK/803LfVABNIt3Yg9u bob"
+)
+
+// portalUsers are the users of the fake identity portal in its own format.
+var portalUsers = []map[string]any{
+	{
+		"id":      json.Number("9007199254740993"),
+		"login":   "alice",
+		"profile": map[string]any{"displayName": "Alice Liddell"},
+		"keys": []any{
+			map[string]any{"value": execKey},
+			map[string]any{"value": portalDesktopKey},
+		},
+		"groups": []any{map[string]any{"name": "dev"}, map[string]any{"name": "ops"}},
+		"active": true,
+	},
+	{
+		"id":     json.Number("2"),
+		"login":  "bob",
+		"keys":   []any{map[string]any{"value": portalBobKey}},
+		"active": false,
+	},
+	{
+		// no login, skipped
+		"id": json.Number("3"),
+	},
+	{
+		"id":     json.Number("4"),
+		"login":  "carol",
+		"active": "true",
+	},
+	{
+		"id":    json.Number("5"),
+		"login": "dave",
+	},
+	{
+		"id":     json.Number("6"),
+		"login":  "erin",
+		"active": "no",
+	},
+}
+
+var portalFields = domain.RestFieldMapping{
+	Id:       "id",
+	Username: "login",
+	Fullname: "profile.displayName",
+	SshKeys:  "keys[*].value",
+	Groups:   "groups[*].name",
+	Enabled:  "active",
+}
+
+// newPortal serves portalUsers, the handler writes the page of users
+// starting at offset.
+func newPortal(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, page func(offset, limit int) []map[string]any)) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		handler(w, r, func(offset, limit int) []map[string]any {
+			return portalUsers[min(offset, len(portalUsers)):min(offset+limit, len(portalUsers))]
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func expectPortalUsers(users []domain.UserDetail) {
+	Expect(lo.Map(users, func(item domain.UserDetail, _ int) string { return item.Username })).
+		To(Equal([]string{"alice", "bob", "carol", "dave", "erin"}))
+
+	Expect(users[0]).To(Equal(domain.UserDetail{
+		Id:            "9007199254740993",
+		Username:      "alice",
+		Fullname:      "Alice Liddell",
+		SshPublicKeys: []string{execKey, portalDesktopKey},
+		Groups:        []string{"dev", "ops"},
+	}))
+	Expect(users[1].Disabled).To(BeTrue())
+	Expect(users[2].Disabled).To(BeFalse())
+	Expect(users[3].Disabled).To(BeFalse())
+	// values which are not understood as enabled disable the user
+	Expect(users[4].Disabled).To(BeTrue())
+}
+
+func TestRestOffset(t *testing.T) {
+	RegisterTestingT(t)
+
+	var requests []string
+
+	server := newPortal(t, func(w http.ResponseWriter, r *http.Request, page func(offset, limit int) []map[string]any) {
+		requests = append(requests, r.URL.RequestURI())
+
+		if r.Header.Get("Authorization") != "Bearer portal-token" || r.Header.Get("X-Tenant") != "corp" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"users": page(offset, limit)}})
+	})
+
+	cfg := domain.RestConfig{
+		UsersURL:   server.URL + "/api/users",
+		UsersPath:  "$.data.users",
+		Fields:     portalFields,
+		Auth:       domain.RestAuthConfig{Type: "bearer", Token: "portal-token"},
+		Pagination: domain.RestPaginationConfig{Style: "offset", PageSize: 2, OffsetParam: "skip"},
+		Headers:    map[string]string{"X-Tenant": "corp"},
+	}
+
+	k, err := adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+	Expect(err).To(BeNil())
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	expectPortalUsers(users)
+	Expect(requests).To(Equal([]string{
+		"/api/users?limit=2&skip=0",
+		"/api/users?limit=2&skip=2",
+		"/api/users?limit=2&skip=4",
+		"/api/users?limit=2&skip=6",
+	}))
+
+	// users are looked up in the listing without user_url
+	bob, err := k.FetchUser(context.Background(), "bob")
+	Expect(err).To(BeNil())
+	Expect(bob.Id).To(Equal("2"))
+
+	_, err = k.FetchUser(context.Background(), "nobody")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	cfg.Auth.Token = "expired"
+	k, err = adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(errors.Is(err, domain.ErrForbidden)).To(BeTrue())
+
+	// a users_path matching nothing must not look like an empty directory
+	cfg.Auth.Token = "portal-token"
+	cfg.UsersPath = "users"
+	k, err = adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(MatchError(ContainSubstring("no user array")))
+}
+
+func TestRestOffsetIgnored(t *testing.T) {
+	RegisterTestingT(t)
+
+	for name, tc := range map[string]struct {
+		page func(page func(offset, limit int) []map[string]any, offset, limit int) []map[string]any
+		err  string
+	}{
+		"limit": {
+			page: func(page func(offset, limit int) []map[string]any, offset, _ int) []map[string]any {
+				return page(offset, len(portalUsers))
+			},
+			err: "page of 6 users exceeds the limit 2",
+		},
+		"offset": {
+			page: func(page func(offset, limit int) []map[string]any, _, limit int) []map[string]any {
+				return page(0, limit)
+			},
+			err: "returned again at offset 2",
+		},
+	} {
+		var requests int
+
+		server := newPortal(t, func(w http.ResponseWriter, r *http.Request, page func(offset, limit int) []map[string]any) {
+			requests++
+
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+			_ = json.NewEncoder(w).Encode(tc.page(page, offset, limit))
+		})
+
+		k, err := adapter.NewRestAdapter(&domain.Config{Rest: domain.RestConfig{
+			UsersURL:   server.URL + "/users",
+			Fields:     portalFields,
+			Pagination: domain.RestPaginationConfig{Style: "offset", PageSize: 2},
+		}})
+		Expect(err).To(BeNil(), name)
+
+		_, err = k.FetchUsers(context.Background())
+		Expect(err).To(MatchError(ContainSubstring(tc.err)), name)
+		Expect(requests).To(BeNumerically("<=", 2), name)
+	}
+}
+
+func TestRestCursor(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := newPortal(t, func(w http.ResponseWriter, r *http.Request, page func(offset, limit int) []map[string]any) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("after"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+		response := map[string]any{"items": page(offset, limit)}
+		if offset+limit < len(portalUsers) {
+			response["paging"] = map[string]any{"next": strconv.Itoa(offset + limit)}
+		}
+
+		_ = json.NewEncoder(w).Encode(response)
+	})
+
+	k, err := adapter.NewRestAdapter(&domain.Config{Rest: domain.RestConfig{
+		UsersURL:  server.URL + "/users",
+		UsersPath: "items",
+		Fields:    portalFields,
+		Pagination: domain.RestPaginationConfig{
+			Style: "cursor", PageSize: 3, CursorParam: "after", CursorPath: "paging.next",
+		},
+	}})
+	Expect(err).To(BeNil())
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	expectPortalUsers(users)
+}
+
+func TestRestLink(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := newPortal(t, func(w http.ResponseWriter, r *http.Request, page func(offset, limit int) []map[string]any) {
+		if username, password, _ := r.BasicAuth(); username != "sshkeyman" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if offset+2 < len(portalUsers) {
+			w.Header().Set("Link", fmt.Sprintf(`<https://portal.example.com/first>; rel="first", <?page=%d>; rel="next last"`, offset+2))
+		}
+
+		_ = json.NewEncoder(w).Encode(page(offset, 2))
+	})
+
+	k, err := adapter.NewRestAdapter(&domain.Config{Rest: domain.RestConfig{
+		UsersURL:   server.URL + "/users",
+		Fields:     portalFields,
+		Auth:       domain.RestAuthConfig{Type: "basic", Username: "sshkeyman", Password: "secret"},
+		Pagination: domain.RestPaginationConfig{Style: "link"},
+	}})
+	Expect(err).To(BeNil())
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	expectPortalUsers(users)
+}
+
+func TestRestLinkOrigin(t *testing.T) {
+	RegisterTestingT(t)
+
+	var leaked bool
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("Authorization") != ""
+		_, _ = w.Write([]byte("[]"))
+	}))
+	t.Cleanup(other.Close)
+
+	server := newPortal(t, func(w http.ResponseWriter, _ *http.Request, page func(offset, limit int) []map[string]any) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s/users?page=2>; rel="next"`, other.URL))
+		_ = json.NewEncoder(w).Encode(page(0, 2))
+	})
+
+	k, err := adapter.NewRestAdapter(&domain.Config{Rest: domain.RestConfig{
+		UsersURL:   server.URL + "/users",
+		Fields:     portalFields,
+		Auth:       domain.RestAuthConfig{Type: "bearer", Token: "portal-token"},
+		Pagination: domain.RestPaginationConfig{Style: "link"},
+	}})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(MatchError(ContainSubstring("leaves the origin")))
+	Expect(leaked).To(BeFalse())
+}
+
+func TestRestInvalidUsers(t *testing.T) {
+	RegisterTestingT(t)
+
+	users := []map[string]any{
+		{"login": "alice", "keys": []any{map[string]any{"value": "ssh-ed25519 AAAA alice"}}},
+	}
+
+	server := newPortal(t, func(w http.ResponseWriter, r *http.Request, _ func(offset, limit int) []map[string]any) {
+		if r.URL.Path == "/users/alice" {
+			_ = json.NewEncoder(w).Encode(users[0])
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(users)
+	})
+
+	cfg := domain.RestConfig{UsersURL: server.URL + "/users", Fields: portalFields}
+
+	k, err := adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(MatchError(ContainSubstring("malformed ssh key")))
+
+	cfg.UserURL = server.URL + "/users/{username}"
+	k, err = adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUser(context.Background(), "alice")
+	Expect(err).To(MatchError(ContainSubstring("malformed ssh key")))
+
+	// names which can not be served through NSS are rejected as well
+	users[0] = map[string]any{"login": "../root"}
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).To(MatchError(ContainSubstring("invalid username")))
+}
+
+func TestRestUser(t *testing.T) {
+	RegisterTestingT(t)
+
+	var paths []string
+
+	server := newPortal(t, func(w http.ResponseWriter, r *http.Request, _ func(offset, limit int) []map[string]any) {
+		paths = append(paths, r.URL.EscapedPath())
+
+		username := strings.TrimPrefix(r.URL.Path, "/users/")
+		if username == "ALICE" {
+			// case insensitive lookup
+			username = "alice"
+		}
+
+		user, found := lo.Find(portalUsers, func(item map[string]any) bool { return item["login"] == username })
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"user": user})
+	})
+
+	k, err := adapter.NewRestAdapter(&domain.Config{Rest: domain.RestConfig{
+		UsersURL: server.URL + "/users",
+		UserURL:  server.URL + "/users/{username}",
+		UserPath: "user",
+		Fields:   portalFields,
+	}})
+	Expect(err).To(BeNil())
+
+	alice, err := k.FetchUser(context.Background(), "alice")
+	Expect(err).To(BeNil())
+	Expect(alice.Fullname).To(Equal("Alice Liddell"))
+	Expect(alice.SshPublicKeys).To(HaveLen(2))
+
+	_, err = k.FetchUser(context.Background(), "ALICE")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	_, err = k.FetchUser(context.Background(), "../admin")
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+	Expect(paths).To(ContainElement("/users/..%2Fadmin"))
+}
+
+func TestRestClientCertificate(t *testing.T) {
+	RegisterTestingT(t)
+
+	cert, certPath, keyPath := testCertificate(t)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(lo.Must(x509.ParseCertificate(cert.Certificate[0])))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(portalUsers)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	cfg := domain.RestConfig{
+		UsersURL: server.URL + "/users",
+		Fields:   portalFields,
+		Auth:     domain.RestAuthConfig{CACert: certPath},
+	}
+
+	k, err := adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+	Expect(err).To(BeNil())
+
+	_, err = k.FetchUsers(context.Background())
+	Expect(err).NotTo(BeNil())
+
+	cfg.Auth.ClientCert = certPath
+	cfg.Auth.ClientKey = keyPath
+
+	k, err = adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+	Expect(err).To(BeNil())
+
+	users, err := k.FetchUsers(context.Background())
+	Expect(err).To(BeNil())
+	expectPortalUsers(users)
+}
+
+func TestRestConfig(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, cfg := range []domain.RestConfig{
+		{Fields: portalFields},
+		{UsersURL: "https://portal.example.com/users"},
+		{UsersURL: "https://portal.example.com/users", Fields: domain.RestFieldMapping{Username: "keys[x]"}},
+		{UsersURL: "https://portal.example.com/users", Fields: portalFields, Auth: domain.RestAuthConfig{Type: "digest"}},
+		{UsersURL: "https://portal.example.com/users", Fields: portalFields, Pagination: domain.RestPaginationConfig{Style: "cursor"}},
+		{UsersURL: "https://portal.example.com/users", Fields: portalFields, Pagination: domain.RestPaginationConfig{Style: "page"}},
+		{UsersURL: "https://portal.example.com/users", Fields: portalFields, Auth: domain.RestAuthConfig{ClientCert: "/nonexistent.pem"}},
+	} {
+		_, err := adapter.NewRestAdapter(&domain.Config{Rest: cfg})
+		Expect(err).NotTo(BeNil(), "%+v", cfg)
+	}
+}
@@ -0,0 +1,848 @@
+package adapter
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	// ScimSshSchema is the user extension holding the ssh public keys.
+	ScimSshSchema = "urn:sshkeyman:params:scim:schemas:extension:ssh:2.0:User"
+
+	scimListSchema     = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema    = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema    = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimProviderSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	DefaultScimBasePath = "/scim/v2"
+
+	// maxScimBody limits the size of request bodies.
+	maxScimBody = 1 << 20
+	// maxScimResults limits the resources returned by a listing.
+	maxScimResults = 1000
+)
+
+// scimUser is the User resource, the ssh keys are in the ScimSshSchema
+// extension. The groups are read only, memberships are managed through
+// the Group resource.
+type scimUser struct {
+	Schemas     []string     `json:"schemas"`
+	Id          string       `json:"id,omitempty"`
+	UserName    string       `json:"userName"`
+	Name        *scimName    `json:"name,omitempty"`
+	DisplayName string       `json:"displayName,omitempty"`
+	Active      *scimBool    `json:"active,omitempty"`
+	Groups      []scimMember `json:"groups,omitempty"`
+	Ssh         *scimSsh     `json:"urn:sshkeyman:params:scim:schemas:extension:ssh:2.0:User,omitempty"`
+	Meta        *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimSsh struct {
+	SshPublicKeys []scimSshKey `json:"sshPublicKeys,omitempty"`
+}
+
+// scimSshKey is an authorized_keys line with an optional validity window.
+type scimSshKey struct {
+	Value     string    `json:"value"`
+	NotBefore time.Time `json:"notBefore,omitzero"`
+	NotAfter  time.Time `json:"notAfter,omitzero"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	Id          string       `json:"id,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+	Meta        *scimMeta    `json:"meta,omitempty"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+type scimList struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+type scimPatch struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// scimBool also accepts "True" and "False", which some identity providers
+// send in PATCH operations.
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	var value any
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case bool:
+		*b = scimBool(value)
+	case string:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("malformed boolean %q", value)
+		}
+
+		*b = scimBool(parsed)
+	default:
+		return fmt.Errorf("malformed boolean %s", data)
+	}
+
+	return nil
+}
+
+// scimError is an error response, scimType is one of the error types of
+// RFC 7644 section 3.12.
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string {
+	return e.detail
+}
+
+func invalidValue(format string, args ...any) error {
+	return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: fmt.Sprintf(format, args...)}
+}
+
+// ScimHandler serves a SCIM 2.0 Users and Groups endpoint, so identity
+// providers can push changes instead of waiting for the next sync. The
+// resources are stored through the service with the scim origin and are
+// left alone by Sync.
+type ScimHandler struct {
+	BasePath string
+
+	srv   domain.IService
+	token []byte
+	mux   *http.ServeMux
+
+	// mu serializes the writes, ids and names are checked before storing
+	mu sync.Mutex
+}
+
+func NewScimHandler(config *domain.Config, srv domain.IService) (*ScimHandler, error) {
+	cfg := config.Scim
+
+	token := cfg.Token
+
+	if cfg.TokenFile != "" {
+		content, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("scim token: %w", err)
+		}
+
+		token = strings.TrimSpace(string(content))
+	}
+
+	if token == "" {
+		return nil, errors.New("scim token is not set")
+	}
+
+	h := &ScimHandler{
+		BasePath: strings.TrimSuffix(lo.CoalesceOrEmpty(cfg.BasePath, DefaultScimBasePath), "/"),
+		srv:      srv,
+		token:    []byte(token),
+		mux:      http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("GET "+h.BasePath+"/Users", h.listUsers)
+	h.mux.HandleFunc("POST "+h.BasePath+"/Users", h.createUser)
+	h.mux.HandleFunc("GET "+h.BasePath+"/Users/{id}", h.getUser)
+	h.mux.HandleFunc("PUT "+h.BasePath+"/Users/{id}", h.replaceUser)
+	h.mux.HandleFunc("PATCH "+h.BasePath+"/Users/{id}", h.patchUser)
+	h.mux.HandleFunc("DELETE "+h.BasePath+"/Users/{id}", h.deleteUser)
+	h.mux.HandleFunc("GET "+h.BasePath+"/Groups", h.listGroups)
+	h.mux.HandleFunc("POST "+h.BasePath+"/Groups", h.createGroup)
+	h.mux.HandleFunc("GET "+h.BasePath+"/Groups/{id}", h.getGroup)
+	h.mux.HandleFunc("PUT "+h.BasePath+"/Groups/{id}", h.replaceGroup)
+	h.mux.HandleFunc("PATCH "+h.BasePath+"/Groups/{id}", h.patchGroup)
+	h.mux.HandleFunc("DELETE "+h.BasePath+"/Groups/{id}", h.deleteGroup)
+	h.mux.HandleFunc("GET "+h.BasePath+"/ServiceProviderConfig", h.serviceProviderConfig)
+
+	return h, nil
+}
+
+func (h *ScimHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), h.token) != 1 {
+		log.Warn().Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("scim request without valid token")
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sshkeyman"`)
+		h.fail(w, &scimError{status: http.StatusUnauthorized, detail: "invalid bearer token"})
+
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxScimBody)
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *ScimHandler) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.srv.ProvisionedUsers(r.Context())
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	attribute, value, err := parseScimFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	switch strings.ToLower(attribute) {
+	case "":
+	case "username":
+		users = lo.Filter(users, func(item domain.KeyDto, _ int) bool { return item.User.Username == value })
+	case "id":
+		users = lo.Filter(users, func(item domain.KeyDto, _ int) bool { return item.BackendId == value })
+	default:
+		h.fail(w, &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "unsupported filter attribute " + attribute})
+		return
+	}
+
+	h.list(w, r, len(users), func(i int) (any, error) {
+		return h.toUser(r.Context(), users[i])
+	})
+}
+
+func (h *ScimHandler) getUser(w http.ResponseWriter, r *http.Request) {
+	user, err := h.findUser(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeUser(w, r, http.StatusOK, user)
+}
+
+func (h *ScimHandler) createUser(w http.ResponseWriter, r *http.Request) {
+	var resource scimUser
+
+	if err := decodeScim(r, &resource); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, err := newScimId()
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	user, err := h.storeUser(r.Context(), id, resource)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeUser(w, r, http.StatusCreated, user)
+}
+
+func (h *ScimHandler) replaceUser(w http.ResponseWriter, r *http.Request) {
+	var resource scimUser
+
+	if err := decodeScim(r, &resource); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	existing, err := h.findUser(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	user, err := h.storeUser(r.Context(), existing.BackendId, resource)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeUser(w, r, http.StatusOK, user)
+}
+
+func (h *ScimHandler) patchUser(w http.ResponseWriter, r *http.Request) {
+	var patch scimPatch
+
+	if err := decodeScim(r, &patch); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	existing, err := h.findUser(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	current, err := h.toUser(r.Context(), existing)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	var resource scimUser
+
+	if err := applyScimPatch(current, patch, &resource); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	user, err := h.storeUser(r.Context(), existing.BackendId, resource)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeUser(w, r, http.StatusOK, user)
+}
+
+func (h *ScimHandler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	user, err := h.findUser(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	if err := h.srv.DeprovisionUser(r.Context(), user.User.Username); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ScimHandler) listGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := h.srv.ProvisionedGroups(r.Context())
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	attribute, value, err := parseScimFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	switch strings.ToLower(attribute) {
+	case "":
+	case "displayname":
+		groups = lo.Filter(groups, func(item domain.GroupDto, _ int) bool { return item.Group.Groupname == value })
+	case "id":
+		groups = lo.Filter(groups, func(item domain.GroupDto, _ int) bool { return item.BackendId == value })
+	default:
+		h.fail(w, &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "unsupported filter attribute " + attribute})
+		return
+	}
+
+	// identity providers exclude the members when looking up large groups
+	excludeMembers := lo.ContainsBy(strings.Split(r.URL.Query().Get("excludedAttributes"), ","), func(item string) bool {
+		return strings.EqualFold(strings.TrimSpace(item), "members")
+	})
+
+	h.list(w, r, len(groups), func(i int) (any, error) {
+		group, err := h.toGroup(r.Context(), groups[i])
+		if excludeMembers {
+			group.Members = nil
+		}
+
+		return group, err
+	})
+}
+
+func (h *ScimHandler) getGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := h.findGroup(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeGroup(w, r, http.StatusOK, group)
+}
+
+func (h *ScimHandler) createGroup(w http.ResponseWriter, r *http.Request) {
+	var resource scimGroup
+
+	if err := decodeScim(r, &resource); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, err := newScimId()
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	group, err := h.storeGroup(r.Context(), id, resource)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeGroup(w, r, http.StatusCreated, group)
+}
+
+func (h *ScimHandler) replaceGroup(w http.ResponseWriter, r *http.Request) {
+	var resource scimGroup
+
+	if err := decodeScim(r, &resource); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	existing, err := h.findGroup(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	group, err := h.storeGroup(r.Context(), existing.BackendId, resource)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeGroup(w, r, http.StatusOK, group)
+}
+
+func (h *ScimHandler) patchGroup(w http.ResponseWriter, r *http.Request) {
+	var patch scimPatch
+
+	if err := decodeScim(r, &patch); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	existing, err := h.findGroup(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	current, err := h.toGroup(r.Context(), existing)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	var resource scimGroup
+
+	if err := applyScimPatch(current, patch, &resource); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	group, err := h.storeGroup(r.Context(), existing.BackendId, resource)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	h.writeGroup(w, r, http.StatusOK, group)
+}
+
+func (h *ScimHandler) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	group, err := h.findGroup(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	if err := h.srv.DeprovisionGroup(r.Context(), group.Group.Groupname); err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ScimHandler) serviceProviderConfig(w http.ResponseWriter, _ *http.Request) {
+	supported := func(supported bool) map[string]any { return map[string]any{"supported": supported} }
+
+	h.write(w, http.StatusOK, map[string]any{
+		"schemas":        []string{scimProviderSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": maxScimResults},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "Static bearer token of the sshkeyman configuration",
+		}},
+	})
+}
+
+// storeUser validates the resource and provisions it with the given id.
+func (h *ScimHandler) storeUser(ctx context.Context, id string, resource scimUser) (domain.KeyDto, error) {
+	userDetail := domain.UserDetail{
+		Id:       id,
+		Username: resource.UserName,
+		Fullname: resource.DisplayName,
+		Disabled: resource.Active != nil && !bool(*resource.Active),
+	}
+
+	if name := resource.Name; userDetail.Fullname == "" && name != nil {
+		userDetail.Fullname = lo.CoalesceOrEmpty(name.Formatted, strings.TrimSpace(name.GivenName+" "+name.FamilyName))
+	}
+
+	if resource.Ssh != nil {
+		for _, key := range resource.Ssh.SshPublicKeys {
+			userDetail.SshPublicKeys = append(userDetail.SshPublicKeys, key.Value)
+			userDetail.SshKeyNotBefore = append(userDetail.SshKeyNotBefore, key.NotBefore)
+			userDetail.SshKeyNotAfter = append(userDetail.SshKeyNotAfter, key.NotAfter)
+		}
+	}
+
+	if err := validateUsers([]domain.UserDetail{userDetail}); err != nil {
+		return domain.KeyDto{}, invalidValue("%s", err)
+	}
+
+	return h.srv.ProvisionUser(ctx, userDetail)
+}
+
+// storeGroup validates the resource and provisions it with the given id,
+// the members must be provisioned users.
+func (h *ScimHandler) storeGroup(ctx context.Context, id string, resource scimGroup) (domain.GroupDto, error) {
+	if !validName(resource.DisplayName) {
+		return domain.GroupDto{}, invalidValue("invalid displayName %q", resource.DisplayName)
+	}
+
+	users, err := h.srv.ProvisionedUsers(ctx)
+	if err != nil {
+		return domain.GroupDto{}, err
+	}
+
+	var members []string
+
+	for _, member := range resource.Members {
+		user, found := lo.Find(users, func(item domain.KeyDto) bool { return item.BackendId == member.Value })
+		if !found {
+			return domain.GroupDto{}, invalidValue("member %q is not a provisioned user", member.Value)
+		}
+
+		members = append(members, user.User.Username)
+	}
+
+	return h.srv.ProvisionGroup(ctx, id, resource.DisplayName, members)
+}
+
+func (h *ScimHandler) findUser(ctx context.Context, id string) (domain.KeyDto, error) {
+	users, err := h.srv.ProvisionedUsers(ctx)
+	if err != nil {
+		return domain.KeyDto{}, err
+	}
+
+	user, found := lo.Find(users, func(item domain.KeyDto) bool { return item.BackendId == id })
+	if !found {
+		return domain.KeyDto{}, fmt.Errorf("user %s: %w", id, domain.ErrNotFound)
+	}
+
+	return user, nil
+}
+
+func (h *ScimHandler) findGroup(ctx context.Context, id string) (domain.GroupDto, error) {
+	groups, err := h.srv.ProvisionedGroups(ctx)
+	if err != nil {
+		return domain.GroupDto{}, err
+	}
+
+	group, found := lo.Find(groups, func(item domain.GroupDto) bool { return item.BackendId == id })
+	if !found {
+		return domain.GroupDto{}, fmt.Errorf("group %s: %w", id, domain.ErrNotFound)
+	}
+
+	return group, nil
+}
+
+// toUser builds the resource of a stored user. Rejected keys are returned
+// as well, so that the identity provider sees the keys it pushed.
+func (h *ScimHandler) toUser(ctx context.Context, user domain.KeyDto) (scimUser, error) {
+	groups, err := h.srv.UserGroups(ctx, user.User.Username)
+	if err != nil {
+		return scimUser{}, err
+	}
+
+	resource := scimUser{
+		Schemas:     []string{scimUserSchema, ScimSshSchema},
+		Id:          user.BackendId,
+		UserName:    user.User.Username,
+		DisplayName: user.User.Gecos,
+		Active:      lo.ToPtr(scimBool(!user.Locked())),
+		Ssh:         &scimSsh{},
+		Meta:        &scimMeta{ResourceType: "User", Location: h.BasePath + "/Users/" + user.BackendId},
+	}
+
+	if user.User.Gecos != "" {
+		resource.Name = &scimName{Formatted: user.User.Gecos}
+	}
+
+	for _, key := range user.SshKeys {
+		resource.Ssh.SshPublicKeys = append(resource.Ssh.SshPublicKeys, scimSshKey{
+			Value:     key.AuthorizedKey(),
+			NotBefore: key.NotBefore,
+			NotAfter:  key.NotAfter,
+		})
+	}
+
+	for _, key := range user.RejectedKeys {
+		resource.Ssh.SshPublicKeys = append(resource.Ssh.SshPublicKeys, scimSshKey{
+			Value:     key.Key,
+			NotBefore: key.NotBefore,
+			NotAfter:  key.NotAfter,
+		})
+	}
+
+	for _, group := range groups {
+		if group.Origin != domain.OriginScim {
+			continue
+		}
+
+		resource.Groups = append(resource.Groups, scimMember{
+			Value:   group.BackendId,
+			Ref:     h.BasePath + "/Groups/" + group.BackendId,
+			Display: group.Group.Groupname,
+		})
+	}
+
+	return resource, nil
+}
+
+func (h *ScimHandler) toGroup(ctx context.Context, group domain.GroupDto) (scimGroup, error) {
+	resource := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		Id:          group.BackendId,
+		DisplayName: group.Group.Groupname,
+		Meta:        &scimMeta{ResourceType: "Group", Location: h.BasePath + "/Groups/" + group.BackendId},
+	}
+
+	for _, username := range group.Group.Members {
+		user, err := h.srv.FindUser(ctx, domain.WithUsername(username))
+		if errors.Is(err, domain.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return scimGroup{}, err
+		}
+
+		resource.Members = append(resource.Members, scimMember{
+			Value:   user.BackendId,
+			Ref:     h.BasePath + "/Users/" + user.BackendId,
+			Display: username,
+		})
+	}
+
+	return resource, nil
+}
+
+func (h *ScimHandler) writeUser(w http.ResponseWriter, r *http.Request, status int, user domain.KeyDto) {
+	resource, err := h.toUser(r.Context(), user)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	w.Header().Set("Location", resource.Meta.Location)
+	h.write(w, status, resource)
+}
+
+func (h *ScimHandler) writeGroup(w http.ResponseWriter, r *http.Request, status int, group domain.GroupDto) {
+	resource, err := h.toGroup(r.Context(), group)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	w.Header().Set("Location", resource.Meta.Location)
+	h.write(w, status, resource)
+}
+
+// list writes the page of resources selected by startIndex and count,
+// resource builds the i-th resource.
+func (h *ScimHandler) list(w http.ResponseWriter, r *http.Request, total int, resource func(i int) (any, error)) {
+	start, err := scimIndex(r, "startIndex", 1)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	count, err := scimIndex(r, "count", maxScimResults)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+
+	start, count = max(start, 1), min(max(count, 0), maxScimResults)
+
+	response := scimList{
+		Schemas:      []string{scimListSchema},
+		TotalResults: total,
+		StartIndex:   start,
+		Resources:    []any{},
+	}
+
+	for i := start - 1; i < total && len(response.Resources) < count; i++ {
+		item, err := resource(i)
+		if err != nil {
+			h.fail(w, err)
+			return
+		}
+
+		response.Resources = append(response.Resources, item)
+	}
+
+	response.ItemsPerPage = len(response.Resources)
+
+	h.write(w, http.StatusOK, response)
+}
+
+func (h *ScimHandler) write(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Warn().Err(err).Msg("writing scim response")
+	}
+}
+
+// fail writes the error response of err.
+func (h *ScimHandler) fail(w http.ResponseWriter, err error) {
+	var response *scimError
+
+	switch {
+	case errors.As(err, &response):
+	case errors.Is(err, domain.ErrNotFound):
+		response = &scimError{status: http.StatusNotFound, detail: err.Error()}
+	case errors.Is(err, domain.ErrConflict):
+		response = &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: err.Error()}
+	default:
+		log.Err(err).Msg("scim request failed")
+		response = &scimError{status: http.StatusInternalServerError, detail: "internal error"}
+	}
+
+	body := map[string]any{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(response.status),
+		"detail":  response.detail,
+	}
+
+	if response.scimType != "" {
+		body["scimType"] = response.scimType
+	}
+
+	h.write(w, response.status, body)
+}
+
+func decodeScim(r *http.Request, out any) error {
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()}
+	}
+
+	return nil
+}
+
+func scimIndex(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	index, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, invalidValue("malformed %s %q", name, value)
+	}
+
+	return index, nil
+}
+
+// newScimId returns a random version 4 UUID.
+func newScimId() (string, error) {
+	var id [16]byte
+
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
@@ -0,0 +1,265 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	// scimFilter matches the only filter supported by the listings and
+	// value selection paths, an equality on a single attribute.
+	scimFilter = regexp.MustCompile(`(?i)^\s*([a-z][\w.$-]*)\s+eq\s+("(?:[^"\\]|\\.)*")\s*$`)
+	// scimPath matches an attribute path, with an optional value filter
+	// and sub attribute, e.g. members[value eq "42"] or name.givenName.
+	scimPath = regexp.MustCompile(`^([A-Za-z$][\w$-]*)(?:\[(.+)\])?(?:\.([A-Za-z$][\w$-]*))?$`)
+)
+
+// scimSchemas are the schema URNs accepted as path prefix, the core schemas
+// address the top level attributes.
+var scimSchemas = map[string]string{
+	scimUserSchema:  "",
+	scimGroupSchema: "",
+	ScimSshSchema:   ScimSshSchema,
+}
+
+// parseScimFilter parses an equality filter, an empty filter returns an
+// empty attribute.
+func parseScimFilter(filter string) (string, string, error) {
+	if strings.TrimSpace(filter) == "" {
+		return "", "", nil
+	}
+
+	match := scimFilter.FindStringSubmatch(filter)
+	if match == nil {
+		return "", "", &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: fmt.Sprintf("unsupported filter %q", filter)}
+	}
+
+	var value string
+
+	if err := json.Unmarshal([]byte(match[2]), &value); err != nil {
+		return "", "", &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: fmt.Sprintf("malformed filter value %s", match[2])}
+	}
+
+	return match[1], value, nil
+}
+
+// applyScimPatch applies the patch operations to the current resource and
+// decodes the result into out. The operations work on the JSON form of the
+// resource, attribute names are case insensitive.
+func applyScimPatch(current any, patch scimPatch, out any) error {
+	if !slices.Contains(patch.Schemas, scimPatchSchema) {
+		return invalidValue("missing schema %s", scimPatchSchema)
+	}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	var resource map[string]any
+
+	if err := json.Unmarshal(data, &resource); err != nil {
+		return err
+	}
+
+	for i, operation := range patch.Operations {
+		if err := applyScimOperation(resource, strings.ToLower(operation.Op), operation.Path, operation.Value); err != nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: fmt.Sprintf("operation %d: %s", i, err)}
+		}
+	}
+
+	if data, err = json.Marshal(resource); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return invalidValue("%s", err)
+	}
+
+	return nil
+}
+
+func applyScimOperation(resource map[string]any, op, path string, value any) error {
+	switch op {
+	case "add", "replace", "remove":
+	default:
+		return fmt.Errorf("unsupported op %q", op)
+	}
+
+	if path == "" {
+		if op == "remove" {
+			return fmt.Errorf("remove without path")
+		}
+
+		attributes, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s without path needs an object value", op)
+		}
+
+		// some identity providers send attribute paths as keys
+		for name, value := range attributes {
+			if err := applyScimOperation(resource, op, name, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return applyScimSchemaOperation(resource, op, path, value)
+	}
+
+	match := scimPath.FindStringSubmatch(path)
+	if match == nil {
+		return fmt.Errorf("malformed path %q", path)
+	}
+
+	attribute, filter, sub := match[1], match[2], match[3]
+	key := scimKey(resource, attribute)
+
+	if filter != "" {
+		return applyScimFilterOperation(resource, key, op, filter, sub, value)
+	}
+
+	if sub != "" {
+		child, ok := resource[key].(map[string]any)
+		if !ok {
+			if op == "remove" {
+				return nil
+			}
+
+			child = map[string]any{}
+			resource[key] = child
+		}
+
+		return applyScimOperation(child, op, sub, value)
+	}
+
+	switch op {
+	case "remove":
+		delete(resource, key)
+	case "replace":
+		resource[key] = value
+	case "add":
+		// values are added to multi-valued attributes
+		existing, multi := resource[key].([]any)
+		if !multi {
+			resource[key] = value
+			break
+		}
+
+		if values, ok := value.([]any); ok {
+			resource[key] = append(existing, values...)
+		} else {
+			resource[key] = append(existing, value)
+		}
+	}
+
+	return nil
+}
+
+// applyScimSchemaOperation applies an operation with a path prefixed by a
+// schema URN, e.g. the ssh keys of the extension.
+func applyScimSchemaOperation(resource map[string]any, op, path string, value any) error {
+	for schema, key := range scimSchemas {
+		if len(path) < len(schema) || !strings.EqualFold(path[:len(schema)], schema) {
+			continue
+		}
+
+		rest := path[len(schema):]
+
+		target := resource
+		if key != "" {
+			extension, ok := resource[scimKey(resource, key)].(map[string]any)
+			if !ok {
+				extension = map[string]any{}
+				resource[key] = extension
+			}
+
+			target = extension
+		}
+
+		switch {
+		case rest == "" && op == "remove" && key != "":
+			delete(resource, scimKey(resource, key))
+			return nil
+		case rest == "":
+			return applyScimOperation(target, op, "", value)
+		case strings.HasPrefix(rest, ":"):
+			return applyScimOperation(target, op, rest[1:], value)
+		}
+	}
+
+	return fmt.Errorf("unknown schema in path %q", path)
+}
+
+// applyScimFilterOperation applies an operation to the values of a
+// multi-valued attribute matching the filter.
+func applyScimFilterOperation(resource map[string]any, key, op, filter, sub string, value any) error {
+	attribute, expected, err := parseScimFilter(filter)
+	if err != nil {
+		return err
+	}
+
+	values, _ := resource[key].([]any)
+
+	var (
+		kept    []any
+		matched bool
+	)
+
+	for _, item := range values {
+		element, ok := item.(map[string]any)
+		if !ok || fmt.Sprint(element[scimKey(element, attribute)]) != expected {
+			kept = append(kept, item)
+			continue
+		}
+
+		matched = true
+
+		switch {
+		case op == "remove" && sub == "":
+			continue
+		case op == "remove":
+			delete(element, scimKey(element, sub))
+		case sub == "":
+			replacement, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s of %s needs an object value", op, key)
+			}
+
+			element = replacement
+		default:
+			element[scimKey(element, sub)] = value
+		}
+
+		kept = append(kept, element)
+	}
+
+	// removing a value which is already gone is not an error, identity
+	// providers retry operations
+	if !matched && op != "remove" {
+		return fmt.Errorf("no value of %s matches %s", key, filter)
+	}
+
+	resource[key] = kept
+
+	return nil
+}
+
+// scimKey returns the key of the attribute in the resource, compared case
+// insensitively, or the attribute name if it is not set.
+func scimKey(resource map[string]any, attribute string) string {
+	for key := range resource {
+		if strings.EqualFold(key, attribute) {
+			return key
+		}
+	}
+
+	return attribute
+}
@@ -0,0 +1,448 @@
+package adapter_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+
+	. "github.com/onsi/gomega"
+)
+
+const scimEcdsaKey = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBBrpEURt84wm0le8rqNQP6h2FXa43hE/CtihCJ8XOb7WlI6oKB0kI7TbtYz9plar1B3kat70Qw7iu4tYkZ+fOPM= alice@yubikey"
+
+type scimClient struct {
+	handler http.Handler
+	token   string
+}
+
+func newScimClient(t *testing.T, backend domain.Backend) (*scimClient, domain.IService) {
+	t.Helper()
+
+	db, err := adapter.NewBoldDB(filepath.Join(t.TempDir(), "users.db"), false)
+	if err != nil {
+		t.Fatalf("db open: %v", err)
+	}
+
+	t.Cleanup(func() { _ = db.Close() })
+
+	cfg := &domain.Config{
+		Nss:  domain.NSSConfig{MinUID: 10000, MinGID: 10000, GroupID: 1000, Shell: "/bin/bash"},
+		Home: "/home/%s",
+		Principals: domain.PrincipalsConfig{
+			Username:       lo.ToPtr(true),
+			Groups:         []string{"*"},
+			Prefix:         "group-",
+			SharedAccounts: map[string][]string{"deploy": {"ops"}},
+		},
+		Scim: domain.ScimConfig{Token: "idp-token"},
+	}
+
+	srv := domain.NewService(cfg, db, backend)
+
+	handler, err := adapter.NewScimHandler(cfg, srv)
+	if err != nil {
+		t.Fatalf("new scim handler: %v", err)
+	}
+
+	return &scimClient{handler: handler, token: "idp-token"}, srv
+}
+
+// do sends the request and returns the status and the decoded response.
+func (c *scimClient) do(method, path string, body any) (int, map[string]any) {
+	var payload bytes.Buffer
+
+	if body != nil {
+		Expect(json.NewEncoder(&payload).Encode(body)).To(Succeed())
+	}
+
+	r := httptest.NewRequest(method, "/scim/v2"+path, &payload)
+	r.Header.Set("Authorization", "Bearer "+c.token)
+
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, r)
+
+	var response map[string]any
+
+	if w.Body.Len() > 0 {
+		Expect(w.Header().Get("Content-Type")).To(Equal("application/scim+json"))
+		Expect(json.Unmarshal(w.Body.Bytes(), &response)).To(Succeed())
+	}
+
+	return w.Code, response
+}
+
+func patchOp(operations ...map[string]any) map[string]any {
+	return map[string]any{
+		"schemas":    []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"},
+		"Operations": operations,
+	}
+}
+
+func resources(response map[string]any) []map[string]any {
+	return lo.Map(response["Resources"].([]any), func(item any, _ int) map[string]any { return item.(map[string]any) })
+}
+
+func TestScimUsers(t *testing.T) {
+	RegisterTestingT(t)
+
+	client, srv := newScimClient(t, &staticBackend{})
+	ctx := context.Background()
+
+	status, alice := client.do(http.MethodPost, "/Users", map[string]any{
+		"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:User", adapter.ScimSshSchema},
+		"userName": "alice",
+		"name":     map[string]any{"givenName": "Alice", "familyName": "Liddell"},
+		"emails":   []any{map[string]any{"value": "alice@example.com", "primary": true}},
+		"active":   true,
+		adapter.ScimSshSchema: map[string]any{
+			"sshPublicKeys": []any{map[string]any{"value": execKey}},
+		},
+	})
+	Expect(status).To(Equal(http.StatusCreated))
+	Expect(alice["userName"]).To(Equal("alice"))
+	Expect(alice["displayName"]).To(Equal("Alice Liddell"))
+
+	id := alice["id"].(string)
+	Expect(id).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+
+	user, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(err).To(BeNil())
+	Expect(user.Origin).To(Equal(domain.OriginScim))
+	Expect(user.User.Gecos).To(Equal("Alice Liddell"))
+	Expect(user.SshKeys).To(HaveLen(1))
+
+	status, fetched := client.do(http.MethodGet, "/Users/"+id, nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(fetched[adapter.ScimSshSchema]).To(Equal(map[string]any{
+		"sshPublicKeys": []any{map[string]any{"value": execKey}},
+	}))
+
+	status, _ = client.do(http.MethodPost, "/Users", map[string]any{"userName": "bob"})
+	Expect(status).To(Equal(http.StatusCreated))
+
+	// filtering by userName
+	status, list := client.do(http.MethodGet, "/Users?filter="+url.QueryEscape(`userName eq "alice"`), nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(list["totalResults"]).To(BeEquivalentTo(1))
+	Expect(resources(list)[0]["id"]).To(Equal(id))
+
+	status, list = client.do(http.MethodGet, "/Users?filter="+url.QueryEscape(`userName eq "carol"`), nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(list["totalResults"]).To(BeEquivalentTo(0))
+	Expect(list["Resources"]).To(BeEmpty())
+
+	status, list = client.do(http.MethodGet, "/Users?startIndex=2&count=1", nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(list["totalResults"]).To(BeEquivalentTo(2))
+	Expect(list["itemsPerPage"]).To(BeEquivalentTo(1))
+	Expect(resources(list)[0]["userName"]).To(Equal("bob"))
+
+	// patching the keys and disabling the account the way Entra ID does
+	status, patched := client.do(http.MethodPatch, "/Users/"+id, patchOp(
+		map[string]any{
+			"op":    "add",
+			"path":  adapter.ScimSshSchema + ":sshPublicKeys",
+			"value": []any{map[string]any{"value": scimEcdsaKey, "notAfter": "2099-01-01T00:00:00Z"}},
+		},
+		map[string]any{
+			"op":   "remove",
+			"path": `urn:sshkeyman:params:scim:schemas:extension:ssh:2.0:User:sshPublicKeys[value eq "` + execKey + `"]`,
+		},
+		map[string]any{"op": "Replace", "value": map[string]any{"displayName": "Alice L."}},
+	))
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(patched["displayName"]).To(Equal("Alice L."))
+
+	user, err = srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(err).To(BeNil())
+	Expect(user.SshKeys).To(HaveLen(1))
+	Expect(user.SshKeys[0].AuthorizedKey()).To(Equal(scimEcdsaKey))
+	Expect(user.SshKeys[0].NotAfter.Year()).To(Equal(2099))
+
+	status, _ = client.do(http.MethodPatch, "/Users/"+id, patchOp(
+		map[string]any{"op": "Replace", "path": "active", "value": "False"},
+	))
+	Expect(status).To(Equal(http.StatusOK))
+
+	user, err = srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(err).To(BeNil())
+	Expect(user.Locked()).To(BeTrue())
+	Expect(user.SshKeys).To(BeEmpty())
+
+	// the keys of the disabled account keep their validity window
+	status, fetched = client.do(http.MethodGet, "/Users/"+id, nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(fetched[adapter.ScimSshSchema]).To(Equal(map[string]any{
+		"sshPublicKeys": []any{map[string]any{"value": scimEcdsaKey, "notAfter": "2099-01-01T00:00:00Z"}},
+	}))
+
+	status, _ = client.do(http.MethodPatch, "/Users/"+id, patchOp(
+		map[string]any{"op": "replace", "path": "active", "value": true},
+	))
+	Expect(status).To(Equal(http.StatusOK))
+
+	user, err = srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(err).To(BeNil())
+	Expect(user.Locked()).To(BeFalse())
+	Expect(user.SshKeys).To(HaveLen(1))
+	Expect(user.SshKeys[0].NotAfter).To(Equal(time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// renaming keeps the id and the uid
+	status, _ = client.do(http.MethodPut, "/Users/"+id, map[string]any{
+		"userName": "alice.liddell",
+		adapter.ScimSshSchema: map[string]any{
+			"sshPublicKeys": []any{map[string]any{"value": execKey}},
+		},
+	})
+	Expect(status).To(Equal(http.StatusOK))
+
+	renamed, err := srv.FindUser(ctx, domain.WithUsername("alice.liddell"))
+	Expect(err).To(BeNil())
+	Expect(renamed.User.UID).To(Equal(user.User.UID))
+
+	_, err = srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	status, _ = client.do(http.MethodDelete, "/Users/"+id, nil)
+	Expect(status).To(Equal(http.StatusNoContent))
+
+	status, response := client.do(http.MethodGet, "/Users/"+id, nil)
+	Expect(status).To(Equal(http.StatusNotFound))
+	Expect(response["status"]).To(Equal("404"))
+
+	_, err = srv.FindUser(ctx, domain.WithUsername("alice.liddell"))
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+}
+
+func TestScimGroups(t *testing.T) {
+	RegisterTestingT(t)
+
+	backend := &staticBackend{users: []domain.UserDetail{
+		{Id: "1", Username: "dave", SshPublicKeys: []string{execKey}, Groups: []string{"dev"}},
+	}}
+
+	client, srv := newScimClient(t, backend)
+	ctx := context.Background()
+
+	ids := map[string]string{}
+
+	for _, username := range []string{"alice", "bob"} {
+		status, user := client.do(http.MethodPost, "/Users", map[string]any{"userName": username})
+		Expect(status).To(Equal(http.StatusCreated))
+
+		ids[username] = user["id"].(string)
+	}
+
+	status, group := client.do(http.MethodPost, "/Groups", map[string]any{
+		"displayName": "ops",
+		"members":     []any{map[string]any{"value": ids["alice"]}},
+	})
+	Expect(status).To(Equal(http.StatusCreated))
+
+	id := group["id"].(string)
+
+	alice, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(err).To(BeNil())
+	Expect(alice.Principals).To(Equal([]string{"alice", "group-ops"}))
+
+	status, user := client.do(http.MethodGet, "/Users/"+ids["alice"], nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(user["groups"]).To(HaveLen(1))
+
+	// member changes the way Entra ID sends them
+	status, _ = client.do(http.MethodPatch, "/Groups/"+id, patchOp(
+		map[string]any{"op": "Add", "path": "members", "value": []any{map[string]any{"value": ids["bob"]}}},
+		map[string]any{"op": "Remove", "path": `members[value eq "` + ids["alice"] + `"]`},
+	))
+	Expect(status).To(Equal(http.StatusOK))
+
+	members, err := srv.FindGroup(ctx, domain.WithGroupname("ops"))
+	Expect(err).To(BeNil())
+	Expect(members.Group.Members).To(Equal([]string{"bob"}))
+
+	alice, err = srv.FindUser(ctx, domain.WithUsername("alice"))
+	Expect(err).To(BeNil())
+	Expect(alice.Principals).To(Equal([]string{"alice"}))
+
+	status, list := client.do(http.MethodGet, "/Groups?excludedAttributes=members&filter="+url.QueryEscape(`displayName eq "ops"`), nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(resources(list)).To(HaveLen(1))
+	Expect(resources(list)[0]).NotTo(HaveKey("members"))
+
+	// renaming with the replace Okta sends
+	status, _ = client.do(http.MethodPatch, "/Groups/"+id, patchOp(
+		map[string]any{"op": "replace", "value": map[string]any{"id": id, "displayName": "sre"}},
+	))
+	Expect(status).To(Equal(http.StatusOK))
+
+	renamed, err := srv.FindGroup(ctx, domain.WithGroupname("sre"))
+	Expect(err).To(BeNil())
+	Expect(renamed.Group.GID).To(Equal(members.Group.GID))
+
+	_, err = srv.FindGroup(ctx, domain.WithGroupname("ops"))
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+
+	// a sync keeps the pushed users and groups
+	Expect(srv.Sync(ctx)).To(Succeed())
+
+	for _, username := range []string{"alice", "bob", "dave"} {
+		_, err := srv.FindUser(ctx, domain.WithUsername(username))
+		Expect(err).To(BeNil(), username)
+	}
+
+	_, err = srv.FindGroup(ctx, domain.WithGroupname("sre"))
+	Expect(err).To(BeNil())
+
+	// groups of the backend are not served
+	status, list = client.do(http.MethodGet, "/Groups", nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(list["totalResults"]).To(BeEquivalentTo(1))
+
+	status, _ = client.do(http.MethodPost, "/Groups", map[string]any{"displayName": "dev"})
+	Expect(status).To(Equal(http.StatusConflict))
+
+	// deleting a member removes it from the group
+	status, _ = client.do(http.MethodDelete, "/Users/"+ids["bob"], nil)
+	Expect(status).To(Equal(http.StatusNoContent))
+
+	renamed, err = srv.FindGroup(ctx, domain.WithGroupname("sre"))
+	Expect(err).To(BeNil())
+	Expect(renamed.Group.Members).To(BeEmpty())
+
+	status, _ = client.do(http.MethodDelete, "/Groups/"+id, nil)
+	Expect(status).To(Equal(http.StatusNoContent))
+
+	_, err = srv.FindGroup(ctx, domain.WithGroupname("sre"))
+	Expect(errors.Is(err, domain.ErrNotFound)).To(BeTrue())
+}
+
+func TestScimRejected(t *testing.T) {
+	RegisterTestingT(t)
+
+	backend := &staticBackend{users: []domain.UserDetail{
+		{Id: "1", Username: "dave", SshPublicKeys: []string{execKey}},
+	}}
+
+	client, srv := newScimClient(t, backend)
+	Expect(srv.Sync(context.Background())).To(Succeed())
+
+	status, _ := client.do(http.MethodPost, "/Users", map[string]any{"userName": "alice"})
+	Expect(status).To(Equal(http.StatusCreated))
+
+	for name, tc := range map[string]struct {
+		method, path string
+		body         any
+		status       int
+		scimType     string
+	}{
+		"duplicate": {
+			http.MethodPost, "/Users",
+			map[string]any{"userName": "alice"},
+			http.StatusConflict, "uniqueness",
+		},
+		"backend user": {
+			http.MethodPost, "/Users",
+			map[string]any{"userName": "dave"},
+			http.StatusConflict, "uniqueness",
+		},
+		"invalid username": {
+			http.MethodPost, "/Users",
+			map[string]any{"userName": "root:x:0:0"},
+			http.StatusBadRequest, "invalidValue",
+		},
+		"malformed key": {
+			http.MethodPost, "/Users",
+			map[string]any{
+				"userName":            "carol",
+				adapter.ScimSshSchema: map[string]any{"sshPublicKeys": []any{map[string]any{"value": "ssh-ed25519 garbage"}}},
+			},
+			http.StatusBadRequest, "invalidValue",
+		},
+		"malformed body": {
+			http.MethodPost, "/Users", "userName=carol",
+			http.StatusBadRequest, "invalidSyntax",
+		},
+		"unknown member": {
+			http.MethodPost, "/Groups",
+			map[string]any{"displayName": "ops", "members": []any{map[string]any{"value": "1"}}},
+			http.StatusBadRequest, "invalidValue",
+		},
+		"unsupported filter": {
+			http.MethodGet, "/Users?filter=" + url.QueryEscape(`userName sw "a"`), nil,
+			http.StatusBadRequest, "invalidFilter",
+		},
+		"unsupported filter attribute": {
+			http.MethodGet, "/Users?filter=" + url.QueryEscape(`emails eq "alice@example.com"`), nil,
+			http.StatusBadRequest, "invalidFilter",
+		},
+		"unknown user": {
+			http.MethodPatch, "/Users/unknown", patchOp(map[string]any{"op": "replace", "path": "active", "value": false}),
+			http.StatusNotFound, "",
+		},
+	} {
+		status, response := client.do(tc.method, tc.path, tc.body)
+		Expect(status).To(Equal(tc.status), name)
+		Expect(response["schemas"]).To(Equal([]any{"urn:ietf:params:scim:api:messages:2.0:Error"}), name)
+
+		if tc.scimType != "" {
+			Expect(response["scimType"]).To(Equal(tc.scimType), name)
+		}
+	}
+
+	// users of the backend are not served
+	status, list := client.do(http.MethodGet, "/Users", nil)
+	Expect(status).To(Equal(http.StatusOK))
+	Expect(list["totalResults"]).To(BeEquivalentTo(1))
+
+	client.token = "wrong"
+
+	status, _ = client.do(http.MethodGet, "/Users", nil)
+	Expect(status).To(Equal(http.StatusUnauthorized))
+}
+
+func TestScimPatchRejected(t *testing.T) {
+	RegisterTestingT(t)
+
+	client, _ := newScimClient(t, &staticBackend{})
+
+	status, user := client.do(http.MethodPost, "/Users", map[string]any{"userName": "alice"})
+	Expect(status).To(Equal(http.StatusCreated))
+
+	id := user["id"].(string)
+
+	for name, patch := range map[string]map[string]any{
+		"schema":      {"Operations": []any{map[string]any{"op": "replace", "path": "active", "value": false}}},
+		"op":          patchOp(map[string]any{"op": "move", "path": "active"}),
+		"remove":      patchOp(map[string]any{"op": "remove"}),
+		"path":        patchOp(map[string]any{"op": "replace", "path": "name..givenName", "value": "Alice"}),
+		"schema path": patchOp(map[string]any{"op": "replace", "path": "urn:example:User:shell", "value": "/bin/sh"}),
+		"no match":    patchOp(map[string]any{"op": "replace", "path": `emails[value eq "a"]`, "value": map[string]any{}}),
+		"boolean":     patchOp(map[string]any{"op": "replace", "path": "active", "value": "maybe"}),
+		"username":    patchOp(map[string]any{"op": "remove", "path": "userName"}),
+	} {
+		status, _ := client.do(http.MethodPatch, "/Users/"+id, patch)
+		Expect(status).To(Equal(http.StatusBadRequest), name)
+	}
+}
+
+func TestScimConfig(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := adapter.NewScimHandler(&domain.Config{}, nil)
+	Expect(err).To(MatchError("scim token is not set"))
+
+	_, err = adapter.NewScimHandler(&domain.Config{Scim: domain.ScimConfig{TokenFile: "/nonexistent/token"}}, nil)
+	Expect(err).NotTo(BeNil())
+}
@@ -2,20 +2,118 @@ package domain
 
 import (
 	"context"
+	"fmt"
+	"time"
 )
 
 type UserDetail struct {
-	Id           string
-	Username     string
-	Fullname     string
-	SshPublicKey string
+	Id       string
+	Username string
+	Fullname string
+	// SshPublicKeys holds every authorized_keys line of the user
+	SshPublicKeys []string
+	// SshKeyNotBefore and SshKeyNotAfter hold the validity window of the key
+	// with the same index in SshPublicKeys, missing or zero entries leave the
+	// key unrestricted
+	SshKeyNotBefore []time.Time
+	SshKeyNotAfter  []time.Time
+	Groups          []string
+	// Roles holds the realm roles of the user, if the backend has roles
+	Roles []string
+	// Disabled is set for accounts which are disabled in the backend
+	Disabled bool
+	// RevokedBefore invalidates every credential issued before it, zero
+	// means nothing was revoked
+	RevokedBefore time.Time
+	// ExpiresAt is the account expiry, zero means the account never expires
+	ExpiresAt time.Time
+	// UID, GID, Shell and Home are set when the backend defines them, zero
+	// values fall back to the configured defaults
+	UID   uint
+	GID   uint
+	Shell string
+	Home  string
+	// Backend names the backend of a composite backend the user is served
+	// from
+	Backend string
+}
+
+// KeyWindow returns the validity window of the i-th key.
+func (u UserDetail) KeyWindow(i int) (notBefore, notAfter time.Time) {
+	if i < len(u.SshKeyNotBefore) {
+		notBefore = u.SshKeyNotBefore[i]
+	}
+
+	if i < len(u.SshKeyNotAfter) {
+		notAfter = u.SshKeyNotAfter[i]
+	}
+
+	return notBefore, notAfter
+}
+
+// ParseDate parses the dates accepted in backend attributes and on the
+// command line, RFC 3339 timestamps or YYYY-MM-DD.
+func ParseDate(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("malformed date %q, expected RFC 3339 or YYYY-MM-DD", value)
 }
 
 type TokenDetail struct {
-	AuthToken string `json:"access_token"`
+	AuthToken        string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
 }
 
 type Backend interface {
 	FetchUser(ctx context.Context, username string) (UserDetail, error)
 	FetchUsers(ctx context.Context) ([]UserDetail, error)
 }
+
+// PartialError is returned by FetchUsers together with the users of the
+// sources which answered when others failed. Failed names the failed
+// sources, the sync keeps the stored users served from them.
+type PartialError struct {
+	Failed []string
+	Err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("partial user listing: %s", e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// ChangeTracker is implemented by backends able to report the users changed
+// since a cursor, allowing an incremental sync between full syncs.
+type ChangeTracker interface {
+	// ChangeCursor returns the cursor of the latest change.
+	ChangeCursor(ctx context.Context) (string, error)
+	// FetchChanges returns the changes after cursor.
+	FetchChanges(ctx context.Context, cursor string) (Changes, error)
+}
+
+// Changes are the users changed since a cursor.
+type Changes struct {
+	// Users holds the current state of the changed users
+	Users []UserDetail
+	// Removed holds the ids of the deleted users and of the users which no
+	// longer have access
+	Removed []string
+	// Cursor is passed to the next FetchChanges call
+	Cursor string
+}
+
+// TokenVerifier is implemented by backends able to authenticate a user by
+// an access token issued by the identity provider.
+type TokenVerifier interface {
+	// VerifyToken returns the username the token was issued to.
+	VerifyToken(ctx context.Context, token string) (string, error)
+}
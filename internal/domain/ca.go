@@ -0,0 +1,270 @@
+package domain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultCertValidity is used when the validity is not configured.
+const defaultCertValidity = 8 * time.Hour
+
+// IssueCertificate implements IService. The user authenticates either with a
+// key already known for the user or with an identity provider token, the
+// certificate is issued for the given public key with the login name and
+// the shared account principals of the user.
+func (s *Service) IssueCertificate(ctx context.Context, username, publicKey, token string) (string, error) {
+	if s.cfg.CA.KeyPath == "" {
+		return "", ErrCADisabled
+	}
+
+	user, err := s.db.ReadUser(ctx, username)
+	if err != nil {
+		return "", fmt.Errorf("read user: %w", err)
+	}
+
+	key, err := ParseSshKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.authorizeCertificate(ctx, user, key, token); err != nil {
+		return "", err
+	}
+
+	if user.Locked() || user.Expired(time.Now()) {
+		return "", fmt.Errorf("%w: account is locked", ErrUnauthorized)
+	}
+
+	groups, err := s.UserGroups(ctx, username)
+	if err != nil {
+		return "", fmt.Errorf("user groups: %w", err)
+	}
+
+	// the key policy applies to certified keys as it does to stored keys
+	groupNames := lo.Map(groups, func(item GroupDto, _ int) string {
+		return item.Group.Groupname
+	})
+
+	if err := s.cfg.KeyPolicy.Check(key, groupNames); err != nil {
+		return "", err
+	}
+
+	// only the login name and principals mapped to a shared account are
+	// certified, stored principals may predate a change of the mapping
+	principals := lo.Filter(user.Principals, func(item string, _ int) bool {
+		return (item == username && lo.FromPtr(s.cfg.Principals.Username)) || s.cfg.Principals.Shared(item)
+	})
+
+	if len(principals) == 0 {
+		// a certificate without principals is valid for every user
+		return "", fmt.Errorf("%w: user has no principals", ErrUnauthorized)
+	}
+
+	signer, err := s.caSigner()
+	if err != nil {
+		return "", err
+	}
+
+	pub, err := key.PublicKey()
+	if err != nil {
+		return "", err
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return "", fmt.Errorf("serial: %w", err)
+	}
+
+	validity := defaultCertValidity
+	if s.cfg.CA.ValidityHours > 0 {
+		validity = time.Duration(s.cfg.CA.ValidityHours) * time.Hour
+	}
+
+	now := time.Now()
+	record := CertDto{
+		Serial:      binary.BigEndian.Uint64(serial[:]),
+		Username:    username,
+		Fingerprint: key.Fingerprint,
+		Principals:  principals,
+		// tolerate clock skew between the daemon and the ssh servers
+		ValidAfter:  now.Add(-5 * time.Minute),
+		ValidBefore: now.Add(validity),
+		IssuedAt:    now,
+	}
+	record.KeyId = fmt.Sprintf("sshkeyman:%s:%d", username, record.Serial)
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          record.Serial,
+		CertType:        ssh.UserCert,
+		KeyId:           record.KeyId,
+		ValidPrincipals: record.Principals,
+		ValidAfter:      uint64(record.ValidAfter.Unix()),
+		ValidBefore:     uint64(record.ValidBefore.Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{},
+			Extensions:      map[string]string{},
+		},
+	}
+
+	for _, extension := range s.cfg.CA.Extensions {
+		cert.Extensions[extension] = ""
+	}
+
+	if s.cfg.CA.ForceCommand != "" {
+		cert.CriticalOptions["force-command"] = s.cfg.CA.ForceCommand
+	}
+
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return "", fmt.Errorf("sign certificate: %w", err)
+	}
+
+	if err := s.db.CreateCert(ctx, record); err != nil {
+		return "", fmt.Errorf("backend write: %w", err)
+	}
+
+	log.Info().Str("user", username).Uint64("serial", record.Serial).Strs("principals", record.Principals).Msg("certificate issued")
+
+	return string(ssh.MarshalAuthorizedKey(cert)), nil
+}
+
+// ListCertificates implements IService.
+func (s *Service) ListCertificates(ctx context.Context) ([]CertDto, error) {
+	return s.db.ListCerts(ctx)
+}
+
+// RevokeCertificate implements IService. Revoked serials are exported for
+// sshd's RevokedKeys through a key revocation list.
+func (s *Service) RevokeCertificate(ctx context.Context, serial uint64) error {
+	cert, err := s.db.ReadCert(ctx, serial)
+	if err != nil {
+		return err
+	}
+
+	cert.Revoked = true
+
+	if err := s.db.CreateCert(ctx, cert); err != nil {
+		return fmt.Errorf("backend write: %w", err)
+	}
+
+	log.Info().Str("user", cert.Username).Uint64("serial", serial).Msg("certificate revoked")
+
+	return nil
+}
+
+// revokeCertificates revokes the certificates of disabled users and the
+// certificates issued before the revocation time of the user.
+func (s *Service) revokeCertificates(ctx context.Context, users []UserDetail) error {
+	revokedBefore := map[string]time.Time{}
+
+	for _, user := range users {
+		switch {
+		case user.Disabled:
+			revokedBefore[user.Username] = time.Now()
+		case !user.RevokedBefore.IsZero():
+			revokedBefore[user.Username] = user.RevokedBefore
+		}
+	}
+
+	if len(revokedBefore) == 0 {
+		return nil
+	}
+
+	certs, err := s.db.ListCerts(ctx)
+	if err != nil {
+		return fmt.Errorf("backend read: %w", err)
+	}
+
+	for _, cert := range certs {
+		before, ok := revokedBefore[cert.Username]
+		if !ok || cert.Revoked || !cert.ValidBefore.After(time.Now()) {
+			continue
+		}
+
+		issuedAt := cert.IssuedAt
+		if issuedAt.IsZero() {
+			issuedAt = cert.ValidAfter
+		}
+
+		if issuedAt.After(before) {
+			continue
+		}
+
+		if err := s.RevokeCertificate(ctx, cert.Serial); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authorizeCertificate checks that the requester owns the account, either
+// the key is a currently valid key of the user or the token was issued to
+// the user.
+func (s *Service) authorizeCertificate(ctx context.Context, user KeyDto, key SshKey, token string) error {
+	if token == "" {
+		if lo.ContainsBy(user.ValidKeys(time.Now()), func(item SshKey) bool {
+			return item.Fingerprint == key.Fingerprint
+		}) {
+			return nil
+		}
+
+		return fmt.Errorf("%w: key %s is not a key of %s", ErrUnauthorized, key.Fingerprint, user.User.Username)
+	}
+
+	verifier, ok := s.keycloak.(TokenVerifier)
+	if !ok {
+		return fmt.Errorf("%w: backend does not support tokens", ErrUnauthorized)
+	}
+
+	username, err := verifier.VerifyToken(ctx, token)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+
+	if username != user.User.Username {
+		return fmt.Errorf("%w: token of %s", ErrUnauthorized, username)
+	}
+
+	return nil
+}
+
+// caSigner loads the CA key, it is read on every use so that the key can be
+// rotated without restarting the daemon.
+func (s *Service) caSigner() (ssh.Signer, error) {
+	pem, err := os.ReadFile(s.cfg.CA.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read ca key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("parse ca key: %w", err)
+	}
+
+	return signer, nil
+}
+
+// KRL formats the revoked certificates as an ssh-keygen key revocation list
+// specification, see ssh-keygen(1) -k.
+func KRL(certs []CertDto) string {
+	var ret strings.Builder
+
+	for _, cert := range certs {
+		if cert.Revoked {
+			ret.WriteString("serial: " + strconv.FormatUint(cert.Serial, 10) + "\n")
+		}
+	}
+
+	return ret.String()
+}
@@ -0,0 +1,240 @@
+package domain_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/protosam/go-libnss/structs"
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestCA writes a fresh CA key and returns its path and public key.
+func newTestCA(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+
+	pub, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(private, "test ca")
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	caPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+
+	return path, caPub
+}
+
+func TestIssueCertificate(t *testing.T) {
+	ctx := context.Background()
+	caPath, caPub := newTestCA(t)
+
+	cfg := newTestConfig()
+	cfg.Principals.Username = lo.ToPtr(true)
+	cfg.CA = domain.CAConfig{KeyPath: caPath, ValidityHours: 1, Extensions: []string{"permit-pty"}}
+
+	srv := newTestService(t, cfg, &fakeBackend{tokens: map[string]string{"alice-token": "alice"}})
+
+	key, err := domain.ParseSshKey(testEd25519Key)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+
+	err = srv.AddUser(ctx, domain.KeyDto{User: structs.Passwd{Username: "alice"}, SshKeys: []domain.SshKey{key}})
+	if err != nil {
+		t.Fatalf("add user: %v", err)
+	}
+
+	line, err := srv.IssueCertificate(ctx, "alice", testEd25519Key, "")
+	if err != nil {
+		t.Fatalf("issue certificate: %v", err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+
+	cert := pub.(*ssh.Certificate)
+
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(caPub.Marshal())
+		},
+	}
+	if err := checker.CheckCert("alice", cert); err != nil {
+		t.Fatalf("certificate not valid for alice: %v", err)
+	}
+
+	if _, has := cert.Extensions["permit-pty"]; !has {
+		t.Fatalf("missing extension: %v", cert.Extensions)
+	}
+
+	// unknown keys need a token of the user
+	_, err = srv.IssueCertificate(ctx, "alice", testEcdsaKey, "")
+	if !errors.Is(err, domain.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	_, err = srv.IssueCertificate(ctx, "alice", testEcdsaKey, "bob-token")
+	if !errors.Is(err, domain.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	if _, err = srv.IssueCertificate(ctx, "alice", testEcdsaKey, "alice-token"); err != nil {
+		t.Fatalf("issue certificate with token: %v", err)
+	}
+
+	certs, err := srv.ListCertificates(ctx)
+	if err != nil || len(certs) != 2 {
+		t.Fatalf("expected 2 recorded certificates: %v %v", certs, err)
+	}
+
+	if err := srv.RevokeCertificate(ctx, cert.Serial); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+
+	certs, _ = srv.ListCertificates(ctx)
+	if krl := domain.KRL(certs); !strings.Contains(krl, "serial: ") || strings.Count(krl, "\n") != 1 {
+		t.Fatalf("unexpected revocation list: %q", krl)
+	}
+}
+
+func TestIssueCertificatePrincipals(t *testing.T) {
+	ctx := context.Background()
+	caPath, _ := newTestCA(t)
+
+	cfg := newTestConfig()
+	cfg.Principals = domain.PrincipalsConfig{
+		Username:       lo.ToPtr(true),
+		Groups:         []string{"*"},
+		Prefix:         "group-",
+		SharedAccounts: map[string][]string{"deploy": {"admins"}},
+	}
+	cfg.CA = domain.CAConfig{KeyPath: caPath}
+
+	srv := newTestService(t, cfg, &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"admins", "developers"}},
+		},
+	})
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	principals := func() []string {
+		line, err := srv.IssueCertificate(ctx, "alice", testEd25519Key, "")
+		if err != nil {
+			t.Fatalf("issue certificate: %v", err)
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			t.Fatalf("parse certificate: %v", err)
+		}
+
+		return pub.(*ssh.Certificate).ValidPrincipals
+	}
+
+	if got := principals(); strings.Join(got, ",") != "alice,group-admins" {
+		t.Fatalf("unexpected principals: %v", got)
+	}
+
+	// principals stored before the mapping changed are not certified
+	cfg.Principals.SharedAccounts = nil
+
+	if got := principals(); strings.Join(got, ",") != "alice" {
+		t.Fatalf("unexpected principals after unmapping: %v", got)
+	}
+}
+
+func TestIssueCertificateKeyPolicy(t *testing.T) {
+	ctx := context.Background()
+	caPath, _ := newTestCA(t)
+
+	cfg := newTestConfig()
+	cfg.Principals.Username = lo.ToPtr(true)
+	cfg.CA = domain.CAConfig{KeyPath: caPath}
+
+	srv := newTestService(t, cfg, &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"admins"}},
+		},
+		tokens: map[string]string{"alice-token": "alice"},
+	})
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	cfg.KeyPolicy = domain.KeyPolicyConfig{AllowedAlgorithms: []string{"ssh-ed25519"}}
+
+	_, err := srv.IssueCertificate(ctx, "alice", testEcdsaKey, "alice-token")
+	if !errors.Is(err, domain.ErrKeyPolicy) {
+		t.Fatalf("expected key policy error, got %v", err)
+	}
+
+	// the groups of the user are taken into account
+	cfg.KeyPolicy = domain.KeyPolicyConfig{RequireSkGroups: []string{"admins"}}
+
+	_, err = srv.IssueCertificate(ctx, "alice", testEd25519Key, "")
+	if !errors.Is(err, domain.ErrKeyPolicy) {
+		t.Fatalf("expected key policy error for admins, got %v", err)
+	}
+}
+
+func TestIssueCertificateExpired(t *testing.T) {
+	ctx := context.Background()
+	caPath, _ := newTestCA(t)
+
+	cfg := newTestConfig()
+	cfg.Principals.Username = lo.ToPtr(true)
+	cfg.CA = domain.CAConfig{KeyPath: caPath}
+
+	srv := newTestService(t, cfg, &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, ExpiresAt: time.Now().AddDate(0, 0, -2)},
+		},
+		tokens: map[string]string{"alice-token": "alice"},
+	})
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	// the token proves the ownership, the account still expired
+	_, err := srv.IssueCertificate(ctx, "alice", testEd25519Key, "alice-token")
+	if !errors.Is(err, domain.ErrUnauthorized) || !strings.Contains(err.Error(), "locked") {
+		t.Fatalf("expected locked account, got %v", err)
+	}
+}
+
+func TestIssueCertificateDisabled(t *testing.T) {
+	srv := newTestService(t, newTestConfig(), &fakeBackend{})
+
+	_, err := srv.IssueCertificate(context.Background(), "alice", testEd25519Key, "")
+	if !errors.Is(err, domain.ErrCADisabled) {
+		t.Fatalf("expected disabled ca, got %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+)
+
+// stateChangeCursor stores the backend change cursor of the last sync.
+const stateChangeCursor = "change_cursor"
+
+// SyncChanges implements IService. It applies the users changed in the
+// backend since the last sync, backends without change tracking and the
+// first sync fall back to a full Sync.
+func (s *Service) SyncChanges(ctx context.Context) error {
+	tracker, tracked := s.keycloak.(ChangeTracker)
+	if !tracked {
+		return s.Sync(ctx)
+	}
+
+	cursor, err := s.db.ReadState(ctx, stateChangeCursor)
+	if errors.Is(err, ErrNotFound) {
+		return s.Sync(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("backend read: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Sync.EffectiveTimeout())
+
+	defer cancel()
+
+	changes, err := tracker.FetchChanges(ctx, cursor)
+	if err != nil {
+		log.Warn().Err(err).Msg("fetching changes, falling back to a full sync")
+		// the full sync has a timeout of its own
+		return s.Sync(context.WithoutCancel(ctx))
+	}
+
+	stored, err := s.backendIdUsers(ctx, lo.Map(changes.Users, func(item UserDetail, _ int) string {
+		return item.Id
+	}))
+	if err != nil {
+		return err
+	}
+
+	for _, userDetail := range changes.Users {
+		// the entry of a user renamed in the backend would keep serving
+		// the keys under the old name
+		for _, username := range stored[userDetail.Id] {
+			if username == userDetail.Username {
+				continue
+			}
+
+			log.Info().Str("user", username).Str("renamed", userDetail.Username).Msg("user renamed")
+
+			if err := s.removeUser(ctx, username); err != nil {
+				return err
+			}
+		}
+
+		if len(userDetail.SshPublicKeys) == 0 {
+			if err := s.removeUser(ctx, userDetail.Username); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := s.storeUser(ctx, userDetail); err != nil {
+			return err
+		}
+
+		if err := s.updateMemberships(ctx, userDetail.Username, userDetail.Groups); err != nil {
+			return fmt.Errorf("update groups: %w", err)
+		}
+	}
+
+	if err := s.revokeCertificates(ctx, changes.Users); err != nil {
+		return fmt.Errorf("revoke certificates: %w", err)
+	}
+
+	if err := s.removeBackendIds(ctx, changes.Removed); err != nil {
+		return err
+	}
+
+	if err := s.db.WriteState(ctx, stateChangeCursor, changes.Cursor); err != nil {
+		return fmt.Errorf("backend write: %w", err)
+	}
+
+	log.Info().Int("changed", len(changes.Users)).Int("removed", len(changes.Removed)).Msg("changes applied")
+
+	return nil
+}
+
+// removeUser deletes a user provisioned by a sync together with its group
+// memberships. Locally added users are kept.
+func (s *Service) removeUser(ctx context.Context, username string) error {
+	user, err := s.db.ReadUser(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("backend read: %w", err)
+	}
+
+	if user.Origin != OriginBackend {
+		return nil
+	}
+
+	log.Info().Str("user", username).Msg("removing")
+
+	if err := s.db.DeleteUser(ctx, username); err != nil {
+		return fmt.Errorf("backend delete: %w", err)
+	}
+
+	if err := s.updateMemberships(ctx, username, nil); err != nil {
+		return fmt.Errorf("update groups: %w", err)
+	}
+
+	return nil
+}
+
+// removeBackendIds removes the provisioned users with the given backend
+// ids. Users stored before the id was recorded are left to the next full
+// sync.
+func (s *Service) removeBackendIds(ctx context.Context, ids []string) error {
+	stored, err := s.backendIdUsers(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, username := range lo.Flatten(lo.Values(stored)) {
+		if err := s.removeUser(ctx, username); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backendIdUsers returns the names of the stored users with the given
+// backend ids, keyed by id.
+func (s *Service) backendIdUsers(ctx context.Context, ids []string) (map[string][]string, error) {
+	ret := map[string][]string{}
+
+	if len(ids) == 0 {
+		return ret, nil
+	}
+
+	for cursor := ""; ; {
+		users, next, err := s.db.ListUsers(ctx, cursor, 100)
+		if err != nil {
+			return nil, fmt.Errorf("backend read: %w", err)
+		}
+
+		for _, user := range users {
+			if user.BackendId != "" && lo.Contains(ids, user.BackendId) {
+				ret[user.BackendId] = append(ret[user.BackendId], user.User.Username)
+			}
+		}
+
+		if next == "" {
+			return ret, nil
+		}
+
+		cursor = next
+	}
+}
+
+// updateMemberships makes the user a member of exactly the given groups,
+// creating missing groups and removing groups left without members. The
+// members of groups pushed over SCIM are managed by the identity provider.
+func (s *Service) updateMemberships(ctx context.Context, username string, groups []string) error {
+	existing, err := s.db.ListGroups(ctx)
+	if err != nil {
+		return fmt.Errorf("backend read: %w", err)
+	}
+
+	for _, group := range existing {
+		if group.Origin == OriginScim {
+			continue
+		}
+
+		member := lo.Contains(group.Group.Members, username)
+		wanted := lo.Contains(groups, group.Group.Groupname)
+
+		switch {
+		case member && !wanted:
+			group.Group.Members = lo.Without(group.Group.Members, username)
+		case !member && wanted:
+			group.Group.Members = append(group.Group.Members, username)
+		default:
+			continue
+		}
+
+		if len(group.Group.Members) == 0 {
+			log.Info().Str("group", group.Group.Groupname).Msg("removing")
+
+			if err := s.db.DeleteGroup(ctx, group.Group.Groupname); err != nil {
+				return fmt.Errorf("backend delete: %w", err)
+			}
+
+			continue
+		}
+
+		if err := s.db.CreateGroup(ctx, group.Group.Groupname, group); err != nil {
+			return fmt.Errorf("backend write: %w", err)
+		}
+	}
+
+	for _, name := range groups {
+		if lo.ContainsBy(existing, func(item GroupDto) bool { return item.Group.Groupname == name }) {
+			continue
+		}
+
+		if err := s.db.CreateGroup(ctx, name, s.newGroup(name, []string{username})); err != nil {
+			return fmt.Errorf("backend write: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -2,35 +2,314 @@ package domain
 
 import (
 	"os"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
 )
 
 // Config is base config in /etc/nss_sshkeyman.conf
 type Config struct {
-	Nss                  NSSConfig      `yaml:"nss"`
-	Keycloak             KeycloakConfig `yaml:"keycloak"`
-	Home                 string         `yaml:"home"`
-	DBPath               string         `yaml:"db_path"`
-	SocketPath           string         `yaml:"socket_path"`
-	ManagementSocketPath string         `yaml:"management_socket_path"`
+	Nss                  NSSConfig        `yaml:"nss"`
+	Backend              string           `yaml:"backend"`
+	Backends             []BackendConfig  `yaml:"backends"`
+	BackendConflict      string           `yaml:"backend_conflict"`
+	Keycloak             KeycloakConfig   `yaml:"keycloak"`
+	Ldap                 LdapConfig       `yaml:"ldap"`
+	Rest                 RestConfig       `yaml:"rest"`
+	Exec                 ExecConfig       `yaml:"exec"`
+	File                 FileConfig       `yaml:"file"`
+	KeyPolicy            KeyPolicyConfig  `yaml:"key_policy"`
+	Principals           PrincipalsConfig `yaml:"principals"`
+	CA                   CAConfig         `yaml:"ca"`
+	Sync                 SyncConfig       `yaml:"sync"`
+	Scim                 ScimConfig       `yaml:"scim"`
+	Home                 string           `yaml:"home"`
+	DBPath               string           `yaml:"db_path"`
+	SocketPath           string           `yaml:"socket_path"`
+	ManagementSocketPath string           `yaml:"management_socket_path"`
 }
 
 type NSSConfig struct {
 	MinUID   uint     `yaml:"minuid"`
+	MinGID   uint     `yaml:"mingid"`
 	GroupID  uint     `yaml:"groupid"`
 	Override bool     `yaml:"override"`
 	Suffix   []string `yaml:"suffix"`
 	Shell    string   `yaml:"shell"`
+	// Enumerate serves the users to getpwent, defaults to true
+	Enumerate *bool `yaml:"enumerate"`
 }
 
 type KeycloakConfig struct {
-	Server   string `yaml:"server"`
-	ClientId string `yaml:"client_id"`
+	Server string `yaml:"server"`
+	// ContextPath is the path Keycloak is served below, "/auth" before
+	// Keycloak 17 and "/" since. It is detected through the OIDC discovery
+	// document of the realm when empty
+	ContextPath string `yaml:"context_path"`
+	ClientId    string `yaml:"client_id"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	Realm       string `yaml:"realm"`
+	// GrantType is "password" or "client_credentials", defaults to the
+	// password grant when a username is configured
+	GrantType string `yaml:"grant_type"`
+	// ClientSecret or ClientAssertionKey, a PEM private key path used for
+	// signed JWT client authentication, authenticate confidential clients
+	ClientSecret       string `yaml:"client_secret"`
+	ClientAssertionKey string `yaml:"client_assertion_key"`
+	// SshKeyAttributes lists the multi-valued user attributes holding the
+	// ssh public keys, defaults to "ssh-key"
+	SshKeyAttributes []string `yaml:"ssh_key_attributes"`
+	// Attributes maps user attributes to the account, unset attributes
+	// keep the values derived from the nss section
+	Attributes AttributeMapping `yaml:"attributes"`
+	// ExpiryAttribute is an optional user attribute holding the account
+	// expiry date (RFC 3339 or YYYY-MM-DD)
+	ExpiryAttribute string `yaml:"expiry_attribute"`
+	// KeyExpiryAttribute and KeyNotBeforeAttribute are optional user
+	// attributes holding the validity window of the ssh keys, one value
+	// per key in key order or a single value for all keys
+	KeyExpiryAttribute    string `yaml:"key_expiry_attribute"`
+	KeyNotBeforeAttribute string `yaml:"key_not_before_attribute"`
+	// PageSize is the number of users fetched per request, defaults to 100
+	PageSize int `yaml:"page_size"`
+	// LockRequiredActions lists keycloak required actions which lock the
+	// account until the user completed them
+	LockRequiredActions []string `yaml:"lock_required_actions"`
+	// RequiredGroups, RequiredRealmRoles and RequiredClientRoles restrict
+	// the synced users to members of any of the groups, given by path and
+	// including subgroups, or holders of any of the roles. Client roles are
+	// keyed by client id. Every user is synced when all are empty
+	RequiredGroups      []string            `yaml:"required_groups"`
+	RequiredRealmRoles  []string            `yaml:"required_realm_roles"`
+	RequiredClientRoles map[string][]string `yaml:"required_client_roles"`
+}
+
+// BackendConfig declares one of several backends users are synced from.
+// The settings section of the type replaces the top level one.
+type BackendConfig struct {
+	// Name identifies the backend in logs and errors, defaults to the type
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Priority orders the backends, lower values are asked first
+	Priority int            `yaml:"priority"`
+	Keycloak KeycloakConfig `yaml:"keycloak"`
+	Ldap     LdapConfig     `yaml:"ldap"`
+	Rest     RestConfig     `yaml:"rest"`
+	Exec     ExecConfig     `yaml:"exec"`
+	File     FileConfig     `yaml:"file"`
+}
+
+// LdapConfig configures the LDAP backend. Empty filters and attributes take
+// the defaults of the schema.
+type LdapConfig struct {
+	// URL of the server, e.g. "ldaps://ldap.example.com"
+	URL          string `yaml:"url"`
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	BaseDN       string `yaml:"base_dn"`
+	// Schema is "openldap" (default), "freeipa" or "ad"
+	Schema     string `yaml:"schema"`
+	UserFilter string `yaml:"user_filter"`
+	// GroupBaseDN defaults to BaseDN
+	GroupBaseDN string `yaml:"group_base_dn"`
+	GroupFilter string `yaml:"group_filter"`
+
+	UsernameAttribute string           `yaml:"username_attribute"`
+	FullnameAttribute string           `yaml:"fullname_attribute"`
+	Attributes        AttributeMapping `yaml:"attributes"`
+
+	// StartTLS upgrades ldap:// connections to TLS, ldaps:// URLs use TLS
+	// from the start
+	StartTLS bool `yaml:"start_tls"`
+	// CACert is a PEM bundle verifying the server certificate, defaults to
+	// the system roots
+	CACert string `yaml:"ca_cert"`
+	// TLSSkipVerify disables the server certificate verification
+	TLSSkipVerify bool `yaml:"tls_skip_verify"`
+	// PageSize is the number of entries per result page (RFC 2696),
+	// defaults to 500
+	PageSize int `yaml:"page_size"`
+	// Timeout of connects and requests, defaults to 10 seconds
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// RestConfig configures the REST backend reading users from a JSON API.
+type RestConfig struct {
+	// UsersURL lists the users. UserURL returns a single user, "{username}"
+	// is replaced by the escaped username. Users are looked up in the
+	// listing when it is empty
+	UsersURL string `yaml:"users_url"`
+	UserURL  string `yaml:"user_url"`
+	// UsersPath selects the user array in the listing, the response itself
+	// when empty. UserPath selects the user in the UserURL response
+	UsersPath  string               `yaml:"users_path"`
+	UserPath   string               `yaml:"user_path"`
+	Fields     RestFieldMapping     `yaml:"fields"`
+	Auth       RestAuthConfig       `yaml:"auth"`
+	Pagination RestPaginationConfig `yaml:"pagination"`
+	// Headers are added to every request
+	Headers map[string]string `yaml:"headers"`
+	// Timeout of a request, defaults to 10 seconds
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// RestFieldMapping holds the paths of the user fields in a user object, e.g.
+// "profile.displayName" or "keys[*].value". Paths selecting several values
+// are used for the keys and groups.
+type RestFieldMapping struct {
+	Id       string `yaml:"id"`
+	Username string `yaml:"username"`
+	Fullname string `yaml:"fullname"`
+	SshKeys  string `yaml:"ssh_keys"`
+	Groups   string `yaml:"groups"`
+	// Enabled is a boolean, users are enabled when it is missing
+	Enabled string `yaml:"enabled"`
+}
+
+// RestAuthConfig authenticates the REST backend requests.
+type RestAuthConfig struct {
+	// Type is "bearer", "basic" or empty for none
+	Type     string `yaml:"type"`
+	Token    string `yaml:"token"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
-	Realm    string `yaml:"realm"`
+	// ClientCert and ClientKey are PEM files authenticating the client
+	// with TLS, CACert a PEM bundle verifying the server
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	CACert     string `yaml:"ca_cert"`
+}
+
+// RestPaginationConfig describes how the user listing is paged.
+type RestPaginationConfig struct {
+	// Style is "offset", "cursor", "link" (the next page in the Link
+	// header) or empty for a single request
+	Style string `yaml:"style"`
+	// PageSize is sent as LimitParam, defaults to 100
+	PageSize    int    `yaml:"page_size"`
+	LimitParam  string `yaml:"limit_param"`
+	OffsetParam string `yaml:"offset_param"`
+	// CursorParam sends the cursor found at CursorPath in the previous page
+	CursorParam string `yaml:"cursor_param"`
+	CursorPath  string `yaml:"cursor_path"`
+}
+
+// ExecConfig configures the exec backend, an executable answering the
+// requests of the daemon with JSON, see adapter.ExecRequest.
+type ExecConfig struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	// Env is added to the environment of the daemon
+	Env map[string]string `yaml:"env"`
+	// Timeout of a run, defaults to 30 seconds. It must be below the sync
+	// timeout, which cancels the run
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// FileConfig configures the file backend.
+type FileConfig struct {
+	// Path is a YAML or JSON file listing the users, or a directory with a
+	// file per user, e.g. users.d/alice.yaml. It is reloaded on change
+	Path string `yaml:"path"`
+}
+
+// AttributeMapping names the backend user attributes holding account
+// properties, e.g. the posixAccount attributes synced from a directory.
+type AttributeMapping struct {
+	// SshKeys is deprecated for Keycloak, which reads ssh_key_attributes.
+	// Config loading moves it there
+	SshKeys []string `yaml:"ssh_keys"`
+	Uid     string   `yaml:"uid"`
+	Gid     string   `yaml:"gid"`
+	Shell   string   `yaml:"shell"`
+	Home    string   `yaml:"home"`
+}
+
+// KeyPolicyConfig restricts the ssh keys accepted from the backend and the
+// management socket. Empty or zero values disable the related check.
+type KeyPolicyConfig struct {
+	// AllowedAlgorithms lists the accepted key types, e.g. "ssh-ed25519"
+	AllowedAlgorithms []string `yaml:"allowed_algorithms"`
+	MinRSABits        int      `yaml:"min_rsa_bits"`
+	MinECDSABits      int      `yaml:"min_ecdsa_bits"`
+	// RequireSkGroups lists the groups whose members may only use FIDO
+	// security key (sk-) types
+	RequireSkGroups []string `yaml:"require_sk_groups"`
+}
+
+// PrincipalsConfig selects the principals accepted in ssh certificates of a
+// user, served to sshd through AuthorizedPrincipalsCommand. Personal
+// accounts only accept the login name, group and role principals are only
+// accepted by the shared accounts they are mapped to.
+type PrincipalsConfig struct {
+	// Username adds the login name as a principal, defaults to true
+	Username *bool `yaml:"username"`
+	// Groups and Roles list the backend groups and realm roles mapped to a
+	// principal of the same name, "*" maps all of them
+	Groups []string `yaml:"groups"`
+	Roles  []string `yaml:"roles"`
+	// Prefix is prepended to the group and role principals, it is required
+	// with them so that they never equal a login name
+	Prefix string `yaml:"prefix"`
+	// SharedAccounts maps local accounts, e.g. "deploy", to the groups and
+	// roles whose members may log in to them with a certificate
+	SharedAccounts map[string][]string `yaml:"shared_accounts"`
+}
+
+// SyncConfig schedules the backend sync of the daemon. Between full syncs
+// only the changes reported by the backend are applied, if it tracks them.
+type SyncConfig struct {
+	// Interval between two syncs, defaults to one minute
+	Interval time.Duration `yaml:"interval"`
+	// FullInterval between two full syncs, defaults to one hour
+	FullInterval time.Duration `yaml:"full_interval"`
+	// Timeout of a single sync, defaults to one minute
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// defaultSyncTimeout is used when the sync timeout is not configured.
+const defaultSyncTimeout = time.Minute
+
+// EffectiveTimeout returns the timeout of a single sync.
+func (c SyncConfig) EffectiveTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+
+	return defaultSyncTimeout
+}
+
+// ScimConfig configures the SCIM 2.0 server identity providers push users
+// and groups to. It is disabled when Listen is empty.
+type ScimConfig struct {
+	// Listen is the address of the server, e.g. ":8443"
+	Listen string `yaml:"listen"`
+	// Token is the bearer token of the identity provider, TokenFile reads
+	// it from a file instead
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	// BasePath prefixes the endpoints, defaults to /scim/v2
+	BasePath string `yaml:"base_path"`
+	// TLSCert and TLSKey serve HTTPS, plain HTTP is meant for a TLS
+	// terminating proxy in front of the daemon
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+}
+
+// CAConfig configures the ssh certificate authority of the daemon.
+type CAConfig struct {
+	// KeyPath is the CA private key in OpenSSH format, certificates are not
+	// issued when empty
+	KeyPath string `yaml:"key_path"`
+	// ValidityHours is the lifetime of issued certificates, defaults to 8
+	ValidityHours int `yaml:"validity_hours"`
+	// Extensions are granted to every certificate, e.g. "permit-pty"
+	Extensions []string `yaml:"extensions"`
+	// ForceCommand is set as the force-command critical option if not empty
+	ForceCommand string `yaml:"force_command"`
 }
 
 func LoadConfig() *Config {
@@ -47,13 +326,61 @@ func LoadConfig() *Config {
 		cfg.DBPath = "/tmp/users.db"
 		cfg.SocketPath = "/var/lib/sshkeyman/daemon.sock"
 		cfg.ManagementSocketPath = "/var/lib/sshkeyman/management.sock"
+		cfg.applyDefaults()
 		return &cfg
 	}
-	config := Config{}
-	cfgErr = yaml.Unmarshal([]byte(cfgfile), &config)
+	config, cfgErr := ParseConfig(cfgfile)
 	if cfgErr != nil {
 		log.Warn().Msgf("open config file, using defaults: %s\n", cfgErr.Error())
 	}
 
-	return &config
+	return config
+}
+
+// ParseConfig decodes a config file. Settings missing in the file get their
+// defaults, the config is returned with them even if decoding failed.
+func ParseConfig(data []byte) (*Config, error) {
+	config := Config{}
+	err := yaml.Unmarshal(data, &config)
+
+	config.applyDefaults()
+
+	return &config, err
+}
+
+// applyDefaults sets the defaults of the settings config files written
+// before they were added lack.
+func (c *Config) applyDefaults() {
+	if c.Nss.MinGID == 0 {
+		c.Nss.MinGID = 10000
+	}
+
+	if c.Nss.Enumerate == nil {
+		c.Nss.Enumerate = lo.ToPtr(true)
+	}
+
+	if c.Principals.Username == nil {
+		c.Principals.Username = lo.ToPtr(true)
+	}
+
+	c.Keycloak.migrate()
+	for i := range c.Backends {
+		c.Backends[i].Keycloak.migrate()
+	}
+}
+
+// migrate moves the deprecated attributes.ssh_keys to ssh_key_attributes.
+func (k *KeycloakConfig) migrate() {
+	if len(k.Attributes.SshKeys) == 0 {
+		return
+	}
+
+	if len(k.SshKeyAttributes) > 0 {
+		log.Warn().Msg("keycloak attributes.ssh_keys is deprecated and ignored, ssh_key_attributes is set")
+	} else {
+		log.Warn().Msg("keycloak attributes.ssh_keys is deprecated, use ssh_key_attributes")
+		k.SshKeyAttributes = k.Attributes.SshKeys
+	}
+
+	k.Attributes.SshKeys = nil
 }
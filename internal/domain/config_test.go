@@ -1,6 +1,7 @@
 package domain_test
 
 import (
+	"slices"
 	"testing"
 
 	"github.com/h2hsecure/sshkeyman/internal/domain"
@@ -18,3 +19,51 @@ func TestConfigLoad(t *testing.T) {
 		t.Fatalf("wrong db path: %s", cfg.DBPath)
 	}
 }
+
+func TestParseConfigDefaults(t *testing.T) {
+	cfg, err := domain.ParseConfig([]byte("nss:\n  minuid: 20000\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if cfg.Nss.MinGID != 10000 || !*cfg.Nss.Enumerate || !*cfg.Principals.Username {
+		t.Fatalf("defaults not applied: %+v %+v", cfg.Nss, cfg.Principals)
+	}
+
+	// false is kept, it differs from a missing setting
+	cfg, err = domain.ParseConfig([]byte("nss:\n  mingid: 50000\n  enumerate: false\nprincipals:\n  username: false\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if cfg.Nss.MinGID != 50000 || *cfg.Nss.Enumerate || *cfg.Principals.Username {
+		t.Fatalf("settings overridden by defaults: %+v %+v", cfg.Nss, cfg.Principals)
+	}
+}
+
+func TestParseConfigSshKeyAttributes(t *testing.T) {
+	cfg, err := domain.ParseConfig([]byte(`
+keycloak:
+  attributes:
+    ssh_keys: ["sshPublicKey"]
+backends:
+  - type: keycloak
+    keycloak:
+      ssh_key_attributes: ["ssh-key"]
+      attributes:
+        ssh_keys: ["sshPublicKey"]
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if !slices.Equal(cfg.Keycloak.SshKeyAttributes, []string{"sshPublicKey"}) || cfg.Keycloak.Attributes.SshKeys != nil {
+		t.Fatalf("attributes.ssh_keys not migrated: %+v", cfg.Keycloak)
+	}
+
+	// the kept setting wins over the deprecated one
+	backend := cfg.Backends[0].Keycloak
+	if !slices.Equal(backend.SshKeyAttributes, []string{"ssh-key"}) || backend.Attributes.SshKeys != nil {
+		t.Fatalf("ssh_key_attributes overridden: %+v", backend)
+	}
+}
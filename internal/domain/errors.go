@@ -3,3 +3,19 @@ package domain
 import "fmt"
 
 var ErrNotFound = fmt.Errorf("not found")
+
+var ErrEnumerationDisabled = fmt.Errorf("enumeration disabled")
+
+var ErrInvalidKey = fmt.Errorf("invalid ssh key")
+
+var ErrKeyPolicy = fmt.Errorf("key rejected by policy")
+
+var ErrCADisabled = fmt.Errorf("certificate authority not configured")
+
+var ErrUnauthorized = fmt.Errorf("unauthorized")
+
+var ErrTruncated = fmt.Errorf("truncated user listing")
+
+var ErrForbidden = fmt.Errorf("forbidden")
+
+var ErrConflict = fmt.Errorf("conflict")
@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"golang.org/x/crypto/ssh"
+)
+
+// RejectedKey is a key dropped during sync or SETUSER together with the
+// reason, so that users can be told why their key is not accepted. The
+// validity window is kept for keys accepted again once the account is
+// re-enabled.
+type RejectedKey struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Reason      string    `json:"reason"`
+	NotBefore   time.Time `json:"not_before,omitzero"`
+	NotAfter    time.Time `json:"not_after,omitzero"`
+}
+
+// Check validates the key against the policy. Groups are the groups of the
+// key owner, used for the FIDO requirement.
+func (p KeyPolicyConfig) Check(key SshKey, groups []string) error {
+	pub, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	// keys stored before certificates were rejected are checked by the key
+	// they wrap
+	if cert, isCert := pub.(*ssh.Certificate); isCert {
+		pub = cert.Key
+	}
+
+	algo := pub.Type()
+
+	if len(p.AllowedAlgorithms) > 0 && !lo.Contains(p.AllowedAlgorithms, algo) {
+		return fmt.Errorf("%w: algorithm %s is not allowed", ErrKeyPolicy, algo)
+	}
+
+	if cryptoKey, ok := pub.(ssh.CryptoPublicKey); ok {
+		switch k := cryptoKey.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			if bits := k.N.BitLen(); bits < p.MinRSABits {
+				return fmt.Errorf("%w: rsa key has %d bits, at least %d required", ErrKeyPolicy, bits, p.MinRSABits)
+			}
+		case *ecdsa.PublicKey:
+			if bits := k.Curve.Params().BitSize; bits < p.MinECDSABits {
+				return fmt.Errorf("%w: ecdsa key has %d bits, at least %d required", ErrKeyPolicy, bits, p.MinECDSABits)
+			}
+		}
+	}
+
+	if !strings.HasPrefix(algo, "sk-") {
+		if group, has := lo.Find(groups, func(item string) bool {
+			return lo.Contains(p.RequireSkGroups, item)
+		}); has {
+			return fmt.Errorf("%w: members of %s must use a FIDO (sk-) key", ErrKeyPolicy, group)
+		}
+	}
+
+	return nil
+}
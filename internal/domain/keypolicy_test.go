@@ -0,0 +1,114 @@
+package domain_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"golang.org/x/crypto/ssh"
+)
+
+func newRsaKey(t *testing.T, bits int) string {
+	t.Helper()
+
+	private, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	pub, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " rsa@laptop"
+}
+
+func TestKeyPolicyCheck(t *testing.T) {
+	policy := domain.KeyPolicyConfig{
+		AllowedAlgorithms: []string{"ssh-ed25519", "ssh-rsa", "ecdsa-sha2-nistp256"},
+		MinRSABits:        3072,
+		MinECDSABits:      384,
+		RequireSkGroups:   []string{"admins"},
+	}
+
+	tests := []struct {
+		name   string
+		line   string
+		groups []string
+		reject bool
+	}{
+		{name: "ed25519", line: testEd25519Key, groups: []string{"developers"}},
+		{name: "admin without sk key", line: testEd25519Key, groups: []string{"developers", "admins"}, reject: true},
+		{name: "weak rsa", line: newRsaKey(t, 2048), reject: true},
+		{name: "strong rsa", line: newRsaKey(t, 3072)},
+		{name: "small ecdsa curve", line: testEcdsaKey, reject: true},
+	}
+
+	for _, tt := range tests {
+		key, err := domain.ParseSshKey(tt.line)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tt.name, err)
+		}
+
+		err = policy.Check(key, tt.groups)
+		if tt.reject != errors.Is(err, domain.ErrKeyPolicy) {
+			t.Fatalf("%s: unexpected policy result: %v", tt.name, err)
+		}
+	}
+
+	key, _ := domain.ParseSshKey(testEd25519Key)
+
+	if err := (domain.KeyPolicyConfig{AllowedAlgorithms: []string{"ssh-rsa"}}).Check(key, nil); !errors.Is(err, domain.ErrKeyPolicy) {
+		t.Fatalf("algorithm not in the allowed list accepted: %v", err)
+	}
+
+	if err := (domain.KeyPolicyConfig{}).Check(key, []string{"admins"}); err != nil {
+		t.Fatalf("empty policy rejected key: %v", err)
+	}
+}
+
+func TestKeyPolicyCertificate(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	pub, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ca key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+
+	cert := &ssh.Certificate{Key: pub, CertType: ssh.UserCert, ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+
+	if _, err := domain.ParseSshKey(line); !errors.Is(err, domain.ErrInvalidKey) {
+		t.Fatalf("certificate accepted as key: %v", err)
+	}
+
+	// a certificate stored earlier is checked by the key it wraps
+	key := domain.SshKey{Aglo: cert.Type(), Key: base64.StdEncoding.EncodeToString(cert.Marshal())}
+
+	if err := (domain.KeyPolicyConfig{MinRSABits: 3072}).Check(key, nil); !errors.Is(err, domain.ErrKeyPolicy) {
+		t.Fatalf("weak key in a certificate accepted: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"errors"
+
+	"github.com/samber/lo"
+)
+
+// Validate rejects group and role principals without a prefix, they could
+// equal the login name of another user.
+func (p PrincipalsConfig) Validate() error {
+	if p.Prefix == "" && (len(p.Groups) > 0 || len(p.Roles) > 0 || len(p.SharedAccounts) > 0) {
+		return errors.New("prefix is required with group and role principals")
+	}
+
+	return nil
+}
+
+// Principals returns the ssh certificate principals of a user with the
+// given backend groups and roles. Besides the login name these are the
+// mapped group and role principals accepted by a shared account.
+func (p PrincipalsConfig) Principals(username string, groups, roles []string) []string {
+	var ret []string
+
+	if lo.FromPtr(p.Username) {
+		ret = append(ret, username)
+	}
+
+	for _, group := range groups {
+		if (lo.Contains(p.Groups, "*") || lo.Contains(p.Groups, group)) && p.Shared(p.Prefix+group) {
+			ret = append(ret, p.Prefix+group)
+		}
+	}
+
+	for _, role := range roles {
+		if (lo.Contains(p.Roles, "*") || lo.Contains(p.Roles, role)) && p.Shared(p.Prefix+role) {
+			ret = append(ret, p.Prefix+role)
+		}
+	}
+
+	return lo.Uniq(ret)
+}
+
+// AccountPrincipals returns the group and role principals accepted by a
+// shared account.
+func (p PrincipalsConfig) AccountPrincipals(account string) []string {
+	if p.Prefix == "" {
+		return nil
+	}
+
+	return lo.Map(p.SharedAccounts[account], func(item string, _ int) string {
+		return p.Prefix + item
+	})
+}
+
+// Shared reports whether a shared account accepts the group or role
+// principal.
+func (p PrincipalsConfig) Shared(principal string) bool {
+	for account := range p.SharedAccounts {
+		if lo.Contains(p.AccountPrincipals(account), principal) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package domain_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/samber/lo"
+)
+
+func TestPrincipals(t *testing.T) {
+	shared := map[string][]string{"deploy": {"admins"}, "oncall": {"ops"}}
+
+	tests := []struct {
+		cfg  domain.PrincipalsConfig
+		want []string
+	}{
+		{
+			cfg:  domain.PrincipalsConfig{Username: lo.ToPtr(true)},
+			want: []string{"alice"},
+		},
+		{
+			// mapped groups and roles not accepted by a shared account
+			// are no principals
+			cfg:  domain.PrincipalsConfig{Username: lo.ToPtr(true), Groups: []string{"*"}, Roles: []string{"*"}, Prefix: "group-"},
+			want: []string{"alice"},
+		},
+		{
+			// "admins" is both a group and a role and listed once
+			cfg:  domain.PrincipalsConfig{Groups: []string{"*"}, Roles: []string{"*"}, Prefix: "group-", SharedAccounts: shared},
+			want: []string{"group-admins", "group-ops"},
+		},
+		{
+			cfg:  domain.PrincipalsConfig{Username: lo.ToPtr(true), Groups: []string{"developers"}, Roles: []string{"ops"}, Prefix: "role-", SharedAccounts: shared},
+			want: []string{"alice", "role-ops"},
+		},
+		{
+			// without a prefix group principals could equal a login name
+			cfg:  domain.PrincipalsConfig{Username: lo.ToPtr(true), Groups: []string{"*"}, SharedAccounts: shared},
+			want: []string{"alice"},
+		},
+		{
+			cfg: domain.PrincipalsConfig{},
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.cfg.Principals("alice", []string{"developers", "admins"}, []string{"ops", "offline_access", "admins"})
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("unexpected principals for %+v: %v", tt.cfg, got)
+		}
+	}
+}
+
+func TestPrincipalsValidate(t *testing.T) {
+	if err := (domain.PrincipalsConfig{Username: lo.ToPtr(true)}).Validate(); err != nil {
+		t.Fatalf("username principals rejected: %v", err)
+	}
+
+	if err := (domain.PrincipalsConfig{Groups: []string{"admins"}}).Validate(); err == nil {
+		t.Fatalf("group principals without prefix accepted")
+	}
+
+	if err := (domain.PrincipalsConfig{SharedAccounts: map[string][]string{"deploy": {"admins"}}}).Validate(); err == nil {
+		t.Fatalf("shared accounts without prefix accepted")
+	}
+}
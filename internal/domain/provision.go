@@ -0,0 +1,283 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/samber/lo"
+)
+
+// ProvisionUser implements IService. It stores a user pushed by an identity
+// provider over SCIM, userDetail.Id is the SCIM id of the user and renames
+// are applied by id. The supplementary groups of the user are the SCIM
+// groups it is a member of. A user of another origin is only replaced if
+// override is enabled.
+func (s *Service) ProvisionUser(ctx context.Context, userDetail UserDetail) (KeyDto, error) {
+	users, err := s.ProvisionedUsers(ctx)
+	if err != nil {
+		return KeyDto{}, err
+	}
+
+	previous, renamed := lo.Find(users, func(item KeyDto) bool {
+		return item.BackendId == userDetail.Id && item.User.Username != userDetail.Username
+	})
+
+	existing, err := s.db.ReadUser(ctx, userDetail.Username)
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return KeyDto{}, fmt.Errorf("backend read: %w", err)
+	case existing.Origin == OriginScim && existing.BackendId != userDetail.Id:
+		return KeyDto{}, fmt.Errorf("user %s: %w: provisioned with another id", userDetail.Username, ErrConflict)
+	case existing.Origin != OriginScim && !s.cfg.Nss.Override:
+		return KeyDto{}, fmt.Errorf("user %s: %w: override disabled", userDetail.Username, ErrConflict)
+	}
+
+	if renamed {
+		log.Info().Str("user", previous.User.Username).Str("name", userDetail.Username).Msg("renaming")
+
+		if err := s.renameMember(ctx, previous.User.Username, userDetail.Username); err != nil {
+			return KeyDto{}, err
+		}
+	}
+
+	user, err := s.storeProvisioned(ctx, userDetail, nil)
+	if err != nil {
+		return KeyDto{}, err
+	}
+
+	if renamed {
+		if err := s.db.DeleteUser(ctx, previous.User.Username); err != nil {
+			return KeyDto{}, fmt.Errorf("backend delete: %w", err)
+		}
+	}
+
+	return user, nil
+}
+
+// DeprovisionUser implements IService. It deletes a user pushed over SCIM
+// and removes it from its SCIM groups.
+func (s *Service) DeprovisionUser(ctx context.Context, username string) error {
+	user, err := s.db.ReadUser(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	if user.Origin != OriginScim {
+		return fmt.Errorf("user %s: %w", username, ErrNotFound)
+	}
+
+	log.Info().Str("user", username).Msg("removing")
+
+	if err := s.db.DeleteUser(ctx, username); err != nil {
+		return fmt.Errorf("backend delete: %w", err)
+	}
+
+	return s.renameMember(ctx, username, "")
+}
+
+// ProvisionedUsers implements IService. It returns the users pushed over
+// SCIM, regardless of the enumerate setting.
+func (s *Service) ProvisionedUsers(ctx context.Context) ([]KeyDto, error) {
+	var provisioned []KeyDto
+
+	for cursor := ""; ; {
+		users, next, err := s.db.ListUsers(ctx, cursor, 100)
+		if err != nil {
+			return nil, fmt.Errorf("backend read: %w", err)
+		}
+
+		provisioned = append(provisioned, lo.Filter(users, func(item KeyDto, _ int) bool {
+			return item.Origin == OriginScim
+		})...)
+
+		if next == "" {
+			return provisioned, nil
+		}
+
+		cursor = next
+	}
+}
+
+// ProvisionGroup implements IService. It stores a group pushed over SCIM
+// with the given id, name and member usernames. Renames are applied by id,
+// the gid is derived from the id so that it survives them. The members are
+// stored again to update their principals and key policy.
+func (s *Service) ProvisionGroup(ctx context.Context, id, name string, members []string) (GroupDto, error) {
+	groups, err := s.ProvisionedGroups(ctx)
+	if err != nil {
+		return GroupDto{}, err
+	}
+
+	previous, found := lo.Find(groups, func(item GroupDto) bool {
+		return item.BackendId == id
+	})
+
+	existing, err := s.db.ReadGroup(ctx, name)
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return GroupDto{}, fmt.Errorf("backend read: %w", err)
+	case existing.Origin != OriginScim:
+		return GroupDto{}, fmt.Errorf("group %s: %w: managed by the backend", name, ErrConflict)
+	case existing.BackendId != id:
+		return GroupDto{}, fmt.Errorf("group %s: %w: provisioned with another id", name, ErrConflict)
+	}
+
+	group := s.newGroup(name, lo.Uniq(members))
+	group.Group.GID = s.cfg.Nss.MinGID + uint(hash(id))
+	group.Origin = OriginScim
+	group.BackendId = id
+
+	log.Info().Str("group", name).Int("members", len(group.Group.Members)).Msg("provisioning group")
+
+	if err := s.db.CreateGroup(ctx, name, group); err != nil {
+		return GroupDto{}, fmt.Errorf("backend write: %w", err)
+	}
+
+	if found && previous.Group.Groupname != name {
+		if err := s.db.DeleteGroup(ctx, previous.Group.Groupname); err != nil {
+			return GroupDto{}, fmt.Errorf("backend delete: %w", err)
+		}
+	}
+
+	if err := s.refreshMembers(ctx, append(previous.Group.Members, group.Group.Members...)); err != nil {
+		return GroupDto{}, err
+	}
+
+	return group, nil
+}
+
+// DeprovisionGroup implements IService. It deletes a group pushed over SCIM.
+func (s *Service) DeprovisionGroup(ctx context.Context, name string) error {
+	group, err := s.db.ReadGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if group.Origin != OriginScim {
+		return fmt.Errorf("group %s: %w", name, ErrNotFound)
+	}
+
+	log.Info().Str("group", name).Msg("removing")
+
+	if err := s.db.DeleteGroup(ctx, name); err != nil {
+		return fmt.Errorf("backend delete: %w", err)
+	}
+
+	return s.refreshMembers(ctx, group.Group.Members)
+}
+
+// ProvisionedGroups implements IService. It returns the groups pushed over
+// SCIM.
+func (s *Service) ProvisionedGroups(ctx context.Context) ([]GroupDto, error) {
+	groups, err := s.db.ListGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backend read: %w", err)
+	}
+
+	return lo.Filter(groups, func(item GroupDto, _ int) bool {
+		return item.Origin == OriginScim
+	}), nil
+}
+
+// storeProvisioned writes a SCIM user with the SCIM groups it is a member
+// of, the given keys are added to the rejected keys.
+func (s *Service) storeProvisioned(ctx context.Context, userDetail UserDetail, rejected []RejectedKey) (KeyDto, error) {
+	groups, err := s.ProvisionedGroups(ctx)
+	if err != nil {
+		return KeyDto{}, err
+	}
+
+	userDetail.Groups = nil
+
+	for _, group := range groups {
+		if lo.Contains(group.Group.Members, userDetail.Username) {
+			userDetail.Groups = append(userDetail.Groups, group.Group.Groupname)
+		}
+	}
+
+	log.Info().Str("user", userDetail.Username).Bool("disabled", userDetail.Disabled).Msg("provisioning")
+
+	user := s.newUser(userDetail, OriginScim)
+	user.RejectedKeys = append(user.RejectedKeys, rejected...)
+
+	if err := s.db.CreateUser(ctx, userDetail.Username, user); err != nil {
+		return KeyDto{}, fmt.Errorf("backend write: %w", err)
+	}
+
+	return user, nil
+}
+
+// refreshMembers stores the given SCIM users again after their groups
+// changed. The accepted keys are checked again, rejected keys stay rejected
+// until the identity provider pushes the user again.
+func (s *Service) refreshMembers(ctx context.Context, usernames []string) error {
+	for _, username := range lo.Uniq(usernames) {
+		user, err := s.db.ReadUser(ctx, username)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("backend read: %w", err)
+		}
+
+		if user.Origin != OriginScim {
+			continue
+		}
+
+		userDetail := UserDetail{
+			Id:       user.BackendId,
+			Username: user.User.Username,
+			Fullname: user.User.Gecos,
+			Disabled: user.Locked(),
+			UID:      user.User.UID,
+			GID:      user.User.GID,
+			Shell:    user.User.Shell,
+			Home:     user.User.Dir,
+		}
+
+		for _, key := range user.SshKeys {
+			userDetail.SshPublicKeys = append(userDetail.SshPublicKeys, key.AuthorizedKey())
+			userDetail.SshKeyNotBefore = append(userDetail.SshKeyNotBefore, key.NotBefore)
+			userDetail.SshKeyNotAfter = append(userDetail.SshKeyNotAfter, key.NotAfter)
+		}
+
+		if _, err := s.storeProvisioned(ctx, userDetail, user.RejectedKeys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renameMember replaces a member of the SCIM groups, an empty name removes
+// it. Groups left without members are kept, they are managed by the
+// identity provider.
+func (s *Service) renameMember(ctx context.Context, username, name string) error {
+	groups, err := s.ProvisionedGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if !lo.Contains(group.Group.Members, username) {
+			continue
+		}
+
+		group.Group.Members = lo.Without(group.Group.Members, username)
+		if name != "" {
+			group.Group.Members = append(group.Group.Members, name)
+		}
+
+		if err := s.db.CreateGroup(ctx, group.Group.Groupname, group); err != nil {
+			return fmt.Errorf("backend write: %w", err)
+		}
+	}
+
+	return nil
+}
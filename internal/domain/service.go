@@ -6,7 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"strings"
+	"path"
 	"time"
 
 	"github.com/protosam/go-libnss/structs"
@@ -39,10 +39,45 @@ func WithUserId(userId uint) SearchUserOp {
 	}
 }
 
+type SearchGroup struct {
+	groupname *string
+	groupId   *uint
+}
+
+type SearchGroupOp func(*SearchGroup)
+
+func WithGroupname(groupname string) SearchGroupOp {
+	return func(sg *SearchGroup) {
+		sg.groupname = lo.ToPtr(groupname)
+	}
+}
+
+func WithGroupId(groupId uint) SearchGroupOp {
+	return func(sg *SearchGroup) {
+		sg.groupId = lo.ToPtr(groupId)
+	}
+}
+
 type IService interface {
 	FindUser(context.Context, ...SearchUserOp) (KeyDto, error)
+	FindShadow(context.Context, string) (structs.Shadow, error)
+	FindGroup(context.Context, ...SearchGroupOp) (GroupDto, error)
+	UserGroups(context.Context, string) ([]GroupDto, error)
+	AuthorizedPrincipals(context.Context, string) ([]string, error)
 	AddUser(context.Context, KeyDto) error
+	ListUsers(context.Context, string, int) ([]KeyDto, string, error)
 	Sync(context.Context) error
+	ProvisionUser(context.Context, UserDetail) (KeyDto, error)
+	DeprovisionUser(context.Context, string) error
+	ProvisionedUsers(context.Context) ([]KeyDto, error)
+	ProvisionGroup(context.Context, string, string, []string) (GroupDto, error)
+	DeprovisionGroup(context.Context, string) error
+	ProvisionedGroups(context.Context) ([]GroupDto, error)
+	SyncChanges(context.Context) error
+	PurgeExpiredKeys(context.Context) (int, error)
+	IssueCertificate(context.Context, string, string, string) (string, error)
+	ListCertificates(context.Context) ([]CertDto, error)
+	RevokeCertificate(context.Context, uint64) error
 }
 
 func NewService(cfg *Config, db BoltDB, keycloak Backend) IService {
@@ -70,6 +105,80 @@ func (s *Service) FindUser(ctx context.Context, ops ...SearchUserOp) (KeyDto, er
 	}
 }
 
+// FindShadow implements IService. Users stored without shadow information
+// get an unlocked, never expiring entry.
+func (s *Service) FindShadow(ctx context.Context, username string) (structs.Shadow, error) {
+	user, err := s.db.ReadUser(ctx, username)
+	if err != nil {
+		return structs.Shadow{}, err
+	}
+
+	if user.Shadow.Username == "" {
+		return newShadow(user.User.Username, false, time.Time{}), nil
+	}
+
+	return user.Shadow, nil
+}
+
+// FindGroup implements IService.
+func (s *Service) FindGroup(ctx context.Context, ops ...SearchGroupOp) (GroupDto, error) {
+	var sg SearchGroup
+
+	for _, op := range ops {
+		op(&sg)
+	}
+	switch {
+	case sg.groupname != nil:
+		return s.db.ReadGroup(ctx, *sg.groupname)
+	case sg.groupId != nil:
+		return s.db.ReadGroupById(ctx, *sg.groupId)
+	default:
+		return GroupDto{}, ErrNotFound
+	}
+}
+
+// UserGroups implements IService. It returns the supplementary groups of
+// the given user.
+func (s *Service) UserGroups(ctx context.Context, username string) ([]GroupDto, error) {
+	groups, err := s.db.ListGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list groups: %w", err)
+	}
+
+	return lo.Filter(groups, func(item GroupDto, _ int) bool {
+		return lo.Contains(item.Group.Members, username)
+	}), nil
+}
+
+// AuthorizedPrincipals implements IService. It returns the certificate
+// principals sshd accepts for the account, the login name of a managed
+// user and the group and role principals mapped to a shared account.
+func (s *Service) AuthorizedPrincipals(ctx context.Context, account string) ([]string, error) {
+	principals := s.cfg.Principals.AccountPrincipals(account)
+
+	user, err := s.db.ReadUser(ctx, account)
+
+	switch {
+	case errors.Is(err, ErrNotFound) && len(principals) > 0:
+	case err != nil:
+		return nil, err
+	case lo.FromPtr(s.cfg.Principals.Username) && !user.Locked() && !user.Expired(time.Now()):
+		principals = append([]string{account}, principals...)
+	}
+
+	return principals, nil
+}
+
+// ListUsers implements IService. It returns up to limit users stored after
+// cursor and the cursor of the next page, which is empty on the last page.
+func (s *Service) ListUsers(ctx context.Context, cursor string, limit int) ([]KeyDto, string, error) {
+	if !lo.FromPtr(s.cfg.Nss.Enumerate) {
+		return nil, "", ErrEnumerationDisabled
+	}
+
+	return s.db.ListUsers(ctx, cursor, limit)
+}
+
 // AddUser implements IService.
 func (s *Service) AddUser(ctx context.Context, user KeyDto) error {
 	user.User.UID = s.cfg.Nss.MinUID + uint(hash(user.User.Username))
@@ -81,6 +190,40 @@ func (s *Service) AddUser(ctx context.Context, user KeyDto) error {
 	if user.User.Shell == "" {
 		user.User.Shell = s.cfg.Nss.Shell
 	}
+
+	user.Shadow = newShadow(user.User.Username, false, time.Time{})
+
+	groups, err := s.UserGroups(ctx, user.User.Username)
+	if err != nil {
+		return fmt.Errorf("user groups: %w", err)
+	}
+
+	groupNames := lo.Map(groups, func(item GroupDto, _ int) string {
+		return item.Group.Groupname
+	})
+
+	for i, key := range user.SshKeys {
+		sshKey, err := ParseSshKey(key.AuthorizedKey())
+		if err != nil {
+			return fmt.Errorf("key %d: %w", i, err)
+		}
+
+		if err := s.cfg.KeyPolicy.Check(sshKey, groupNames); err != nil {
+			return fmt.Errorf("key %d: %w", i, err)
+		}
+
+		sshKey.NotBefore, sshKey.NotAfter = key.NotBefore, key.NotAfter
+
+		if sshKey.Expired(time.Now()) {
+			return fmt.Errorf("key %d: %w: expired at %s", i, ErrInvalidKey, sshKey.NotAfter.Format(time.RFC3339))
+		}
+
+		user.SshKeys[i] = sshKey
+	}
+
+	user.Principals = s.cfg.Principals.Principals(user.User.Username, groupNames, nil)
+	user.Origin = OriginLocal
+
 	if err := s.db.CreateUser(ctx, user.User.Username, user); err != nil {
 		return fmt.Errorf("create user: %w", err)
 	}
@@ -92,65 +235,440 @@ func (s *Service) AddUser(ctx context.Context, user KeyDto) error {
 
 // Sync implements IService.
 func (s *Service) Sync(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Sync.EffectiveTimeout())
 
 	defer cancel()
 
+	// the cursor is taken first so that changes made while syncing are
+	// applied again by the next incremental sync
+	tracker, tracked := s.keycloak.(ChangeTracker)
+
+	var cursor string
+
+	if tracked {
+		var err error
+
+		// without a cursor every sync stays a full sync
+		if cursor, err = tracker.ChangeCursor(ctx); err != nil {
+			log.Warn().Err(err).Msg("change tracking unavailable")
+			tracked = false
+		}
+	}
+
+	// a partial listing is applied, the users stored from the failed
+	// sources are kept
+	var partial *PartialError
+
 	userDetails, err := s.keycloak.FetchUsers(ctx)
-	if err != nil {
+	if err != nil && !errors.As(err, &partial) {
 		return fmt.Errorf("fetch user: %w", err)
 	}
 
+	members := map[string][]string{}
+	provisioned := map[string]bool{}
+
+	if partial != nil {
+		kept, err := s.keepUsers(ctx, partial.Failed, provisioned, members)
+		if err != nil {
+			return err
+		}
+
+		log.Warn().Err(partial.Err).Int("kept", len(kept)).Msg("applying partial user listing")
+
+		// the kept users shadow users of the same name of the other sources
+		userDetails = lo.Reject(userDetails, func(item UserDetail, _ int) bool {
+			return lo.Contains(kept, item.Username)
+		})
+	}
+
 	for _, userDetail := range userDetails {
 
-		if userDetail.SshPublicKey == "" {
+		if len(userDetail.SshPublicKeys) == 0 {
 			continue
 		}
-		_, err := s.db.ReadUser(ctx, userDetail.Username)
 
-		if err != nil && !errors.Is(err, ErrNotFound) {
+		provisioned[userDetail.Username] = true
+
+		// memberships are recorded even if override kept the stored entry,
+		// otherwise the user would drop out of its groups
+		if err := s.storeUser(ctx, userDetail); err != nil {
+			return err
+		}
+
+		for _, group := range userDetail.Groups {
+			members[group] = append(members[group], userDetail.Username)
+		}
+	}
+
+	if err := s.revokeCertificates(ctx, userDetails); err != nil {
+		return fmt.Errorf("revoke certificates: %w", err)
+	}
+
+	if err := s.removeUsers(ctx, provisioned); err != nil {
+		return fmt.Errorf("remove users: %w", err)
+	}
+
+	if err := s.syncGroups(ctx, members); err != nil {
+		return fmt.Errorf("sync groups: %w", err)
+	}
+
+	if partial != nil {
+		return fmt.Errorf("fetch user: %w", partial)
+	}
+
+	if tracked {
+		if err := s.db.WriteState(ctx, stateChangeCursor, cursor); err != nil {
+			return fmt.Errorf("backend write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// keepUsers marks the stored users served from the failed sources as
+// provisioned, records their stored group memberships and returns them.
+// Users stored without their source are kept as well.
+func (s *Service) keepUsers(ctx context.Context, failed []string, provisioned map[string]bool, members map[string][]string) ([]string, error) {
+	var kept []string
+
+	for cursor := ""; ; {
+		users, next, err := s.db.ListUsers(ctx, cursor, 100)
+		if err != nil {
+			return nil, fmt.Errorf("backend read: %w", err)
+		}
+
+		for _, user := range users {
+			if user.Origin == OriginBackend && (user.Backend == "" || lo.Contains(failed, user.Backend)) {
+				kept = append(kept, user.User.Username)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		cursor = next
+	}
+
+	groups, err := s.db.ListGroups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backend read: %w", err)
+	}
+
+	for _, username := range kept {
+		provisioned[username] = true
+
+		for _, group := range groups {
+			if group.Origin != OriginScim && lo.Contains(group.Group.Members, username) {
+				members[group.Group.Groupname] = append(members[group.Group.Groupname], username)
+			}
+		}
+	}
+
+	return kept, nil
+}
+
+// storeUser writes a backend user with keys to the database. Existing users
+// which must not be overridden are left as stored.
+func (s *Service) storeUser(ctx context.Context, userDetail UserDetail) error {
+	existing, err := s.db.ReadUser(ctx, userDetail.Username)
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("backend read: %w", err)
+	}
+
+	if err == nil {
+		// disabling and re-enabling a synced user take effect regardless
+		// of override
+		status := existing.Origin == OriginBackend && (userDetail.Disabled || existing.Locked())
+
+		if !s.cfg.Nss.Override && !status {
+			log.Warn().Err(err).Str("user", userDetail.Username).Msgf("override disabled")
+			return nil
+		}
+	}
+
+	log.Info().Str("user", userDetail.Username).Bool("disabled", userDetail.Disabled).Msgf("creating")
+
+	if err := s.db.CreateUser(ctx, userDetail.Username, s.newUser(userDetail, OriginBackend)); err != nil {
+		return fmt.Errorf("backend write: %w", err)
+	}
+
+	return nil
+}
+
+// newUser builds the database entry of a user. The keys of disabled users
+// are recorded as rejected.
+func (s *Service) newUser(userDetail UserDetail, origin string) KeyDto {
+	sshKeys, rejectedKeys := s.checkKeys(userDetail)
+	principals := s.cfg.Principals.Principals(userDetail.Username, userDetail.Groups, userDetail.Roles)
+
+	if userDetail.Disabled {
+		for _, key := range sshKeys {
+			rejectedKeys = append(rejectedKeys, RejectedKey{
+				Key:         key.AuthorizedKey(),
+				Fingerprint: key.Fingerprint,
+				Reason:      "account disabled",
+				NotBefore:   key.NotBefore,
+				NotAfter:    key.NotAfter,
+			})
+		}
+
+		sshKeys, principals = nil, nil
+	}
+
+	return KeyDto{
+		User:         s.passwd(userDetail),
+		Shadow:       newShadow(userDetail.Username, userDetail.Disabled, userDetail.ExpiresAt),
+		SshKeys:      sshKeys,
+		RejectedKeys: rejectedKeys,
+		Principals:   principals,
+		Origin:       origin,
+		BackendId:    userDetail.Id,
+		Backend:      userDetail.Backend,
+	}
+}
+
+// passwd builds the passwd entry of a backend user. Account properties set
+// in the backend take precedence over the configured defaults, ids below
+// the configured minimum and relative paths are ignored.
+func (s *Service) passwd(userDetail UserDetail) structs.Passwd {
+	passwd := structs.Passwd{
+		Username: userDetail.Username,
+		UID:      s.cfg.Nss.MinUID + uint(hash(userDetail.Id)),
+		GID:      s.cfg.Nss.GroupID,
+		Dir:      fmt.Sprintf(s.cfg.Home, userDetail.Username),
+		Shell:    s.cfg.Nss.Shell,
+		Gecos:    userDetail.Fullname,
+	}
+
+	logger := log.With().Str("user", userDetail.Username).Logger()
+
+	switch {
+	case userDetail.UID == 0:
+	case userDetail.UID < s.cfg.Nss.MinUID:
+		logger.Warn().Uint("uid", userDetail.UID).Msg("ignoring uid below minuid")
+	default:
+		passwd.UID = userDetail.UID
+	}
+
+	switch {
+	case userDetail.GID == 0:
+	case userDetail.GID < s.cfg.Nss.GroupID:
+		logger.Warn().Uint("gid", userDetail.GID).Msg("ignoring gid below groupid")
+	default:
+		passwd.GID = userDetail.GID
+	}
+
+	if path.IsAbs(userDetail.Shell) {
+		passwd.Shell = userDetail.Shell
+	} else if userDetail.Shell != "" {
+		logger.Warn().Str("shell", userDetail.Shell).Msg("ignoring relative shell")
+	}
+
+	if path.IsAbs(userDetail.Home) {
+		passwd.Dir = path.Clean(userDetail.Home)
+	} else if userDetail.Home != "" {
+		logger.Warn().Str("home", userDetail.Home).Msg("ignoring relative home")
+	}
+
+	return passwd
+}
+
+// removeUsers deletes the users provisioned by an earlier sync which are no
+// longer returned by the backend, e.g. after leaving a required group or
+// removing all of their keys. Locally added users are kept.
+func (s *Service) removeUsers(ctx context.Context, provisioned map[string]bool) error {
+	var stale []string
+
+	for cursor := ""; ; {
+		users, next, err := s.db.ListUsers(ctx, cursor, 100)
+		if err != nil {
 			return fmt.Errorf("backend read: %w", err)
 		}
 
-		if err == nil {
-			if !s.cfg.Nss.Override {
-				log.Warn().Err(err).Str("user", userDetail.Username).Msgf("override disabled")
-				continue
+		for _, user := range users {
+			if user.Origin == OriginBackend && !provisioned[user.User.Username] {
+				stale = append(stale, user.User.Username)
 			}
 		}
 
-		log.Info().Str("user", userDetail.Username).Msgf("creating")
-
-		key := strings.Split(userDetail.SshPublicKey, " ")
-		if len(key) != 3 {
-			log.Error().Str("user", userDetail.Username).Msg("key format error")
-		}
-
-		err = s.db.CreateUser(ctx, userDetail.Username, KeyDto{
-			User: structs.Passwd{
-				Username: userDetail.Username,
-				UID:      s.cfg.Nss.MinUID + uint(hash(userDetail.Id)),
-				GID:      s.cfg.Nss.GroupID,
-				Dir:      fmt.Sprintf(s.cfg.Home, userDetail.Username),
-				Shell:    s.cfg.Nss.Shell,
-				Gecos:    userDetail.Fullname,
-			},
-			SshKeys: []SshKey{
-				{
-					Aglo: key[0],
-					Key:  key[1],
-					Name: key[2],
-				},
-			},
-		})
+		if next == "" {
+			break
+		}
+
+		cursor = next
+	}
+
+	for _, username := range stale {
+		log.Info().Str("user", username).Msg("removing")
+
+		if err := s.db.DeleteUser(ctx, username); err != nil {
+			return fmt.Errorf("backend delete: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// checkKeys parses the backend keys of the user and splits them into the
+// accepted keys and the keys rejected by the parser or the key policy.
+func (s *Service) checkKeys(userDetail UserDetail) ([]SshKey, []RejectedKey) {
+	var (
+		accepted []SshKey
+		rejected []RejectedKey
+	)
+
+	now := time.Now()
+
+	for i, publicKey := range userDetail.SshPublicKeys {
+		sshKey, err := ParseSshKey(publicKey)
+		if err == nil {
+			err = s.cfg.KeyPolicy.Check(sshKey, userDetail.Groups)
+		}
+
+		sshKey.NotBefore, sshKey.NotAfter = userDetail.KeyWindow(i)
+
+		if err == nil && sshKey.Expired(now) {
+			err = fmt.Errorf("key expired at %s", sshKey.NotAfter.Format(time.RFC3339))
+		}
+
 		if err != nil {
+			log.Warn().Err(err).Str("user", userDetail.Username).Msg("skipping key")
+
+			rejected = append(rejected, RejectedKey{
+				Key:         publicKey,
+				Fingerprint: sshKey.Fingerprint,
+				Reason:      err.Error(),
+				NotBefore:   sshKey.NotBefore,
+				NotAfter:    sshKey.NotAfter,
+			})
+
+			continue
+		}
+
+		accepted = append(accepted, sshKey)
+	}
+
+	return accepted, rejected
+}
+
+// PurgeExpiredKeys implements IService. It removes every key whose validity
+// ended from the database and returns the number of removed keys.
+func (s *Service) PurgeExpiredKeys(ctx context.Context) (int, error) {
+	var (
+		purged int
+		now    = time.Now()
+	)
+
+	// a single transaction keeps keys added meanwhile from being overwritten
+	err := s.db.UpdateUsers(ctx, func(user KeyDto) (KeyDto, bool) {
+		valid := lo.Reject(user.SshKeys, func(item SshKey, _ int) bool {
+			return item.Expired(now)
+		})
+
+		if len(valid) == len(user.SshKeys) {
+			return user, false
+		}
+
+		log.Info().Str("user", user.User.Username).Int("keys", len(user.SshKeys)-len(valid)).Msg("purging expired keys")
+
+		purged += len(user.SshKeys) - len(valid)
+		user.SshKeys = valid
+
+		return user, true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("backend write: %w", err)
+	}
+
+	return purged, nil
+}
+
+// syncGroups stores the given group memberships and removes groups which
+// no longer have any managed member. Groups pushed over SCIM are kept.
+func (s *Service) syncGroups(ctx context.Context, members map[string][]string) error {
+	groups, err := s.db.ListGroups(ctx)
+	if err != nil {
+		return fmt.Errorf("backend read: %w", err)
+	}
+
+	for name, users := range members {
+		if lo.ContainsBy(groups, func(item GroupDto) bool {
+			return item.Group.Groupname == name && item.Origin == OriginScim
+		}) {
+			log.Warn().Str("group", name).Msg("group provisioned over scim, ignoring backend members")
+			continue
+		}
+
+		if err := s.db.CreateGroup(ctx, name, s.newGroup(name, users)); err != nil {
 			return fmt.Errorf("backend write: %w", err)
 		}
 	}
 
+	for _, group := range groups {
+		if _, has := members[group.Group.Groupname]; has || group.Origin == OriginScim {
+			continue
+		}
+
+		log.Info().Str("group", group.Group.Groupname).Msg("removing")
+
+		if err := s.db.DeleteGroup(ctx, group.Group.Groupname); err != nil {
+			return fmt.Errorf("backend delete: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// newGroup builds the group entry of a backend group.
+func (s *Service) newGroup(name string, members []string) GroupDto {
+	return GroupDto{
+		Group: structs.Group{
+			Groupname: name,
+			Password:  "x",
+			GID:       s.cfg.Nss.MinGID + uint(hash(name)),
+			Members:   members,
+		},
+	}
+}
+
+// lockedPassword is the shadow password of disabled users.
+const lockedPassword = "!"
+
+// newShadow builds the shadow entry of a managed user. Managed users never
+// log in with a password, disabled users are locked and expired so that the
+// PAM account stage rejects them.
+func newShadow(username string, disabled bool, expiresAt time.Time) structs.Shadow {
+	shadow := structs.Shadow{
+		Username:        username,
+		Password:        "*",
+		LastChange:      -1,
+		MinChange:       -1,
+		MaxChange:       -1,
+		PasswordWarn:    -1,
+		InactiveLockout: -1,
+		ExpirationDate:  -1,
+		Reserved:        -1,
+	}
+
+	if !expiresAt.IsZero() {
+		shadow.ExpirationDate = daysSinceEpoch(expiresAt)
+	}
+
+	if disabled {
+		shadow.Password = lockedPassword
+		// an expiry in the past makes pam_unix reject the account
+		shadow.ExpirationDate = 1
+	}
+
+	return shadow
+}
+
+func daysSinceEpoch(t time.Time) int {
+	return int(t.Unix() / int64((24 * time.Hour).Seconds()))
+}
+
 func hash(s string) uint32 {
 	hash := sha256.Sum256([]byte(s))
 	// Take first 8 bytes for uint64
@@ -1,6 +1,9 @@
 package domain
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestHashStr(t *testing.T) {
 	h1 := hash("test")
@@ -15,3 +18,24 @@ func TestHashStr(t *testing.T) {
 		t.Fatalf("hash collision detected h1: %d h2: %d", h1, h2)
 	}
 }
+
+func TestNewShadow(t *testing.T) {
+	shadow := newShadow("test", false, time.Time{})
+
+	if shadow.Password != "*" || shadow.ExpirationDate != -1 {
+		t.Fatalf("unexpected shadow for active user: %+v", shadow)
+	}
+
+	expiresAt := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	shadow = newShadow("test", false, expiresAt)
+
+	if shadow.ExpirationDate != daysSinceEpoch(expiresAt) {
+		t.Fatalf("wrong expiration date: %d", shadow.ExpirationDate)
+	}
+
+	shadow = newShadow("test", true, expiresAt)
+
+	if shadow.Password != "!" || shadow.ExpirationDate != 1 {
+		t.Fatalf("disabled user is not locked: %+v", shadow)
+	}
+}
@@ -0,0 +1,51 @@
+package domain
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PublicKey decodes the key blob.
+func (k SshKey) PublicKey() (ssh.PublicKey, error) {
+	blob, err := base64.StdEncoding.DecodeString(k.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	pub, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	return pub, nil
+}
+
+// ParseSshKey parses a single authorized_keys line. Leading options and
+// comments containing spaces are supported, the comment may be missing.
+func ParseSshKey(line string) (SshKey, error) {
+	pub, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return SshKey{}, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+
+	if strings.TrimSpace(string(rest)) != "" {
+		return SshKey{}, fmt.Errorf("%w: more than one key in a line", ErrInvalidKey)
+	}
+
+	// sshd ignores certificates in authorized_keys, their wrapped key would
+	// also escape the key policy
+	if _, isCert := pub.(*ssh.Certificate); isCert {
+		return SshKey{}, fmt.Errorf("%w: certificates are not accepted as keys", ErrInvalidKey)
+	}
+
+	return SshKey{
+		Aglo:        pub.Type(),
+		Key:         base64.StdEncoding.EncodeToString(pub.Marshal()),
+		Name:        comment,
+		Options:     strings.Join(options, ","),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+	}, nil
+}
@@ -0,0 +1,56 @@
+package domain_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+func TestParseSshKey(t *testing.T) {
+	blob := strings.Fields(testEd25519Key)[1]
+
+	tests := []struct {
+		line    string
+		comment string
+		options string
+	}{
+		{line: "ssh-ed25519 " + blob + " alice@laptop", comment: "alice@laptop"},
+		{line: "ssh-ed25519 " + blob},
+		{line: "ssh-ed25519 " + blob + " alice work laptop", comment: "alice work laptop"},
+		{line: `from="10.0.0.0/8",no-pty ssh-ed25519 ` + blob + " alice", comment: "alice", options: `from="10.0.0.0/8",no-pty`},
+	}
+
+	for _, tt := range tests {
+		key, err := domain.ParseSshKey(tt.line)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.line, err)
+		}
+
+		if key.Aglo != "ssh-ed25519" || key.Key != blob {
+			t.Fatalf("wrong key parsed from %q: %+v", tt.line, key)
+		}
+
+		if key.Name != tt.comment || key.Options != tt.options {
+			t.Fatalf("wrong comment or options parsed from %q: %+v", tt.line, key)
+		}
+
+		if !strings.HasPrefix(key.Fingerprint, "SHA256:") {
+			t.Fatalf("missing fingerprint: %q", key.Fingerprint)
+		}
+	}
+}
+
+func TestParseSshKeyInvalid(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"ssh-ed25519",
+		"ssh-ed25519 not-base64 alice",
+		"ssh-rsa AAAAB3NzaC1yc2EAAAABIwAAAQEAt user@keycloak",
+	} {
+		if _, err := domain.ParseSshKey(line); !errors.Is(err, domain.ErrInvalidKey) {
+			t.Fatalf("expected invalid key error for %q, got %v", line, err)
+		}
+	}
+}
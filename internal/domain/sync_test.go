@@ -0,0 +1,782 @@
+package domain_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2hsecure/sshkeyman/internal/adapter"
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+	"github.com/protosam/go-libnss/structs"
+	"github.com/samber/lo"
+)
+
+const (
+	testEd25519Key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKv4yZWYQyaxYLL1yFAqzHMW1gtl40twzGGLgW+HQdii alice@laptop"
+	testEcdsaKey   = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBBrpEURt84wm0le8rqNQP6h2FXa43hE/CtihCJ8XOb7WlI6oKB0kI7TbtYz9plar1B3kat70Qw7iu4tYkZ+fOPM= alice@yubikey"
+)
+
+type fakeBackend struct {
+	users []domain.UserDetail
+	// tokens maps access tokens to usernames
+	tokens map[string]string
+	err    error
+}
+
+func (f *fakeBackend) VerifyToken(ctx context.Context, token string) (string, error) {
+	username, has := f.tokens[token]
+	if !has {
+		return "", fmt.Errorf("invalid token")
+	}
+
+	return username, nil
+}
+
+func (f *fakeBackend) FetchUser(ctx context.Context, username string) (domain.UserDetail, error) {
+	user, found := lo.Find(f.users, func(item domain.UserDetail) bool {
+		return item.Username == username
+	})
+	if !found {
+		return domain.UserDetail{}, domain.ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (f *fakeBackend) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
+	return f.users, f.err
+}
+
+func newTestConfig() *domain.Config {
+	return &domain.Config{
+		Nss: domain.NSSConfig{
+			MinUID:    10000,
+			MinGID:    10000,
+			GroupID:   1000,
+			Override:  true,
+			Shell:     "/bin/bash",
+			Enumerate: lo.ToPtr(true),
+		},
+		Home: "/home/%s",
+	}
+}
+
+func newTestService(t *testing.T, cfg *domain.Config, backend domain.Backend) domain.IService {
+	db, err := adapter.NewBoldDB(filepath.Join(t.TempDir(), "users.db"), false)
+	if err != nil {
+		t.Fatalf("db open: %v", err)
+	}
+
+	t.Cleanup(func() { _ = db.Close() })
+
+	return domain.NewService(cfg, db, backend)
+}
+
+func TestSyncMultipleKeys(t *testing.T) {
+	srv := newTestService(t, newTestConfig(), &fakeBackend{
+		users: []domain.UserDetail{
+			{
+				Id:            "1",
+				Username:      "alice",
+				SshPublicKeys: []string{testEd25519Key, testEcdsaKey},
+			},
+		},
+	})
+
+	if err := srv.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err := srv.FindUser(context.Background(), domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if len(user.SshKeys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(user.SshKeys))
+	}
+}
+
+func TestSyncSkipsInvalidKeys(t *testing.T) {
+	srv := newTestService(t, newTestConfig(), &fakeBackend{
+		users: []domain.UserDetail{
+			{
+				Id:            "1",
+				Username:      "alice",
+				SshPublicKeys: []string{"ssh-rsa broken", testEd25519Key},
+			},
+			{
+				Id:            "2",
+				Username:      "bob",
+				SshPublicKeys: []string{"ssh-ed25519"},
+			},
+		},
+	})
+
+	if err := srv.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err := srv.FindUser(context.Background(), domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if len(user.SshKeys) != 1 || user.SshKeys[0].Name != "alice@laptop" {
+		t.Fatalf("unexpected keys: %+v", user.SshKeys)
+	}
+}
+
+func TestSyncRecordsRejectedKeys(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.KeyPolicy.AllowedAlgorithms = []string{"ssh-ed25519"}
+
+	srv := newTestService(t, cfg, &fakeBackend{
+		users: []domain.UserDetail{
+			{
+				Id:            "1",
+				Username:      "alice",
+				SshPublicKeys: []string{testEd25519Key, testEcdsaKey},
+			},
+		},
+	})
+
+	if err := srv.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err := srv.FindUser(context.Background(), domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if len(user.SshKeys) != 1 || user.SshKeys[0].Aglo != "ssh-ed25519" {
+		t.Fatalf("unexpected keys: %+v", user.SshKeys)
+	}
+
+	if len(user.RejectedKeys) != 1 || user.RejectedKeys[0].Key != testEcdsaKey || user.RejectedKeys[0].Reason == "" {
+		t.Fatalf("unexpected rejected keys: %+v", user.RejectedKeys)
+	}
+
+	err = srv.AddUser(context.Background(), domain.KeyDto{
+		User:    user.User,
+		SshKeys: []domain.SshKey{{Aglo: "ecdsa-sha2-nistp256", Key: strings.Fields(testEcdsaKey)[1]}},
+	})
+	if !errors.Is(err, domain.ErrKeyPolicy) {
+		t.Fatalf("expected policy error, got %v", err)
+	}
+}
+
+func TestSyncKeyValidity(t *testing.T) {
+	now := time.Now()
+
+	srv := newTestService(t, newTestConfig(), &fakeBackend{
+		users: []domain.UserDetail{
+			{
+				Id:              "1",
+				Username:        "alice",
+				SshPublicKeys:   []string{testEd25519Key, testEcdsaKey},
+				SshKeyNotBefore: []time.Time{now.Add(time.Hour)},
+				SshKeyNotAfter:  []time.Time{{}, now.Add(-time.Hour)},
+			},
+		},
+	})
+
+	if err := srv.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err := srv.FindUser(context.Background(), domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if len(user.SshKeys) != 1 || len(user.RejectedKeys) != 1 {
+		t.Fatalf("expired key not rejected: %+v %+v", user.SshKeys, user.RejectedKeys)
+	}
+
+	if len(user.ValidKeys(now)) != 0 || len(user.ValidKeys(now.Add(2*time.Hour))) != 1 {
+		t.Fatalf("key served outside of its validity window")
+	}
+}
+
+func TestPurgeExpiredKeys(t *testing.T) {
+	db, err := adapter.NewBoldDB(filepath.Join(t.TempDir(), "users.db"), false)
+	if err != nil {
+		t.Fatalf("db open: %v", err)
+	}
+
+	t.Cleanup(func() { _ = db.Close() })
+
+	err = db.CreateUser(context.Background(), "alice", domain.KeyDto{
+		User: structs.Passwd{Username: "alice"},
+		SshKeys: []domain.SshKey{
+			{Aglo: "ssh-ed25519", Key: "AAAA", NotAfter: time.Now().Add(-time.Minute)},
+			{Aglo: "ssh-ed25519", Key: "BBBB", NotAfter: time.Now().Add(time.Hour)},
+			{Aglo: "ssh-ed25519", Key: "CCCC"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	srv := domain.NewService(newTestConfig(), db, &fakeBackend{})
+
+	purged, err := srv.PurgeExpiredKeys(context.Background())
+	if err != nil || purged != 1 {
+		t.Fatalf("purge: %d %v", purged, err)
+	}
+
+	user, err := db.ReadUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("read user: %v", err)
+	}
+
+	if len(user.SshKeys) != 2 || user.SshKeys[0].Key != "BBBB" {
+		t.Fatalf("unexpected keys after purge: %+v", user.SshKeys)
+	}
+}
+
+func TestSyncPrincipals(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := newTestConfig()
+	cfg.Principals = domain.PrincipalsConfig{
+		Username:       lo.ToPtr(true),
+		Groups:         []string{"admins"},
+		Roles:          []string{"*"},
+		Prefix:         "group-",
+		SharedAccounts: map[string][]string{"deploy": {"admins"}},
+	}
+
+	srv := newTestService(t, cfg, &fakeBackend{
+		users: []domain.UserDetail{
+			{
+				Id:            "1",
+				Username:      "alice",
+				SshPublicKeys: []string{testEd25519Key},
+				Groups:        []string{"developers", "admins"},
+				Roles:         []string{"ops"},
+			},
+			{Id: "2", Username: "bob", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"admins"}},
+			{Id: "3", Username: "carol", SshPublicKeys: []string{testEd25519Key}, ExpiresAt: time.Now().AddDate(0, 0, -2)},
+		},
+	})
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if strings.Join(user.Principals, ",") != "alice,group-admins" {
+		t.Fatalf("unexpected principals: %v", user.Principals)
+	}
+
+	// personal accounts only accept their login name, the group principal
+	// of alice must not log her in as bob
+	for account, want := range map[string]string{"bob": "bob", "deploy": "group-admins", "carol": ""} {
+		principals, err := srv.AuthorizedPrincipals(ctx, account)
+		if err != nil {
+			t.Fatalf("authorized principals of %s: %v", account, err)
+		}
+
+		if strings.Join(principals, ",") != want {
+			t.Fatalf("unexpected principals of %s: %v", account, principals)
+		}
+	}
+
+	if _, err := srv.AuthorizedPrincipals(ctx, "mallory"); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestSyncTruncatedListing(t *testing.T) {
+	backend := &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"ops"}},
+		},
+	}
+
+	srv := newTestService(t, newTestConfig(), backend)
+
+	if err := srv.Sync(context.Background()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	backend.users, backend.err = nil, fmt.Errorf("%w: listed 0 of 1 users", domain.ErrTruncated)
+
+	if err := srv.Sync(context.Background()); !errors.Is(err, domain.ErrTruncated) {
+		t.Fatalf("expected truncated listing error, got %v", err)
+	}
+
+	if _, err := srv.FindGroup(context.Background(), domain.WithGroupname("ops")); err != nil {
+		t.Fatalf("group removed after truncated listing: %v", err)
+	}
+}
+
+func TestSyncPartialListing(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"ops"}, Backend: "keycloak"},
+			{Id: "2", Username: "bob", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"ops"}, Backend: "ldap"},
+			{Id: "3", Username: "carol", SshPublicKeys: []string{testEd25519Key}, Backend: "keycloak"},
+		},
+	}
+
+	srv := newTestService(t, newTestConfig(), backend)
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	// the source of bob failed, carol was removed from the one which
+	// answered and the bob it lists is shadowed by the stored one
+	backend.users = []domain.UserDetail{
+		{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key, testEcdsaKey}, Groups: []string{"ops"}, Backend: "keycloak"},
+		{Id: "4", Username: "bob", SshPublicKeys: []string{testEcdsaKey}, Backend: "keycloak"},
+	}
+	backend.err = &domain.PartialError{Failed: []string{"ldap"}, Err: errors.New("backend ldap: connection refused")}
+
+	var partial *domain.PartialError
+	if err := srv.Sync(ctx); !errors.As(err, &partial) {
+		t.Fatalf("expected partial listing error, got %v", err)
+	}
+
+	alice, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	if err != nil || len(alice.SshKeys) != 2 {
+		t.Fatalf("partial listing not applied: %+v %v", alice, err)
+	}
+
+	if bob, err := srv.FindUser(ctx, domain.WithUsername("bob")); err != nil || bob.BackendId != "2" {
+		t.Fatalf("user of the failed source not kept: %+v %v", bob, err)
+	}
+
+	if _, err := srv.FindUser(ctx, domain.WithUsername("carol")); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("carol not removed: %v", err)
+	}
+
+	ops, err := srv.FindGroup(ctx, domain.WithGroupname("ops"))
+	if err != nil || strings.Join(slices.Sorted(slices.Values(ops.Group.Members)), ",") != "alice,bob" {
+		t.Fatalf("unexpected members of ops: %+v %v", ops, err)
+	}
+}
+
+// blockingBackend lists users only after the context is done.
+type blockingBackend struct {
+	fakeBackend
+}
+
+func (b *blockingBackend) FetchUsers(ctx context.Context) ([]domain.UserDetail, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSyncTimeout(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Sync.Timeout = 50 * time.Millisecond
+
+	srv := newTestService(t, cfg, &blockingBackend{})
+
+	start := time.Now()
+
+	if err := srv.Sync(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("configured timeout ignored, sync took %s", elapsed)
+	}
+}
+
+func TestSyncRemovesUsers(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}},
+			{Id: "2", Username: "bob", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"ops"}},
+			{Id: "3", Username: "carol", SshPublicKeys: []string{testEd25519Key}},
+		},
+	}
+
+	srv := newTestService(t, newTestConfig(), backend)
+
+	key, _ := domain.ParseSshKey(testEcdsaKey)
+	if err := srv.AddUser(ctx, domain.KeyDto{User: structs.Passwd{Username: "local"}, SshKeys: []domain.SshKey{key}}); err != nil {
+		t.Fatalf("add user: %v", err)
+	}
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	// bob left the required group, carol removed all of her keys
+	backend.users = []domain.UserDetail{
+		backend.users[0],
+		{Id: "3", Username: "carol"},
+	}
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	for _, username := range []string{"alice", "local"} {
+		if _, err := srv.FindUser(ctx, domain.WithUsername(username)); err != nil {
+			t.Fatalf("%s removed: %v", username, err)
+		}
+	}
+
+	for _, username := range []string{"bob", "carol"} {
+		if _, err := srv.FindUser(ctx, domain.WithUsername(username)); !errors.Is(err, domain.ErrNotFound) {
+			t.Fatalf("%s not removed: %v", username, err)
+		}
+	}
+
+	if _, err := srv.FindGroup(ctx, domain.WithGroupname("ops")); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("group of removed user kept: %v", err)
+	}
+}
+
+func TestSyncOverrideDisabledMemberships(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := newTestConfig()
+	cfg.Nss.Override = false
+
+	backend := &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"ops"}},
+		},
+	}
+
+	srv := newTestService(t, cfg, backend)
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	// the stored entry is kept, the memberships must be as well
+	backend.users[0].SshPublicKeys = append(backend.users[0].SshPublicKeys, testEcdsaKey)
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	if err != nil || len(user.SshKeys) != 1 {
+		t.Fatalf("stored entry overridden: %+v %v", user, err)
+	}
+
+	ops, err := srv.FindGroup(ctx, domain.WithGroupname("ops"))
+	if err != nil || !lo.Contains(ops.Group.Members, "alice") {
+		t.Fatalf("alice dropped from ops: %+v %v", ops, err)
+	}
+}
+
+func TestSyncDisabledUser(t *testing.T) {
+	ctx := context.Background()
+	caPath, _ := newTestCA(t)
+
+	cfg := newTestConfig()
+	// disabling a user is applied even without override
+	cfg.Nss.Override = false
+	cfg.Principals.Username = lo.ToPtr(true)
+	cfg.CA = domain.CAConfig{KeyPath: caPath}
+
+	backend := &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}},
+		},
+	}
+
+	srv := newTestService(t, cfg, backend)
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if _, err := srv.IssueCertificate(ctx, "alice", testEd25519Key, ""); err != nil {
+		t.Fatalf("issue certificate: %v", err)
+	}
+
+	backend.users[0].Disabled = true
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if len(user.SshKeys) != 0 || len(user.Principals) != 0 {
+		t.Fatalf("disabled user kept keys %v, principals %v", user.SshKeys, user.Principals)
+	}
+
+	if len(user.RejectedKeys) != 1 || user.RejectedKeys[0].Reason != "account disabled" {
+		t.Fatalf("unexpected rejected keys: %v", user.RejectedKeys)
+	}
+
+	if user.Shadow.Password != "!" {
+		t.Fatalf("account not locked: %v", user.Shadow)
+	}
+
+	certs, err := srv.ListCertificates(ctx)
+	if err != nil {
+		t.Fatalf("list certificates: %v", err)
+	}
+
+	if len(certs) != 1 || !certs[0].Revoked {
+		t.Fatalf("certificate of disabled user not revoked: %v", certs)
+	}
+
+	// re-enabling is applied without override as well
+	backend.users[0].Disabled = false
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	user, err = srv.FindUser(ctx, domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if user.Locked() || len(user.SshKeys) != 1 {
+		t.Fatalf("user not re-enabled: %v, keys %v", user.Shadow, user.SshKeys)
+	}
+}
+
+func TestSyncRevokedBefore(t *testing.T) {
+	ctx := context.Background()
+	caPath, _ := newTestCA(t)
+
+	cfg := newTestConfig()
+	cfg.Principals.Username = lo.ToPtr(true)
+	cfg.CA = domain.CAConfig{KeyPath: caPath}
+
+	backend := &fakeBackend{
+		users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}},
+		},
+	}
+
+	srv := newTestService(t, cfg, backend)
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if _, err := srv.IssueCertificate(ctx, "alice", testEd25519Key, ""); err != nil {
+		t.Fatalf("issue certificate: %v", err)
+	}
+
+	backend.users[0].RevokedBefore = time.Now()
+
+	if _, err := srv.IssueCertificate(ctx, "alice", testEd25519Key, ""); err != nil {
+		t.Fatalf("issue certificate: %v", err)
+	}
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	certs, err := srv.ListCertificates(ctx)
+	if err != nil {
+		t.Fatalf("list certificates: %v", err)
+	}
+
+	revoked := lo.CountBy(certs, func(item domain.CertDto) bool {
+		return item.Revoked
+	})
+
+	if len(certs) != 2 || revoked != 1 {
+		t.Fatalf("expected one of two certificates revoked: %v", certs)
+	}
+
+	user, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if len(user.SshKeys) != 1 {
+		t.Fatalf("keys revoked with the sessions: %v", user.SshKeys)
+	}
+}
+
+func TestSyncAccountAttributes(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeBackend{
+		users: []domain.UserDetail{
+			{
+				Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key},
+				UID: 20001, GID: 5000, Shell: "/bin/zsh", Home: "/srv/home/alice/",
+			},
+			{
+				Id: "2", Username: "mallory", SshPublicKeys: []string{testEd25519Key},
+				UID: 0, GID: 27, Shell: "zsh", Home: "home/mallory",
+			},
+			{
+				Id: "3", Username: "bob", SshPublicKeys: []string{testEd25519Key},
+				UID: 500,
+			},
+		},
+	}
+
+	cfg := newTestConfig()
+	srv := newTestService(t, cfg, backend)
+
+	if err := srv.Sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	alice, err := srv.FindUser(ctx, domain.WithUsername("alice"))
+	if err != nil {
+		t.Fatalf("find user: %v", err)
+	}
+
+	if alice.User.UID != 20001 || alice.User.GID != 5000 || alice.User.Shell != "/bin/zsh" || alice.User.Dir != "/srv/home/alice" {
+		t.Fatalf("backend attributes not applied: %+v", alice.User)
+	}
+
+	for _, username := range []string{"mallory", "bob"} {
+		user, err := srv.FindUser(ctx, domain.WithUsername(username))
+		if err != nil {
+			t.Fatalf("find user: %v", err)
+		}
+
+		if user.User.UID < cfg.Nss.MinUID || user.User.GID != cfg.Nss.GroupID ||
+			user.User.Shell != cfg.Nss.Shell || user.User.Dir != fmt.Sprintf(cfg.Home, username) {
+			t.Fatalf("invalid backend attributes applied: %+v", user.User)
+		}
+	}
+}
+
+// fakeTracker reports the configured changes after any cursor.
+type fakeTracker struct {
+	fakeBackend
+	cursor  string
+	changes domain.Changes
+	since   []string
+	err     error
+}
+
+func (f *fakeTracker) ChangeCursor(ctx context.Context) (string, error) {
+	return f.cursor, nil
+}
+
+func (f *fakeTracker) FetchChanges(ctx context.Context, cursor string) (domain.Changes, error) {
+	f.since = append(f.since, cursor)
+	return f.changes, f.err
+}
+
+func TestSyncChanges(t *testing.T) {
+	ctx := context.Background()
+	backend := &fakeTracker{
+		cursor: "1",
+		fakeBackend: fakeBackend{
+			users: []domain.UserDetail{
+				{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"ops"}},
+				{Id: "2", Username: "bob", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"ops", "db"}},
+			},
+		},
+	}
+
+	srv := newTestService(t, newTestConfig(), backend)
+
+	// the first sync is a full sync
+	if err := srv.SyncChanges(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if len(backend.since) != 0 {
+		t.Fatalf("changes fetched without cursor: %v", backend.since)
+	}
+
+	backend.changes = domain.Changes{
+		Users: []domain.UserDetail{
+			{Id: "1", Username: "alice", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"dev"}},
+			{Id: "3", Username: "carol", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"dev"}},
+		},
+		Removed: []string{"2"},
+		Cursor:  "2",
+	}
+
+	if err := srv.SyncChanges(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if err := srv.SyncChanges(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if strings.Join(backend.since, ",") != "1,2" {
+		t.Fatalf("unexpected cursors: %v", backend.since)
+	}
+
+	if _, err := srv.FindUser(ctx, domain.WithUsername("carol")); err != nil {
+		t.Fatalf("changed user not added: %v", err)
+	}
+
+	if _, err := srv.FindUser(ctx, domain.WithUsername("bob")); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("removed user kept: %v", err)
+	}
+
+	for _, name := range []string{"ops", "db"} {
+		if _, err := srv.FindGroup(ctx, domain.WithGroupname(name)); !errors.Is(err, domain.ErrNotFound) {
+			t.Fatalf("group %s without members kept: %v", name, err)
+		}
+	}
+
+	dev, err := srv.FindGroup(ctx, domain.WithGroupname("dev"))
+	if err != nil {
+		t.Fatalf("find group: %v", err)
+	}
+
+	if strings.Join(dev.Group.Members, ",") != "alice,carol" {
+		t.Fatalf("unexpected members: %v", dev.Group.Members)
+	}
+
+	// a renamed user is only served under the new name
+	backend.changes = domain.Changes{
+		Users:  []domain.UserDetail{{Id: "3", Username: "carol.smith", SshPublicKeys: []string{testEd25519Key}, Groups: []string{"dev"}}},
+		Cursor: "3",
+	}
+
+	if err := srv.SyncChanges(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if _, err := srv.FindUser(ctx, domain.WithUsername("carol")); !errors.Is(err, domain.ErrNotFound) {
+		t.Fatalf("old name of the renamed user kept: %v", err)
+	}
+
+	if _, err := srv.FindUser(ctx, domain.WithUsername("carol.smith")); err != nil {
+		t.Fatalf("renamed user not added: %v", err)
+	}
+
+	if dev, err := srv.FindGroup(ctx, domain.WithGroupname("dev")); err != nil || strings.Join(dev.Group.Members, ",") != "alice,carol.smith" {
+		t.Fatalf("unexpected members after rename: %+v %v", dev, err)
+	}
+
+	// unavailable change tracking falls back to a full sync
+	backend.err = fmt.Errorf("forbidden")
+
+	if err := srv.SyncChanges(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	if _, err := srv.FindUser(ctx, domain.WithUsername("bob")); err != nil {
+		t.Fatalf("full sync not run: %v", err)
+	}
+}
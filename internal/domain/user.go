@@ -2,24 +2,143 @@ package domain
 
 import (
 	"context"
+	"time"
 
 	nss "github.com/protosam/go-libnss/structs"
+	"github.com/samber/lo"
 )
 
 type KeyDto struct {
 	User    nss.Passwd
+	Shadow  nss.Shadow
 	SshKeys []SshKey `json:"sshkeys"`
+	// RejectedKeys are the keys of the user dropped by the key parser or
+	// the key policy
+	RejectedKeys []RejectedKey `json:"rejected_keys,omitempty"`
+	// Principals are the ssh certificate principals of the user
+	Principals []string `json:"principals,omitempty"`
+	// Origin is OriginBackend for users provisioned by Sync, only those are
+	// removed when they disappear from the backend
+	Origin string `json:"origin,omitempty"`
+	// BackendId is the id of the user in the backend, used to apply
+	// backend changes reported by id, or the SCIM id of the user
+	BackendId string `json:"backend_id,omitempty"`
+	// Backend is the backend of a composite backend the user was served
+	// from, see UserDetail.Backend
+	Backend string `json:"backend,omitempty"`
 }
 
+const (
+	OriginBackend = "backend"
+	OriginLocal   = "local"
+	// OriginScim marks the users and groups pushed over SCIM, they are left
+	// alone by Sync
+	OriginScim = "scim"
+)
+
 type SshKey struct {
-	Aglo string `json:"algo"`
-	Key  string `json:"key"`
-	Name string `json:"name"`
+	Aglo        string `json:"algo"`
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Options     string `json:"options,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// NotBefore and NotAfter limit when the key is served, zero times are
+	// unrestricted
+	NotBefore time.Time `json:"not_before,omitzero"`
+	NotAfter  time.Time `json:"not_after,omitzero"`
+}
+
+// ValidAt reports whether the key may be used at the given time.
+func (k SshKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+
+	return k.NotAfter.IsZero() || t.Before(k.NotAfter)
+}
+
+// Expired reports whether the key can never be used again after t.
+func (k SshKey) Expired(t time.Time) bool {
+	return !k.NotAfter.IsZero() && !t.Before(k.NotAfter)
+}
+
+// AuthorizedKey formats the key as an authorized_keys line without the
+// trailing newline.
+func (k SshKey) AuthorizedKey() string {
+	line := k.Aglo + " " + k.Key
+
+	if k.Options != "" {
+		line = k.Options + " " + line
+	}
+
+	if k.Name != "" {
+		line += " " + k.Name
+	}
+
+	return line
+}
+
+// Locked reports whether the account is disabled.
+func (k KeyDto) Locked() bool {
+	return k.Shadow.Password == lockedPassword
+}
+
+// Expired reports whether the shadow entry expired the account at the
+// given time. Entries stored without an expiry never expire.
+func (k KeyDto) Expired(t time.Time) bool {
+	return k.Shadow.ExpirationDate > 0 && daysSinceEpoch(t) >= k.Shadow.ExpirationDate
+}
+
+// ValidKeys returns the keys which may be used at the given time, none once
+// the account expired.
+func (k KeyDto) ValidKeys(t time.Time) []SshKey {
+	if k.Expired(t) {
+		return nil
+	}
+
+	return lo.Filter(k.SshKeys, func(item SshKey, _ int) bool {
+		return item.ValidAt(t)
+	})
+}
+
+type GroupDto struct {
+	Group nss.Group
+	// Origin is OriginScim for groups pushed over SCIM, other groups are
+	// managed by Sync
+	Origin string `json:"origin,omitempty"`
+	// BackendId is the SCIM id of the group
+	BackendId string `json:"backend_id,omitempty"`
+}
+
+// CertDto is the audit record of an issued ssh certificate.
+type CertDto struct {
+	Serial      uint64    `json:"serial"`
+	KeyId       string    `json:"key_id"`
+	Username    string    `json:"username"`
+	Fingerprint string    `json:"fingerprint"`
+	Principals  []string  `json:"principals"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	IssuedAt    time.Time `json:"issued_at,omitzero"`
+	Revoked     bool      `json:"revoked,omitempty"`
 }
 
 type BoltDB interface {
 	CreateUser(context.Context, string, KeyDto) error
 	ReadUser(context.Context, string) (KeyDto, error)
 	ReadUserById(context.Context, uint) (KeyDto, error)
+	ListUsers(context.Context, string, int) ([]KeyDto, string, error)
+	DeleteUser(context.Context, string) error
+	UpdateUsers(context.Context, func(KeyDto) (KeyDto, bool)) error
+	CreateGroup(context.Context, string, GroupDto) error
+	ReadGroup(context.Context, string) (GroupDto, error)
+	ReadGroupById(context.Context, uint) (GroupDto, error)
+	ListGroups(context.Context) ([]GroupDto, error)
+	DeleteGroup(context.Context, string) error
+	CreateCert(context.Context, CertDto) error
+	ReadCert(context.Context, uint64) (CertDto, error)
+	ListCerts(context.Context) ([]CertDto, error)
+	ReadState(context.Context, string) (string, error)
+	WriteState(context.Context, string, string) error
 	Close() error
 }
@@ -0,0 +1,87 @@
+package domain_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/protosam/go-libnss/structs"
+
+	"github.com/h2hsecure/sshkeyman/internal/domain"
+)
+
+func TestAuthorizedKey(t *testing.T) {
+	tests := []struct {
+		key  domain.SshKey
+		want string
+	}{
+		{
+			key:  domain.SshKey{Aglo: "ssh-ed25519", Key: "AAAA", Name: "alice@laptop"},
+			want: "ssh-ed25519 AAAA alice@laptop",
+		},
+		{
+			key:  domain.SshKey{Aglo: "ssh-ed25519", Key: "AAAA"},
+			want: "ssh-ed25519 AAAA",
+		},
+		{
+			key:  domain.SshKey{Aglo: "sk-ssh-ed25519@openssh.com", Key: "AAAA", Name: "alice yubikey", Options: `from="10.0.0.0/8",no-pty`},
+			want: `from="10.0.0.0/8",no-pty sk-ssh-ed25519@openssh.com AAAA alice yubikey`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.key.AuthorizedKey(); got != tt.want {
+			t.Fatalf("authorized key mismatch: %q != %q", got, tt.want)
+		}
+	}
+}
+
+func TestSshKeyValidAt(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	key := domain.SshKey{
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+	}
+
+	if !key.ValidAt(now) || key.Expired(now) {
+		t.Fatalf("key should be valid")
+	}
+
+	if key.ValidAt(now.Add(-2*time.Hour)) || key.Expired(now.Add(-2*time.Hour)) {
+		t.Fatalf("key should not be valid yet")
+	}
+
+	if key.ValidAt(now.Add(time.Hour)) || !key.Expired(now.Add(time.Hour)) {
+		t.Fatalf("key should be expired")
+	}
+
+	if !(domain.SshKey{}).ValidAt(now) {
+		t.Fatalf("unrestricted key should be valid")
+	}
+}
+
+func TestKeyDtoExpired(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	user := domain.KeyDto{
+		Shadow:  structs.Shadow{Username: "alice", ExpirationDate: int(now.Unix() / 86400)},
+		SshKeys: []domain.SshKey{{Aglo: "ssh-ed25519", Key: "AAAA"}},
+	}
+
+	if user.Expired(now.AddDate(0, 0, -1)) || len(user.ValidKeys(now.AddDate(0, 0, -1))) != 1 {
+		t.Fatalf("account expired too early")
+	}
+
+	// the account expires at the start of the expiry day, as for pam_unix
+	if !user.Expired(now) || len(user.ValidKeys(now)) != 0 {
+		t.Fatalf("keys of the expired account served")
+	}
+
+	user.Shadow.ExpirationDate = -1
+	if user.Expired(now) {
+		t.Fatalf("account without expiry expired")
+	}
+
+	// users stored without shadow information
+	if (domain.KeyDto{}).Expired(now) {
+		t.Fatalf("account without shadow entry expired")
+	}
+}
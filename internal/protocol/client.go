@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Client is a single request connection to a daemon socket.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Dial connects to the unix socket at path. Every read and write on the
+// connection must finish within timeout.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("deadline: %w", err)
+	}
+
+	return &Client{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Send writes a request frame.
+func (c *Client) Send(command string, args ...string) error {
+	return WriteFrame(c.conn, Frame{
+		Status: StatusOK,
+		Fields: append([]string{command}, args...),
+	})
+}
+
+// Receive reads the next response frame.
+func (c *Client) Receive() (Frame, error) {
+	return ReadFrame(c.r)
+}
+
+// Call sends a request and reads a single response frame. A non OK status
+// is returned as error.
+func (c *Client) Call(command string, args ...string) (Frame, error) {
+	if err := c.Send(command, args...); err != nil {
+		return Frame{}, err
+	}
+
+	f, err := c.Receive()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return f, f.Err()
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
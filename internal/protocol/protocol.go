@@ -0,0 +1,244 @@
+// Package protocol implements the framed wire protocol spoken on the daemon
+// and management sockets by the daemon, the cli commands and the NSS module.
+//
+// A frame is encoded as
+//
+//	version  uint8   always Version
+//	status   uint8   Status of a response, StatusOK for requests
+//	count    uint16  number of fields, big endian
+//	fields   count times: uint32 big endian length followed by the bytes
+//
+// Requests carry the command in the first field and its arguments in the
+// remaining fields. Responses carry one record per frame:
+//
+//	passwd   name, password, uid, gid, gecos, dir, shell
+//	group    name, password, gid, comma separated members
+//	shadow   name, password, lastchg, min, max, warn, inact, expire
+//	sshkey   algo, key, comment, authorized_keys options
+//	principals  one field per ssh certificate principal
+//	keystate "accepted", "inactive" or "rejected", fingerprint, key,
+//	         validity window or rejection reason
+//	cert     serial, key id, username, fingerprint, comma separated
+//	         principals, valid after, valid before, revoked
+//
+// Error responses of the management socket may carry a human readable
+// message in their first field.
+//
+// Commands returning several records (GETSSHKEY, GETPWENT, GETKEYS, CERTS) finish the stream
+// with a StatusEnd frame. GETPWENT puts the cursor of the next page, if any,
+// into the end frame.
+//
+// During rollout the daemon still accepts the legacy newline terminated text
+// commands; ReadRequest tells both apart by the first byte.
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Version is the first byte of every frame. It is never a printable
+// character so that legacy text requests can be told apart.
+const Version byte = 0x01
+
+const (
+	// MaxFields is the maximum number of fields in a frame.
+	MaxFields = 1024
+	// MaxFieldLen is the maximum length of a single field.
+	MaxFieldLen = 64 * 1024
+	// MaxFrameLen is the maximum accumulated field length of a frame.
+	MaxFrameLen = 1024 * 1024
+)
+
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusUnavail
+	StatusTryAgain
+	StatusEnd
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusNotFound:
+		return "NOTFOUND"
+	case StatusUnavail:
+		return "UNAVAIL"
+	case StatusTryAgain:
+		return "TRYAGAIN"
+	case StatusEnd:
+		return "END"
+	default:
+		return fmt.Sprintf("STATUS(%d)", uint8(s))
+	}
+}
+
+var (
+	ErrMalformed = errors.New("malformed frame")
+	ErrVersion   = errors.New("unsupported protocol version")
+	ErrNotFound  = errors.New("not found")
+	ErrUnavail   = errors.New("service unavailable")
+	ErrTryAgain  = errors.New("temporary failure, try again")
+)
+
+type Frame struct {
+	Status Status
+	Fields []string
+}
+
+// Err maps the frame status to an error, OK and END frames return nil.
+func (f Frame) Err() error {
+	var err error
+
+	switch f.Status {
+	case StatusOK, StatusEnd:
+		return nil
+	case StatusNotFound:
+		err = ErrNotFound
+	case StatusTryAgain:
+		err = ErrTryAgain
+	default:
+		err = ErrUnavail
+	}
+
+	if len(f.Fields) > 0 && f.Fields[0] != "" {
+		return fmt.Errorf("%w: %s", err, f.Fields[0])
+	}
+
+	return err
+}
+
+// WriteFrame encodes f into w with a single write.
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Fields) > MaxFields {
+		return fmt.Errorf("%w: %d fields", ErrMalformed, len(f.Fields))
+	}
+
+	total := 0
+	for _, field := range f.Fields {
+		if len(field) > MaxFieldLen {
+			return fmt.Errorf("%w: field of %d bytes", ErrMalformed, len(field))
+		}
+		total += len(field)
+	}
+
+	if total > MaxFrameLen {
+		return fmt.Errorf("%w: frame of %d bytes", ErrMalformed, total)
+	}
+
+	buf := make([]byte, 0, 4+4*len(f.Fields)+total)
+	buf = append(buf, Version, byte(f.Status))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(f.Fields)))
+
+	for _, field := range f.Fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("write frame: %w", err)
+	}
+
+	return nil
+}
+
+// ReadFrame decodes the next frame from r.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [4]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, fmt.Errorf("read header: %w", err)
+	}
+
+	if header[0] != Version {
+		return Frame{}, fmt.Errorf("%w: %d", ErrVersion, header[0])
+	}
+
+	count := int(binary.BigEndian.Uint16(header[2:]))
+	if count > MaxFields {
+		return Frame{}, fmt.Errorf("%w: %d fields", ErrMalformed, count)
+	}
+
+	f := Frame{
+		Status: Status(header[1]),
+		Fields: make([]string, 0, count),
+	}
+
+	total := 0
+
+	for range count {
+		var length [4]byte
+
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return Frame{}, fmt.Errorf("read field length: %w", err)
+		}
+
+		n := int(binary.BigEndian.Uint32(length[:]))
+		if n > MaxFieldLen {
+			return Frame{}, fmt.Errorf("%w: field of %d bytes", ErrMalformed, n)
+		}
+
+		total += n
+		if total > MaxFrameLen {
+			return Frame{}, fmt.Errorf("%w: frame of %d bytes", ErrMalformed, total)
+		}
+
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return Frame{}, fmt.Errorf("read field: %w", err)
+		}
+
+		f.Fields = append(f.Fields, string(field))
+	}
+
+	return f, nil
+}
+
+type Request struct {
+	Command string
+	Args    []string
+	// Legacy is set for requests received in the whitespace separated
+	// text format.
+	Legacy bool
+}
+
+// ReadRequest reads a framed or a legacy text request from r.
+func ReadRequest(r *bufio.Reader) (Request, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return Request{}, fmt.Errorf("read request: %w", err)
+	}
+
+	if first[0] == Version {
+		f, err := ReadFrame(r)
+		if err != nil {
+			return Request{}, err
+		}
+
+		if len(f.Fields) == 0 || f.Fields[0] == "" {
+			return Request{}, fmt.Errorf("%w: missing command", ErrMalformed)
+		}
+
+		return Request{Command: f.Fields[0], Args: f.Fields[1:]}, nil
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Request{}, fmt.Errorf("read request: %w", err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Request{}, fmt.Errorf("%w: empty request", ErrMalformed)
+	}
+
+	return Request{Command: fields[0], Args: fields[1:], Legacy: true}, nil
+}
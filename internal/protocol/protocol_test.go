@@ -0,0 +1,137 @@
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/h2hsecure/sshkeyman/internal/protocol"
+	. "github.com/onsi/gomega"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	RegisterTestingT(t)
+
+	frames := []protocol.Frame{
+		{Status: protocol.StatusOK},
+		{Status: protocol.StatusOK, Fields: []string{"SETUSER", "alice", "ssh-ed25519", "AAAA", "alice laptop key"}},
+		{Status: protocol.StatusNotFound},
+		{Status: protocol.StatusEnd, Fields: []string{""}},
+	}
+
+	for _, f := range frames {
+		var buf bytes.Buffer
+
+		Expect(protocol.WriteFrame(&buf, f)).To(Succeed())
+
+		got, err := protocol.ReadFrame(&buf)
+		Expect(err).To(BeNil())
+		Expect(got.Status).To(Equal(f.Status))
+		Expect(got.Fields).To(HaveLen(len(f.Fields)))
+
+		for i := range f.Fields {
+			Expect(got.Fields[i]).To(Equal(f.Fields[i]))
+		}
+	}
+}
+
+func TestReadFrameLimits(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := protocol.ReadFrame(bytes.NewReader([]byte{0x02, 0, 0, 0}))
+	Expect(errors.Is(err, protocol.ErrVersion)).To(BeTrue())
+
+	_, err = protocol.ReadFrame(bytes.NewReader([]byte{protocol.Version, 0, 0xff, 0xff}))
+	Expect(errors.Is(err, protocol.ErrMalformed)).To(BeTrue())
+
+	_, err = protocol.ReadFrame(bytes.NewReader([]byte{protocol.Version, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}))
+	Expect(errors.Is(err, protocol.ErrMalformed)).To(BeTrue())
+
+	_, err = protocol.ReadFrame(bytes.NewReader([]byte{protocol.Version, 0, 0, 1, 0, 0, 0, 5, 'a'}))
+	Expect(err).NotTo(BeNil())
+
+	err = protocol.WriteFrame(&bytes.Buffer{}, protocol.Frame{Fields: []string{strings.Repeat("a", protocol.MaxFieldLen+1)}})
+	Expect(errors.Is(err, protocol.ErrMalformed)).To(BeTrue())
+}
+
+func TestReadRequest(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	Expect(protocol.WriteFrame(&buf, protocol.Frame{Fields: []string{"GETPWNAM", "alice smith"}})).To(Succeed())
+
+	req, err := protocol.ReadRequest(bufio.NewReader(&buf))
+	Expect(err).To(BeNil())
+	Expect(req.Legacy).To(BeFalse())
+	Expect(req.Command).To(Equal("GETPWNAM"))
+	Expect(req.Args).To(Equal([]string{"alice smith"}))
+
+	req, err = protocol.ReadRequest(bufio.NewReader(strings.NewReader("GETPWNAM alice\n")))
+	Expect(err).To(BeNil())
+	Expect(req.Legacy).To(BeTrue())
+	Expect(req.Command).To(Equal("GETPWNAM"))
+	Expect(req.Args).To(Equal([]string{"alice"}))
+
+	_, err = protocol.ReadRequest(bufio.NewReader(strings.NewReader("  \n")))
+	Expect(errors.Is(err, protocol.ErrMalformed)).To(BeTrue())
+}
+
+func FuzzReadFrame(f *testing.F) {
+	for _, frame := range []protocol.Frame{
+		{Status: protocol.StatusOK, Fields: []string{"GETSSHKEY", "alice"}},
+		{Status: protocol.StatusEnd},
+		{Status: protocol.StatusOK, Fields: []string{"ops", "x", "10001", "alice,bob"}},
+	} {
+		var buf bytes.Buffer
+		if err := protocol.WriteFrame(&buf, frame); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := protocol.ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := protocol.WriteFrame(&buf, frame); err != nil {
+			t.Fatalf("re-encoding decoded frame: %v", err)
+		}
+
+		again, err := protocol.ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("decoding re-encoded frame: %v", err)
+		}
+
+		if again.Status != frame.Status || len(again.Fields) != len(frame.Fields) {
+			t.Fatalf("round trip mismatch: %+v != %+v", again, frame)
+		}
+
+		for i := range frame.Fields {
+			if again.Fields[i] != frame.Fields[i] {
+				t.Fatalf("field %d mismatch: %q != %q", i, again.Fields[i], frame.Fields[i])
+			}
+		}
+	})
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte("GETPWNAM alice\n"))
+	f.Add([]byte("\n"))
+	f.Add([]byte{protocol.Version, 0, 0, 1, 0, 0, 0, 4, 'S', 'Y', 'N', 'C'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := protocol.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+
+		if req.Command == "" {
+			t.Fatalf("request without command: %+v", req)
+		}
+	})
+}
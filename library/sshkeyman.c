@@ -1,108 +1,428 @@
 #define _GNU_SOURCE
 #include <nss.h>
 #include <pwd.h>
+#include <grp.h>
+#include <shadow.h>
+#include <stdint.h>
+#include <stdlib.h>
 #include <string.h>
 #include <unistd.h>
+#include <pthread.h>
 #include <sys/socket.h>
+#include <sys/time.h>
 #include <sys/un.h>
 #include <errno.h>
 #include <stdio.h>
 
 #define SOCKET_PATH "/var/lib/sshkeyman/daemon.sock"
 #define BUF_SIZE 512
+#define TIMEOUT_SEC 3
+
+/* see internal/protocol/protocol.go for the wire format */
+#define PROTO_VERSION 0x01
+#define MAX_FIELDS 1024
+#define MAX_FIELD_LEN (64 * 1024)
+#define MAX_FRAME_LEN (1024 * 1024)
+
+#define STATUS_OK 0
+#define STATUS_NOTFOUND 1
+#define STATUS_UNAVAIL 2
+#define STATUS_TRYAGAIN 3
+#define STATUS_END 4
 
 #define GETPWNAM "GETPWNAM"
 #define GETPWUID "GETPWUID"
+#define GETPWENT "GETPWENT"
+#define GETGRNAM "GETGRNAM"
+#define GETGRGID "GETGRGID"
+#define INITGROUPS "INITGROUPS"
+#define GETSPNAM "GETSPNAM"
 
-static enum nss_status query_daemon(
-    const char *command,
-    const char *usernameOrId,
-    struct passwd *pwd,
-    char *buffer,
-    size_t buflen,
-    int *errnop)
+#define PASSWD_FIELDS 7
+#define GROUP_FIELDS 4
+#define SHADOW_FIELDS 8
+
+/* maximum frames of one GETPWENT page, the daemon sends less */
+#define ENT_MAX_FRAMES 256
+
+struct frame
+{
+    unsigned char status;
+    unsigned count;
+    char **fields; /* NUL terminated copies of the fields */
+    char *data;
+};
+
+/* enumeration state shared by setpwent/getpwent/endpwent */
+static pthread_mutex_t ent_lock = PTHREAD_MUTEX_INITIALIZER;
+static struct frame ent_frames[ENT_MAX_FRAMES];
+static unsigned ent_count = 0;
+static unsigned ent_index = 0;
+static char *ent_cursor = NULL;
+static int ent_done = 0;
+
+static void frame_free(struct frame *f)
+{
+    free(f->fields);
+    free(f->data);
+    memset(f, 0, sizeof(*f));
+}
+
+static int write_full(int fd, const unsigned char *buf, size_t len)
+{
+    while (len > 0)
+    {
+        ssize_t n = write(fd, buf, len);
+        if (n < 0 && errno == EINTR)
+        {
+            continue;
+        }
+        if (n <= 0)
+        {
+            return -1;
+        }
+        buf += n;
+        len -= n;
+    }
+
+    return 0;
+}
+
+static int read_full(int fd, unsigned char *buf, size_t len)
+{
+    while (len > 0)
+    {
+        ssize_t n = read(fd, buf, len);
+        if (n < 0 && errno == EINTR)
+        {
+            continue;
+        }
+        if (n <= 0)
+        {
+            return -1;
+        }
+        buf += n;
+        len -= n;
+    }
+
+    return 0;
+}
+
+static uint32_t get_u32(const unsigned char *p)
+{
+    return ((uint32_t)p[0] << 24) | ((uint32_t)p[1] << 16) | ((uint32_t)p[2] << 8) | p[3];
+}
+
+static void put_u32(unsigned char *p, uint32_t v)
 {
-    int fd = socket(AF_UNIX, SOCK_STREAM, 0);
+    p[0] = v >> 24;
+    p[1] = v >> 16;
+    p[2] = v >> 8;
+    p[3] = v;
+}
+
+/* connect to the daemon with a hard timeout, NSS must never block */
+static int connect_daemon(int *errnop)
+{
+    int fd = socket(AF_UNIX, SOCK_STREAM | SOCK_CLOEXEC, 0);
     if (fd < 0)
     {
         *errnop = errno;
-        return NSS_STATUS_UNAVAIL;
+        return -1;
     }
 
+    struct timeval tv = {.tv_sec = TIMEOUT_SEC, .tv_usec = 0};
+    setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+    setsockopt(fd, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
+
     struct sockaddr_un addr = {0};
     addr.sun_family = AF_UNIX;
     strncpy(addr.sun_path, SOCKET_PATH, sizeof(addr.sun_path) - 1);
 
     if (connect(fd, (struct sockaddr *)&addr, sizeof(addr)) < 0)
     {
-        close(fd);
         *errnop = errno;
-        return NSS_STATUS_UNAVAIL;
+        close(fd);
+        return -1;
     }
 
-    char request[BUF_SIZE];
-    snprintf(request, sizeof(request), "%s %s\n", command, usernameOrId);
-    write(fd, request, strlen(request));
+    return fd;
+}
 
-    char response[BUF_SIZE];
-    ssize_t n = read(fd, response, sizeof(response) - 1);
-    close(fd);
+/* send a request frame with the command and an optional argument */
+static int send_request(int fd, const char *command, const char *arg)
+{
+    size_t cmdlen = strlen(command);
+    size_t arglen = arg ? strlen(arg) : 0;
+
+    if (cmdlen + arglen + 12 > BUF_SIZE)
+    {
+        return -1;
+    }
+
+    unsigned char buf[BUF_SIZE];
+    unsigned char *p = buf;
+
+    *p++ = PROTO_VERSION;
+    *p++ = STATUS_OK;
+    *p++ = 0;
+    *p++ = arg ? 2 : 1;
+
+    put_u32(p, cmdlen);
+    p += 4;
+    memcpy(p, command, cmdlen);
+    p += cmdlen;
+
+    if (arg)
+    {
+        put_u32(p, arglen);
+        p += 4;
+        memcpy(p, arg, arglen);
+        p += arglen;
+    }
+
+    return write_full(fd, buf, p - buf);
+}
+
+/* read one frame, fields are copied into freshly allocated memory */
+static int read_frame(int fd, struct frame *f)
+{
+    unsigned char header[4];
+
+    memset(f, 0, sizeof(*f));
+
+    if (read_full(fd, header, sizeof(header)) < 0)
+    {
+        return -1;
+    }
+
+    if (header[0] != PROTO_VERSION)
+    {
+        return -1;
+    }
+
+    f->status = header[1];
+    f->count = ((unsigned)header[2] << 8) | header[3];
+
+    if (f->count > MAX_FIELDS)
+    {
+        return -1;
+    }
+
+    f->fields = calloc(f->count + 1, sizeof(char *));
+    size_t *offsets = calloc(f->count + 1, sizeof(size_t));
+    if (f->fields == NULL || offsets == NULL)
+    {
+        free(offsets);
+        frame_free(f);
+        return -1;
+    }
+
+    size_t total = 0, datalen = 0, capacity = 0;
+
+    for (unsigned i = 0; i < f->count; i++)
+    {
+        unsigned char lenbuf[4];
+        if (read_full(fd, lenbuf, sizeof(lenbuf)) < 0)
+        {
+            goto fail;
+        }
+
+        uint32_t len = get_u32(lenbuf);
+        if (len > MAX_FIELD_LEN || total + len > MAX_FRAME_LEN)
+        {
+            goto fail;
+        }
+        total += len;
+
+        if (datalen + len + 1 > capacity)
+        {
+            size_t newcap = capacity ? capacity * 2 : 256;
+            while (newcap < datalen + len + 1)
+            {
+                newcap *= 2;
+            }
+
+            char *data = realloc(f->data, newcap);
+            if (data == NULL)
+            {
+                goto fail;
+            }
+            f->data = data;
+            capacity = newcap;
+        }
+
+        if (read_full(fd, (unsigned char *)f->data + datalen, len) < 0)
+        {
+            goto fail;
+        }
+
+        /* fields must not contain NUL bytes, they end up in C strings */
+        if (memchr(f->data + datalen, '\0', len) != NULL)
+        {
+            goto fail;
+        }
+
+        offsets[i] = datalen;
+        f->data[datalen + len] = '\0';
+        datalen += len + 1;
+    }
 
-    if (n <= 0)
+    for (unsigned i = 0; i < f->count; i++)
     {
+        f->fields[i] = f->data + offsets[i];
+    }
+
+    free(offsets);
+    return 0;
+
+fail:
+    free(offsets);
+    frame_free(f);
+    return -1;
+}
+
+/* map the response status to the NSS status */
+static enum nss_status status_of(const struct frame *f, int *errnop)
+{
+    switch (f->status)
+    {
+    case STATUS_OK:
+    case STATUS_END:
+        return NSS_STATUS_SUCCESS;
+    case STATUS_NOTFOUND:
+        return NSS_STATUS_NOTFOUND;
+    case STATUS_TRYAGAIN:
+        *errnop = EAGAIN;
+        return NSS_STATUS_TRYAGAIN;
+    default:
         *errnop = EIO;
         return NSS_STATUS_UNAVAIL;
     }
+}
 
-    response[n] = '\0';
+/* send a single request and read the first response frame */
+static enum nss_status call_daemon(
+    const char *command,
+    const char *arg,
+    struct frame *f,
+    int *errnop)
+{
+    int fd = connect_daemon(errnop);
+    if (fd < 0)
+    {
+        return NSS_STATUS_UNAVAIL;
+    }
 
-    if (strncmp(response, "NOTFOUND", 8) == 0)
+    if (send_request(fd, command, arg) < 0 || read_frame(fd, f) < 0)
     {
-        return NSS_STATUS_NOTFOUND;
+        close(fd);
+        *errnop = EIO;
+        return NSS_STATUS_UNAVAIL;
+    }
+    close(fd);
+
+    enum nss_status status = status_of(f, errnop);
+    if (status != NSS_STATUS_SUCCESS)
+    {
+        frame_free(f);
     }
 
-    unsigned uid, gid;
-    char username[128], home[128], shell[128];
+    return status;
+}
+
+/* copy src into the caller buffer, returns NULL when it does not fit */
+static char *buf_copy(char **p, size_t *left, const char *src)
+{
+    size_t len = strlen(src) + 1;
+    if (len > *left)
+    {
+        return NULL;
+    }
+
+    char *dst = *p;
+    memcpy(dst, src, len);
+    *p += len;
+    *left -= len;
+
+    return dst;
+}
+
+static int parse_id(const char *s, unsigned long *out)
+{
+    char *end;
+    errno = 0;
+    *out = strtoul(s, &end, 10);
+
+    return (errno != 0 || end == s || *end != '\0') ? -1 : 0;
+}
+
+static int parse_long(const char *s, long *out)
+{
+    char *end;
+    errno = 0;
+    *out = strtol(s, &end, 10);
+
+    return (errno != 0 || end == s || *end != '\0') ? -1 : 0;
+}
+
+/* fill pwd from a passwd frame: name, passwd, uid, gid, gecos, dir, shell */
+static enum nss_status fill_passwd(
+    const struct frame *f,
+    struct passwd *pwd,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    unsigned long uid, gid;
 
-    if (sscanf(response, "OK %127s %u %u %127s %127s", username, &uid, &gid, home, shell) != 5)
+    if (f->count != PASSWD_FIELDS ||
+        parse_id(f->fields[2], &uid) < 0 ||
+        parse_id(f->fields[3], &gid) < 0)
     {
         *errnop = EINVAL;
         return NSS_STATUS_UNAVAIL;
     }
 
-    size_t needed =
-        strlen(usernameOrId) + 1 +
-        strlen(home) + 1 +
-        strlen(shell) + 1;
+    char *p = buffer;
+    size_t left = buflen;
 
-    if (needed > buflen)
+    if ((pwd->pw_name = buf_copy(&p, &left, f->fields[0])) == NULL ||
+        (pwd->pw_passwd = buf_copy(&p, &left, f->fields[1])) == NULL ||
+        (pwd->pw_gecos = buf_copy(&p, &left, f->fields[4])) == NULL ||
+        (pwd->pw_dir = buf_copy(&p, &left, f->fields[5])) == NULL ||
+        (pwd->pw_shell = buf_copy(&p, &left, f->fields[6])) == NULL)
     {
         *errnop = ERANGE;
         return NSS_STATUS_TRYAGAIN;
     }
 
-    char *p = buffer;
-
-    pwd->pw_name = p;
-    strcpy(p, username);
-    p += strlen(p) + 1;
-
-    pwd->pw_passwd = (char *)"x";
     pwd->pw_uid = uid;
     pwd->pw_gid = gid;
 
-    pwd->pw_gecos = p;
-    strcpy(p, username);
-    p += strlen(p) + 1;
+    return NSS_STATUS_SUCCESS;
+}
 
-    pwd->pw_dir = p;
-    strcpy(p, home);
-    p += strlen(p) + 1;
+static enum nss_status query_passwd(
+    const char *command,
+    const char *usernameOrId,
+    struct passwd *pwd,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    struct frame f;
 
-    pwd->pw_shell = p;
-    strcpy(p, shell);
+    enum nss_status status = call_daemon(command, usernameOrId, &f, errnop);
+    if (status != NSS_STATUS_SUCCESS)
+    {
+        return status;
+    }
 
-    return NSS_STATUS_SUCCESS;
+    status = fill_passwd(&f, pwd, buffer, buflen, errnop);
+    frame_free(&f);
+
+    return status;
 }
 
 enum nss_status _nss_sshkeyman_getpwnam_r(
@@ -112,7 +432,7 @@ enum nss_status _nss_sshkeyman_getpwnam_r(
     size_t buflen,
     int *errnop)
 {
-    return query_daemon(GETPWNAM, name, pwd, buffer, buflen, errnop);
+    return query_passwd(GETPWNAM, name, pwd, buffer, buflen, errnop);
 }
 
 enum nss_status _nss_sshkeyman_getpwuid_r(
@@ -124,5 +444,413 @@ enum nss_status _nss_sshkeyman_getpwuid_r(
 {
     char uidstr[32];
     snprintf(uidstr, sizeof(uidstr), "%u", uid);
-    return query_daemon(GETPWUID, uidstr, pwd, buffer, buflen, errnop);
-}
\ No newline at end of file
+    return query_passwd(GETPWUID, uidstr, pwd, buffer, buflen, errnop);
+}
+
+static void clear_ent_page(void)
+{
+    for (unsigned i = 0; i < ent_count; i++)
+    {
+        frame_free(&ent_frames[i]);
+    }
+    ent_count = 0;
+    ent_index = 0;
+}
+
+static void reset_ent(void)
+{
+    clear_ent_page();
+    free(ent_cursor);
+    ent_cursor = NULL;
+    ent_done = 0;
+}
+
+enum nss_status _nss_sshkeyman_setpwent(int stayopen)
+{
+    (void)stayopen;
+
+    pthread_mutex_lock(&ent_lock);
+    reset_ent();
+    pthread_mutex_unlock(&ent_lock);
+
+    return NSS_STATUS_SUCCESS;
+}
+
+enum nss_status _nss_sshkeyman_endpwent(void)
+{
+    pthread_mutex_lock(&ent_lock);
+    reset_ent();
+    pthread_mutex_unlock(&ent_lock);
+
+    return NSS_STATUS_SUCCESS;
+}
+
+/* fetch the page after ent_cursor, the page is only kept when complete */
+static enum nss_status fetch_ent_page(int *errnop)
+{
+    clear_ent_page();
+
+    int fd = connect_daemon(errnop);
+    if (fd < 0)
+    {
+        ent_done = 1;
+        return NSS_STATUS_UNAVAIL;
+    }
+
+    if (send_request(fd, GETPWENT, ent_cursor) < 0)
+    {
+        close(fd);
+        ent_done = 1;
+        *errnop = EIO;
+        return NSS_STATUS_UNAVAIL;
+    }
+
+    enum nss_status status = NSS_STATUS_SUCCESS;
+
+    for (;;)
+    {
+        struct frame f;
+
+        if (read_frame(fd, &f) < 0)
+        {
+            *errnop = EIO;
+            status = NSS_STATUS_UNAVAIL;
+            break;
+        }
+
+        if (f.status == STATUS_END)
+        {
+            free(ent_cursor);
+            ent_cursor = f.count == 1 ? strdup(f.fields[0]) : NULL;
+            ent_done = ent_cursor == NULL;
+            frame_free(&f);
+            break;
+        }
+
+        status = status_of(&f, errnop);
+        if (status == NSS_STATUS_SUCCESS && ent_count == ENT_MAX_FRAMES)
+        {
+            *errnop = EIO;
+            status = NSS_STATUS_UNAVAIL;
+        }
+        if (status != NSS_STATUS_SUCCESS)
+        {
+            frame_free(&f);
+            break;
+        }
+
+        ent_frames[ent_count++] = f;
+    }
+    close(fd);
+
+    if (status != NSS_STATUS_SUCCESS)
+    {
+        clear_ent_page();
+        ent_done = 1;
+    }
+
+    return status;
+}
+
+enum nss_status _nss_sshkeyman_getpwent_r(
+    struct passwd *pwd,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    enum nss_status status = NSS_STATUS_NOTFOUND;
+
+    pthread_mutex_lock(&ent_lock);
+
+    for (;;)
+    {
+        if (ent_index == ent_count)
+        {
+            if (ent_done)
+            {
+                status = NSS_STATUS_NOTFOUND;
+                break;
+            }
+
+            status = fetch_ent_page(errnop);
+            if (status != NSS_STATUS_SUCCESS)
+            {
+                break;
+            }
+
+            continue;
+        }
+
+        status = fill_passwd(&ent_frames[ent_index], pwd, buffer, buflen, errnop);
+        if (status == NSS_STATUS_TRYAGAIN)
+        {
+            /* caller retries with a bigger buffer, keep the entry */
+            break;
+        }
+
+        ent_index++;
+
+        if (status == NSS_STATUS_SUCCESS)
+        {
+            break;
+        }
+    }
+
+    pthread_mutex_unlock(&ent_lock);
+
+    return status;
+}
+
+/* fill grp from a group frame: name, passwd, gid, comma separated members */
+static enum nss_status fill_group(
+    const struct frame *f,
+    struct group *grp,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    unsigned long gid;
+
+    if (f->count != GROUP_FIELDS || parse_id(f->fields[2], &gid) < 0)
+    {
+        *errnop = EINVAL;
+        return NSS_STATUS_UNAVAIL;
+    }
+
+    const char *members = f->fields[3];
+
+    size_t count = 0;
+    if (*members != '\0')
+    {
+        count = 1;
+        for (const char *c = members; *c; c++)
+        {
+            if (*c == ',')
+            {
+                count++;
+            }
+        }
+    }
+
+    /* member pointer array goes first and must be aligned */
+    size_t align = (-(uintptr_t)buffer) & (__alignof__(char *) - 1);
+    size_t ptrs = (count + 1) * sizeof(char *);
+
+    if (align + ptrs > buflen)
+    {
+        *errnop = ERANGE;
+        return NSS_STATUS_TRYAGAIN;
+    }
+
+    char **mem = (char **)(buffer + align);
+    char *p = (char *)(mem + count + 1);
+    size_t left = buflen - align - ptrs;
+
+    char *list;
+    if ((grp->gr_name = buf_copy(&p, &left, f->fields[0])) == NULL ||
+        (grp->gr_passwd = buf_copy(&p, &left, f->fields[1])) == NULL ||
+        (list = buf_copy(&p, &left, members)) == NULL)
+    {
+        *errnop = ERANGE;
+        return NSS_STATUS_TRYAGAIN;
+    }
+
+    grp->gr_gid = gid;
+
+    size_t i = 0;
+    if (count > 0)
+    {
+        mem[i++] = list;
+        for (char *c = list; *c; c++)
+        {
+            if (*c == ',')
+            {
+                *c = '\0';
+                mem[i++] = c + 1;
+            }
+        }
+    }
+    mem[i] = NULL;
+    grp->gr_mem = mem;
+
+    return NSS_STATUS_SUCCESS;
+}
+
+static enum nss_status query_group(
+    const char *command,
+    const char *nameOrId,
+    struct group *grp,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    struct frame f;
+
+    enum nss_status status = call_daemon(command, nameOrId, &f, errnop);
+    if (status != NSS_STATUS_SUCCESS)
+    {
+        return status;
+    }
+
+    status = fill_group(&f, grp, buffer, buflen, errnop);
+    frame_free(&f);
+
+    return status;
+}
+
+enum nss_status _nss_sshkeyman_getgrnam_r(
+    const char *name,
+    struct group *grp,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    return query_group(GETGRNAM, name, grp, buffer, buflen, errnop);
+}
+
+enum nss_status _nss_sshkeyman_getgrgid_r(
+    gid_t gid,
+    struct group *grp,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    char gidstr[32];
+    snprintf(gidstr, sizeof(gidstr), "%u", gid);
+    return query_group(GETGRGID, gidstr, grp, buffer, buflen, errnop);
+}
+
+enum nss_status _nss_sshkeyman_initgroups_dyn(
+    const char *user,
+    gid_t group,
+    long int *start,
+    long int *size,
+    gid_t **groupsp,
+    long int limit,
+    int *errnop)
+{
+    struct frame f;
+
+    enum nss_status status = call_daemon(INITGROUPS, user, &f, errnop);
+    if (status != NSS_STATUS_SUCCESS)
+    {
+        return status;
+    }
+
+    for (unsigned n = 0; n < f.count; n++)
+    {
+        unsigned long gid;
+        if (parse_id(f.fields[n], &gid) < 0)
+        {
+            continue;
+        }
+
+        /* primary group is already in the list */
+        if ((gid_t)gid == group)
+        {
+            continue;
+        }
+
+        int dup = 0;
+        for (long int i = 0; i < *start; i++)
+        {
+            if ((*groupsp)[i] == (gid_t)gid)
+            {
+                dup = 1;
+                break;
+            }
+        }
+        if (dup)
+        {
+            continue;
+        }
+
+        if (*start == *size)
+        {
+            if (limit > 0 && *size >= limit)
+            {
+                break;
+            }
+
+            long int newsize = *size > 0 ? *size * 2 : 8;
+            if (limit > 0 && newsize > limit)
+            {
+                newsize = limit;
+            }
+
+            gid_t *newgroups = realloc(*groupsp, newsize * sizeof(gid_t));
+            if (newgroups == NULL)
+            {
+                *errnop = ENOMEM;
+                status = NSS_STATUS_TRYAGAIN;
+                break;
+            }
+
+            *groupsp = newgroups;
+            *size = newsize;
+        }
+
+        (*groupsp)[(*start)++] = (gid_t)gid;
+    }
+
+    frame_free(&f);
+    return status;
+}
+
+/* shadow frame: name, passwd, lastchg, min, max, warn, inact, expire */
+enum nss_status _nss_sshkeyman_getspnam_r(
+    const char *name,
+    struct spwd *spw,
+    char *buffer,
+    size_t buflen,
+    int *errnop)
+{
+    struct frame f;
+
+    enum nss_status status = call_daemon(GETSPNAM, name, &f, errnop);
+    if (status != NSS_STATUS_SUCCESS)
+    {
+        return status;
+    }
+
+    long values[SHADOW_FIELDS - 2];
+
+    if (f.count != SHADOW_FIELDS)
+    {
+        frame_free(&f);
+        *errnop = EINVAL;
+        return NSS_STATUS_UNAVAIL;
+    }
+
+    for (unsigned i = 2; i < SHADOW_FIELDS; i++)
+    {
+        if (parse_long(f.fields[i], &values[i - 2]) < 0)
+        {
+            frame_free(&f);
+            *errnop = EINVAL;
+            return NSS_STATUS_UNAVAIL;
+        }
+    }
+
+    char *p = buffer;
+    size_t left = buflen;
+
+    if ((spw->sp_namp = buf_copy(&p, &left, f.fields[0])) == NULL ||
+        (spw->sp_pwdp = buf_copy(&p, &left, f.fields[1])) == NULL)
+    {
+        frame_free(&f);
+        *errnop = ERANGE;
+        return NSS_STATUS_TRYAGAIN;
+    }
+
+    spw->sp_lstchg = values[0];
+    spw->sp_min = values[1];
+    spw->sp_max = values[2];
+    spw->sp_warn = values[3];
+    spw->sp_inact = values[4];
+    spw->sp_expire = values[5];
+    spw->sp_flag = ~0ul;
+
+    frame_free(&f);
+    return NSS_STATUS_SUCCESS;
+}